@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"os"
+	"time"
+
+	"github.com/yansal/youtube-ar/api/broker"
+	"github.com/yansal/youtube-ar/api/log"
+	"github.com/yansal/youtube-ar/api/worker"
+	"golang.org/x/sync/errgroup"
+)
+
+// runAllInOne runs the server and the worker in one process, sharing an
+// in-memory broker, so that redis isn't required.
+func runAllInOne(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("all-in-one", flag.ExitOnError)
+	var (
+		concurrency, timeouts string
+		grace                 time.Duration
+	)
+	fs.StringVar(&concurrency, "concurrency", os.Getenv("WORKER_CONCURRENCY"), "comma-separated queue=n goroutines, e.g. download-url=4,get-oembed=8")
+	fs.StringVar(&timeouts, "timeout", defaultTimeouts(), "comma-separated queue=duration job deadlines, e.g. download-url=2h,get-oembed=1m")
+	fs.DurationVar(&grace, "grace-period", defaultGracePeriod(), "grace period of running jobs on shutdown, before they are requeued")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	c, err := worker.ParseConcurrency(concurrency)
+	if err != nil {
+		return err
+	}
+	t, err := worker.ParseTimeouts(timeouts)
+	if err != nil {
+		return err
+	}
+
+	log := log.New()
+	db, err := newDB(log)
+	if err != nil {
+		return err
+	}
+	b := broker.NewMemory(log)
+
+	g, ctx := errgroup.WithContext(ctx)
+	g.Go(func() error { return serve(ctx, log, db, b) })
+	g.Go(func() error { return work(ctx, log, db, b, c, t, grace) })
+	return g.Wait()
+}
@@ -2,112 +2,116 @@ package broker
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"time"
 
-	"github.com/go-redis/redis"
 	"github.com/yansal/youtube-ar/api/log"
 )
 
-// New returns a new Broker.
-func New(r Redis, log log.Logger) *Broker {
-	return &Broker{redis: r, log: log}
+// Broker is the interface implemented by brokers.
+type Broker interface {
+	// Send sends payload to queue, with priority.
+	Send(ctx context.Context, queue string, payload string, priority Priority) error
+	// SendAt schedules payload to be sent to queue at t, with priority.
+	SendAt(ctx context.Context, queue string, payload string, priority Priority, t time.Time) error
+	// SendAfter schedules payload to be sent to queue after d, with priority.
+	SendAfter(ctx context.Context, queue string, payload string, priority Priority, d time.Duration) error
+	// Promote sends the scheduled payloads of queue that are due.
+	Promote(ctx context.Context, queue string) (int, error)
+	// Receive receives next job from queue and calls handler. Jobs with a
+	// higher priority are received first.
+	Receive(ctx context.Context, queue string, handler Handler) error
+	// Reap requeues the in-flight jobs of queue whose lease has expired.
+	Reap(ctx context.Context, queue string, fail bool) (int, error)
+	// PopNextFailed pops next job from failed queue.
+	PopNextFailed(ctx context.Context, queue string) (*Job, error)
+	// RemFailed removes the job wrapping payload from failed queue.
+	RemFailed(ctx context.Context, queue string, payload string) error
+	// ListFailed lists the jobs of failed queue, most recent first.
+	ListFailed(ctx context.Context, queue string, offset, limit int64) ([]*Job, error)
+	// CountFailed counts the jobs of failed queue.
+	CountFailed(ctx context.Context, queue string) (int64, error)
+	// GetFailed gets the job with id from failed queue.
+	GetFailed(ctx context.Context, queue string, id string) (*Job, error)
+	// RequeueFailed moves the job with id from failed queue back to queue.
+	RequeueFailed(ctx context.Context, queue string, id string) error
+	// PurgeFailed removes all jobs from failed queue.
+	PurgeFailed(ctx context.Context, queue string) (int64, error)
+	// Publish publishes message to the subscribers of channel.
+	Publish(ctx context.Context, channel string, message string) error
+	// Subscribe subscribes to channel. The returned chan is closed when ctx
+	// is done.
+	Subscribe(ctx context.Context, channel string) (<-chan string, error)
+	// Release moves the in-flight job with id back to queue, e.g. when the
+	// worker handling it is stale.
+	Release(ctx context.Context, queue string, id string) error
+	// Beat records the heartbeat of a worker.
+	Beat(ctx context.Context, h *Heartbeat) error
+	// ListHeartbeats lists the last heartbeat of each worker.
+	ListHeartbeats(ctx context.Context) ([]*Heartbeat, error)
+	// RemoveHeartbeat removes the heartbeat of the worker with id.
+	RemoveHeartbeat(ctx context.Context, id string) error
 }
 
-// Redis is the redis interface required by Broker.
-type Redis interface {
-	LPush(key string, values ...interface{}) *redis.IntCmd
-	BRPopLPush(source, destination string, timeout time.Duration) *redis.StringCmd
-	LRem(key string, count int64, value interface{}) *redis.IntCmd
-	RPop(key string) *redis.StringCmd
-}
-
-// Broker is a broker.
-type Broker struct {
-	log   log.Logger
-	redis Redis
-}
-
-// Send sends payload to queue.
-func (b *Broker) Send(ctx context.Context, queue string, payload string) error {
-	return b.redis.LPush(queue, payload).Err()
-}
+var (
+	_ Broker = &RedisBroker{}
+	_ Broker = &PostgresBroker{}
+	_ Broker = &MemoryBroker{}
+)
 
-// Receive pops next item from queue and calls handler.
-func (b *Broker) Receive(ctx context.Context, queue string, handler Handler) error {
-	fields := []log.Field{log.String("queue", queue)}
-	tmp := queue + ":tmp"
+// Handler is a broker handler.
+type Handler func(ctx context.Context, payload string) error
 
-	var (
-		payload string
-		err     error
-	)
-	c := make(chan struct{})
-	go func() {
-		payload, err = b.redis.BRPopLPush(queue, tmp, 0).Result()
-		c <- struct{}{}
-	}()
+// LeaseTimeout is the duration after which an in-flight job whose lease
+// hasn't been renewed is considered abandoned, and can be reaped.
+const LeaseTimeout = time.Minute
+
+var (
+	// ErrLeaseExpired is the error recorded on jobs whose lease has expired.
+	ErrLeaseExpired = errors.New("lease expired")
+	// ErrNoJob is returned when there is no job to pop, or no job with a
+	// given id.
+	ErrNoJob = errors.New("broker: no job")
+	// ErrRequeue is returned by handlers interrupted before completing their
+	// job, e.g. on shutdown. The job is sent back to its queue instead of the
+	// failed queue, and the attempt isn't counted.
+	ErrRequeue = errors.New("broker: requeue")
+)
 
-	select {
-	case <-ctx.Done():
-		return ctx.Err()
-	case <-c:
+// handle calls handler with the payload of job, and records the handler error
+// or panic on job.
+func handle(ctx context.Context, logger log.Logger, queue string, job *Job, handler Handler) (herr error) {
+	job.Attempts++
+	if job.TraceID != "" {
+		ctx = WithTraceID(ctx, job.TraceID)
 	}
-
-	if err == redis.Nil {
-		return nil
-	} else if err != nil {
-		return err
+	ctx = WithJobID(ctx, job.ID)
+	fields := []log.Field{
+		log.String("queue", queue),
+		log.String("payload", job.Payload),
+		log.String("job_id", job.ID),
+		log.String("trace_id", job.TraceID),
+		log.Int("attempts", job.Attempts),
 	}
 
-	fields = append(fields, log.String("payload", payload))
-
-	defer func() {
-		if err := b.redis.LRem(tmp, 1, payload).Err(); err != nil {
-			b.log.Log(ctx, err.Error())
-		}
-	}()
-
-	var (
-		start = time.Now()
-		herr  error
-	)
+	start := time.Now()
 	defer func() {
 		fields = append(fields, log.Stringer("duration", time.Since(start)))
 		if r := recover(); r != nil {
 			herr = fmt.Errorf("%s", r)
 		}
 		if herr == nil {
-			b.log.Log(ctx, queue+": "+payload, fields...)
+			logger.Log(ctx, queue+": "+job.Payload, fields...)
 			return
 		}
-
-		b.log.Log(ctx, herr.Error(), fields...)
-
-		if ctx.Err() != nil {
-			var cancel context.CancelFunc
-			ctx, cancel = context.WithTimeout(context.Background(), time.Second)
-			defer cancel()
-		}
-		failed := queue + ":failed"
-		if err := b.Send(ctx, failed, payload); err != nil {
-			b.log.Log(ctx, err.Error())
+		logger.Log(ctx, herr.Error(), fields...)
+		if herr == ErrRequeue {
+			job.Attempts--
+			return
 		}
+		job.Fail(herr)
 	}()
 
-	herr = handler(ctx, payload)
-	return nil
-}
-
-// Handler is a broker handler.
-type Handler func(ctx context.Context, payload string) error
-
-// PopNextFailed pops next element from failed queue.
-func (b *Broker) PopNextFailed(ctx context.Context, queue string) (string, error) {
-	return b.redis.RPop(queue + ":failed").Result()
-}
-
-// RemFailed removes payload from failed queue.
-func (b *Broker) RemFailed(ctx context.Context, queue string, payload string) error {
-	return b.redis.LRem(queue+":failed", 1, payload).Err()
+	return handler(ctx, job.Payload)
 }
@@ -0,0 +1,65 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// HeartbeatInterval is the interval at which workers send heartbeats.
+const HeartbeatInterval = 10 * time.Second
+
+// HeartbeatTimeout is the duration after which a worker that hasn't sent a
+// heartbeat is considered stale. The in-flight jobs of stale workers can be
+// released.
+const HeartbeatTimeout = 3 * HeartbeatInterval
+
+// ErrWorkerStale is the error recorded on the jobs released from stale
+// workers.
+var ErrWorkerStale = errors.New("worker stale")
+
+// Heartbeat is the state of a worker, sent periodically.
+type Heartbeat struct {
+	ID        string       `json:"id"`
+	Host      string       `json:"host"`
+	PID       int          `json:"pid"`
+	Queues    []string     `json:"queues"`
+	Jobs      []RunningJob `json:"jobs"`
+	StartedAt time.Time    `json:"started_at"`
+	SeenAt    time.Time    `json:"seen_at"`
+}
+
+// RunningJob is a job being handled by a worker.
+type RunningJob struct {
+	ID        string    `json:"id"`
+	Queue     string    `json:"queue"`
+	StartedAt time.Time `json:"started_at"`
+}
+
+// Stale returns whether the worker of h hasn't sent a heartbeat for more than
+// HeartbeatTimeout at now.
+func (h *Heartbeat) Stale(now time.Time) bool {
+	return now.Sub(h.SeenAt) > HeartbeatTimeout
+}
+
+func parseHeartbeat(s string) (*Heartbeat, error) {
+	var h Heartbeat
+	if err := json.Unmarshal([]byte(s), &h); err != nil {
+		return nil, err
+	}
+	return &h, nil
+}
+
+type jobIDContextKey struct{}
+
+// WithJobID returns a copy of ctx associated with jobID.
+func WithJobID(ctx context.Context, jobID string) context.Context {
+	return context.WithValue(ctx, jobIDContextKey{}, jobID)
+}
+
+// JobID returns the id of the job being handled with ctx.
+func JobID(ctx context.Context) string {
+	jobID, _ := ctx.Value(jobIDContextKey{}).(string)
+	return jobID
+}
@@ -0,0 +1,107 @@
+package broker
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+)
+
+// JobVersion is the current version of the Job envelope.
+const JobVersion = 1
+
+// Job is the envelope wrapping payloads sent to queues.
+type Job struct {
+	Version    int        `json:"v"`
+	ID         string     `json:"id"`
+	Queue      string     `json:"queue"`
+	Attempts   int        `json:"attempts"`
+	EnqueuedAt time.Time  `json:"enqueued_at"`
+	LastError  string     `json:"last_error,omitempty"`
+	Errors     []JobError `json:"errors,omitempty"`
+	TraceID    string     `json:"trace_id,omitempty"`
+	Priority   Priority   `json:"priority,omitempty"`
+	Payload    string     `json:"payload"`
+}
+
+// JobError is a job error.
+type JobError struct {
+	Attempt int       `json:"attempt"`
+	At      time.Time `json:"at"`
+	Error   string    `json:"error"`
+}
+
+// NewJob returns a new Job wrapping payload, with priority. The job inherits
+// the trace id of ctx, if any.
+func NewJob(ctx context.Context, queue string, payload string, priority Priority) *Job {
+	id := newID()
+	traceID := TraceID(ctx)
+	if traceID == "" {
+		traceID = id
+	}
+	return &Job{
+		Version:    JobVersion,
+		ID:         id,
+		Queue:      queue,
+		EnqueuedAt: time.Now(),
+		TraceID:    traceID,
+		Priority:   priority,
+		Payload:    payload,
+	}
+}
+
+// ParseJob parses a job envelope from s. Legacy bare payloads are wrapped in
+// a job with a zero version and no id.
+func ParseJob(queue string, s string) *Job {
+	var job Job
+	if err := json.Unmarshal([]byte(s), &job); err != nil || job.Version == 0 {
+		return &Job{Queue: queue, Payload: s}
+	}
+	return &job
+}
+
+// Fail records err as the error of the current attempt.
+func (j *Job) Fail(err error) {
+	j.LastError = err.Error()
+	j.Errors = append(j.Errors, JobError{
+		Attempt: j.Attempts,
+		At:      time.Now(),
+		Error:   err.Error(),
+	})
+}
+
+// Encode returns the json encoding of j, upgraded to the current version.
+func (j *Job) Encode() (string, error) {
+	if j.Version == 0 {
+		j.Version = JobVersion
+		j.ID = newID()
+		j.TraceID = j.ID
+	}
+	b, err := json.Marshal(j)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+func newID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+type traceIDContextKey struct{}
+
+// WithTraceID returns a copy of ctx associated with traceID.
+func WithTraceID(ctx context.Context, traceID string) context.Context {
+	return context.WithValue(ctx, traceIDContextKey{}, traceID)
+}
+
+// TraceID returns the trace id associated with ctx.
+func TraceID(ctx context.Context) string {
+	traceID, _ := ctx.Value(traceIDContextKey{}).(string)
+	return traceID
+}
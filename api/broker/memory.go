@@ -0,0 +1,419 @@
+package broker
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/yansal/youtube-ar/api/log"
+)
+
+// NewMemory returns a new MemoryBroker.
+func NewMemory(log log.Logger) *MemoryBroker {
+	return &MemoryBroker{
+		log:         log,
+		queues:      make(map[string]*memoryQueue),
+		subscribers: make(map[string][]chan string),
+		heartbeats:  make(map[string]Heartbeat),
+	}
+}
+
+// MemoryBroker is an in-process broker, with the same semantics as
+// RedisBroker. Jobs are lost when the process exits.
+type MemoryBroker struct {
+	log log.Logger
+
+	mu          sync.Mutex
+	queues      map[string]*memoryQueue
+	subscribers map[string][]chan string
+	heartbeats  map[string]Heartbeat
+}
+
+type memoryQueue struct {
+	// ready holds the ready jobs by priority rank, highest first.
+	ready     [][]string
+	inflight  map[string]time.Time
+	failed    []string
+	scheduled map[string]time.Time
+	// notify is closed and replaced when a job is pushed to ready.
+	notify chan struct{}
+}
+
+// queue returns the queue with name, b.mu must be held.
+func (b *MemoryBroker) queue(name string) *memoryQueue {
+	q, ok := b.queues[name]
+	if !ok {
+		q = &memoryQueue{
+			ready:     make([][]string, len(Priorities)),
+			inflight:  make(map[string]time.Time),
+			scheduled: make(map[string]time.Time),
+			notify:    make(chan struct{}),
+		}
+		b.queues[name] = q
+	}
+	return q
+}
+
+// push pushes raw to the ready jobs of q, b.mu must be held.
+func (q *memoryQueue) push(raw string) {
+	r := ParseJob("", raw).Priority.rank()
+	q.ready[r] = append(q.ready[r], raw)
+	close(q.notify)
+	q.notify = make(chan struct{})
+}
+
+// pop pops next ready job of q, highest priority first, b.mu must be held.
+func (q *memoryQueue) pop() (string, bool) {
+	for r := range q.ready {
+		if len(q.ready[r]) > 0 {
+			raw := q.ready[r][0]
+			q.ready[r] = q.ready[r][1:]
+			return raw, true
+		}
+	}
+	return "", false
+}
+
+// Send sends payload to queue, with priority.
+func (b *MemoryBroker) Send(ctx context.Context, queue string, payload string, priority Priority) error {
+	raw, err := NewJob(ctx, queue, payload, priority).Encode()
+	if err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.queue(queue).push(raw)
+	return nil
+}
+
+// SendAt schedules payload to be sent to queue at t, with priority.
+func (b *MemoryBroker) SendAt(ctx context.Context, queue string, payload string, priority Priority, t time.Time) error {
+	raw, err := NewJob(ctx, queue, payload, priority).Encode()
+	if err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.queue(queue).scheduled[raw] = t
+	return nil
+}
+
+// SendAfter schedules payload to be sent to queue after d, with priority.
+func (b *MemoryBroker) SendAfter(ctx context.Context, queue string, payload string, priority Priority, d time.Duration) error {
+	return b.SendAt(ctx, queue, payload, priority, time.Now().Add(d))
+}
+
+// Promote sends the scheduled payloads of queue that are due. It returns the
+// number of promoted payloads.
+func (b *MemoryBroker) Promote(ctx context.Context, queue string) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	q := b.queue(queue)
+	now := time.Now()
+	var n int
+	for raw, t := range q.scheduled {
+		if t.After(now) {
+			continue
+		}
+		delete(q.scheduled, raw)
+		q.push(raw)
+		n++
+	}
+	return n, nil
+}
+
+// Receive pops next job from queue and calls handler.
+func (b *MemoryBroker) Receive(ctx context.Context, queue string, handler Handler) error {
+	b.mu.Lock()
+	q := b.queue(queue)
+	raw, ok := q.pop()
+	if !ok {
+		notify := q.notify
+		b.mu.Unlock()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-notify:
+			return nil
+		}
+	}
+	q.inflight[raw] = time.Now()
+	b.mu.Unlock()
+
+	stoprenew := b.renew(queue, raw)
+	job := ParseJob(queue, raw)
+	herr := handle(ctx, b.log, queue, job, handler)
+	stoprenew()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(q.inflight, raw)
+	if herr == ErrRequeue {
+		s, err := job.Encode()
+		if err != nil {
+			b.log.Log(ctx, err.Error())
+			return nil
+		}
+		q.push(s)
+	} else if herr != nil {
+		if err := b.pushFailed(q, job); err != nil {
+			b.log.Log(ctx, err.Error())
+		}
+	}
+	return nil
+}
+
+// renew periodically renews the lease of raw, until the returned func is called.
+func (b *MemoryBroker) renew(queue string, raw string) func() {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(LeaseTimeout / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				b.mu.Lock()
+				q := b.queue(queue)
+				// don't renew a lease that has been reaped meanwhile
+				if _, ok := q.inflight[raw]; ok {
+					q.inflight[raw] = time.Now()
+				}
+				b.mu.Unlock()
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+// pushFailed pushes job to the failed jobs of q, b.mu must be held.
+func (b *MemoryBroker) pushFailed(q *memoryQueue, job *Job) error {
+	raw, err := job.Encode()
+	if err != nil {
+		return err
+	}
+	q.failed = append(q.failed, raw)
+	return nil
+}
+
+// Reap moves in-flight jobs of queue whose lease has expired back to queue,
+// or to the failed queue if fail is true. It returns the number of reaped
+// jobs.
+func (b *MemoryBroker) Reap(ctx context.Context, queue string, fail bool) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	q := b.queue(queue)
+	expiry := time.Now().Add(-LeaseTimeout)
+	var n int
+	for raw, t := range q.inflight {
+		if t.After(expiry) {
+			continue
+		}
+		delete(q.inflight, raw)
+
+		job := ParseJob(queue, raw)
+		job.Attempts++
+		job.Fail(ErrLeaseExpired)
+		if fail {
+			if err := b.pushFailed(q, job); err != nil {
+				return n, err
+			}
+		} else {
+			s, err := job.Encode()
+			if err != nil {
+				return n, err
+			}
+			q.push(s)
+		}
+		b.log.Log(ctx, "reaped "+queue+": "+job.Payload,
+			log.String("queue", queue),
+			log.String("payload", job.Payload),
+			log.String("job_id", job.ID),
+		)
+		n++
+	}
+	return n, nil
+}
+
+// PopNextFailed pops next job from failed queue.
+func (b *MemoryBroker) PopNextFailed(ctx context.Context, queue string) (*Job, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	q := b.queue(queue)
+	if len(q.failed) == 0 {
+		return nil, ErrNoJob
+	}
+	raw := q.failed[0]
+	q.failed = q.failed[1:]
+	return ParseJob(queue, raw), nil
+}
+
+// RemFailed removes the job wrapping payload from failed queue.
+func (b *MemoryBroker) RemFailed(ctx context.Context, queue string, payload string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	q := b.queue(queue)
+	for i, raw := range q.failed {
+		if ParseJob(queue, raw).Payload != payload {
+			continue
+		}
+		q.failed = append(q.failed[:i:i], q.failed[i+1:]...)
+		return nil
+	}
+	return nil
+}
+
+// ListFailed lists the jobs of failed queue, most recent first.
+func (b *MemoryBroker) ListFailed(ctx context.Context, queue string, offset, limit int64) ([]*Job, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	q := b.queue(queue)
+	var jobs []*Job
+	for i := int64(len(q.failed)) - 1 - offset; i >= 0 && int64(len(jobs)) < limit; i-- {
+		jobs = append(jobs, ParseJob(queue, q.failed[i]))
+	}
+	return jobs, nil
+}
+
+// CountFailed counts the jobs of failed queue.
+func (b *MemoryBroker) CountFailed(ctx context.Context, queue string) (int64, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return int64(len(b.queue(queue).failed)), nil
+}
+
+// GetFailed gets the job with id from failed queue.
+func (b *MemoryBroker) GetFailed(ctx context.Context, queue string, id string) (*Job, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, raw := range b.queue(queue).failed {
+		if job := ParseJob(queue, raw); job.ID == id {
+			return job, nil
+		}
+	}
+	return nil, ErrNoJob
+}
+
+// RequeueFailed moves the job with id from failed queue back to queue.
+func (b *MemoryBroker) RequeueFailed(ctx context.Context, queue string, id string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	q := b.queue(queue)
+	for i, raw := range q.failed {
+		if ParseJob(queue, raw).ID != id {
+			continue
+		}
+		q.failed = append(q.failed[:i:i], q.failed[i+1:]...)
+		q.push(raw)
+		return nil
+	}
+	return ErrNoJob
+}
+
+// PurgeFailed removes all jobs from failed queue. It returns the number of
+// removed jobs.
+func (b *MemoryBroker) PurgeFailed(ctx context.Context, queue string) (int64, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	q := b.queue(queue)
+	n := int64(len(q.failed))
+	q.failed = nil
+	return n, nil
+}
+
+// Publish publishes message to the subscribers of channel. Messages are
+// dropped for subscribers that aren't ready to receive them.
+func (b *MemoryBroker) Publish(ctx context.Context, channel string, message string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, c := range b.subscribers[channel] {
+		select {
+		case c <- message:
+		default:
+		}
+	}
+	return nil
+}
+
+// Subscribe subscribes to channel. The returned chan is closed when ctx is done.
+func (b *MemoryBroker) Subscribe(ctx context.Context, channel string) (<-chan string, error) {
+	c := make(chan string, 16)
+	b.mu.Lock()
+	b.subscribers[channel] = append(b.subscribers[channel], c)
+	b.mu.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		subscribers := b.subscribers[channel]
+		for i := range subscribers {
+			if subscribers[i] == c {
+				b.subscribers[channel] = append(subscribers[:i:i], subscribers[i+1:]...)
+				break
+			}
+		}
+		close(c)
+	}()
+	return c, nil
+}
+
+// Release moves the in-flight job with id back to queue. It returns ErrNoJob
+// if the job isn't in flight.
+func (b *MemoryBroker) Release(ctx context.Context, queue string, id string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	q := b.queue(queue)
+	for raw := range q.inflight {
+		job := ParseJob(queue, raw)
+		if job.ID != id {
+			continue
+		}
+		delete(q.inflight, raw)
+		job.Attempts++
+		job.Fail(ErrWorkerStale)
+		s, err := job.Encode()
+		if err != nil {
+			return err
+		}
+		q.push(s)
+		return nil
+	}
+	return ErrNoJob
+}
+
+// Beat records the heartbeat of a worker.
+func (b *MemoryBroker) Beat(ctx context.Context, h *Heartbeat) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.heartbeats[h.ID] = *h
+	return nil
+}
+
+// ListHeartbeats lists the last heartbeat of each worker, sorted by id.
+func (b *MemoryBroker) ListHeartbeats(ctx context.Context) ([]*Heartbeat, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	heartbeats := make([]*Heartbeat, 0, len(b.heartbeats))
+	for _, h := range b.heartbeats {
+		h := h
+		heartbeats = append(heartbeats, &h)
+	}
+	sort.Slice(heartbeats, func(i, j int) bool { return heartbeats[i].ID < heartbeats[j].ID })
+	return heartbeats, nil
+}
+
+// RemoveHeartbeat removes the heartbeat of the worker with id.
+func (b *MemoryBroker) RemoveHeartbeat(ctx context.Context, id string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.heartbeats, id)
+	return nil
+}
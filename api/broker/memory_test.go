@@ -0,0 +1,301 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestMemoryBrokerReceive(t *testing.T) {
+	b := NewMemory(logMock{})
+	ctx := context.Background()
+	if err := b.Send(ctx, queue, payload, PriorityNormal); err != nil {
+		t.Fatal(err)
+	}
+
+	var received bool
+	handler := func(ctx context.Context, in string) error {
+		received = true
+		assertf(t, in == payload, `expected payload to be %q, got %q`, payload, in)
+		return nil
+	}
+	if err := b.Receive(ctx, queue, handler); err != nil {
+		t.Fatal(err)
+	}
+	assertf(t, received, `expected handler to be called`)
+
+	_, err := b.PopNextFailed(ctx, queue)
+	assertf(t, err == ErrNoJob, `expected err to be %v, got %v`, ErrNoJob, err)
+}
+
+func TestMemoryBrokerReceiveErr(t *testing.T) {
+	b := NewMemory(logMock{})
+	ctx := context.Background()
+	if err := b.Send(ctx, queue, payload, PriorityNormal); err != nil {
+		t.Fatal(err)
+	}
+
+	serr := "err"
+	handler := func(ctx context.Context, in string) error {
+		return errors.New(serr)
+	}
+	if err := b.Receive(ctx, queue, handler); err != nil {
+		t.Fatal(err)
+	}
+
+	job, err := b.PopNextFailed(ctx, queue)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertf(t, job.Payload == payload, `expected job payload to be %q, got %q`, payload, job.Payload)
+	assertf(t, job.Attempts == 1, `expected job attempts to be 1, got %d`, job.Attempts)
+	assertf(t, job.LastError == serr, `expected job last error to be %q, got %q`, serr, job.LastError)
+}
+
+func TestMemoryBrokerReceivePanic(t *testing.T) {
+	b := NewMemory(logMock{})
+	ctx := context.Background()
+	if err := b.Send(ctx, queue, payload, PriorityNormal); err != nil {
+		t.Fatal(err)
+	}
+
+	serr := "panic"
+	handler := func(ctx context.Context, in string) error {
+		panic(serr)
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			t.Errorf("unexpected panic: %v", r)
+		}
+	}()
+	if err := b.Receive(ctx, queue, handler); err != nil {
+		t.Fatal(err)
+	}
+
+	job, err := b.PopNextFailed(ctx, queue)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertf(t, job.LastError == serr, `expected job last error to be %q, got %q`, serr, job.LastError)
+}
+
+func TestMemoryBrokerReceiveCancel(t *testing.T) {
+	b := NewMemory(logMock{})
+	timeout := time.Millisecond
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	err := b.Receive(ctx, queue, nil)
+	assertf(t, err == context.DeadlineExceeded,
+		"expected to get %v, got %v", context.DeadlineExceeded, err)
+}
+
+func TestMemoryBrokerReap(t *testing.T) {
+	b := NewMemory(logMock{})
+	ctx := context.Background()
+	raw, err := NewJob(ctx, queue, payload, PriorityNormal).Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.queue(queue).inflight[raw] = time.Now().Add(-2 * LeaseTimeout)
+
+	n, err := b.Reap(ctx, queue, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertf(t, n == 1, `expected 1 reaped job, got %d`, n)
+
+	job, err := b.PopNextFailed(ctx, queue)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertf(t, job.Payload == payload, `expected job payload to be %q, got %q`, payload, job.Payload)
+	assertf(t, job.LastError == ErrLeaseExpired.Error(), `expected job last error to be %q, got %q`, ErrLeaseExpired, job.LastError)
+}
+
+func TestMemoryBrokerFailed(t *testing.T) {
+	b := NewMemory(logMock{})
+	ctx := context.Background()
+	handler := func(ctx context.Context, in string) error {
+		return errors.New(in)
+	}
+	for _, p := range []string{"first", "second"} {
+		if err := b.Send(ctx, queue, p, PriorityNormal); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Receive(ctx, queue, handler); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	n, err := b.CountFailed(ctx, queue)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertf(t, n == 2, `expected 2 failed jobs, got %d`, n)
+
+	jobs, err := b.ListFailed(ctx, queue, 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertf(t, len(jobs) == 1, `expected 1 job, got %d`, len(jobs))
+	assertf(t, jobs[0].Payload == "second", `expected most recent job first, got %q`, jobs[0].Payload)
+
+	job, err := b.GetFailed(ctx, queue, jobs[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertf(t, job.Payload == "second", `expected job payload to be "second", got %q`, job.Payload)
+
+	if err := b.RequeueFailed(ctx, queue, job.ID); err != nil {
+		t.Fatal(err)
+	}
+	err = b.RequeueFailed(ctx, queue, job.ID)
+	assertf(t, err == ErrNoJob, `expected err to be %v, got %v`, ErrNoJob, err)
+
+	var attempts int
+	if err := b.Receive(ctx, queue, func(ctx context.Context, in string) error {
+		attempts++
+		assertf(t, in == "second", `expected payload to be "second", got %q`, in)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	assertf(t, attempts == 1, `expected handler to be called once, got %d`, attempts)
+
+	purged, err := b.PurgeFailed(ctx, queue)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertf(t, purged == 1, `expected 1 purged job, got %d`, purged)
+	_, err = b.PopNextFailed(ctx, queue)
+	assertf(t, err == ErrNoJob, `expected err to be %v, got %v`, ErrNoJob, err)
+}
+
+func TestMemoryBrokerReceiveRequeue(t *testing.T) {
+	b := NewMemory(logMock{})
+	ctx := context.Background()
+	if err := b.Send(ctx, queue, payload, PriorityNormal); err != nil {
+		t.Fatal(err)
+	}
+
+	handler := func(ctx context.Context, in string) error {
+		return ErrRequeue
+	}
+	if err := b.Receive(ctx, queue, handler); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := b.PopNextFailed(ctx, queue)
+	assertf(t, err == ErrNoJob, `expected err to be %v, got %v`, ErrNoJob, err)
+
+	var received bool
+	handler = func(ctx context.Context, in string) error {
+		received = true
+		return errors.New("err")
+	}
+	if err := b.Receive(ctx, queue, handler); err != nil {
+		t.Fatal(err)
+	}
+	assertf(t, received, `expected requeued job to be received`)
+	job, err := b.PopNextFailed(ctx, queue)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertf(t, job.Attempts == 1, `expected requeued attempt not to be counted, got %d attempts`, job.Attempts)
+	assertf(t, len(job.Errors) == 1, `expected 1 job error, got %d`, len(job.Errors))
+}
+
+func TestMemoryBrokerRelease(t *testing.T) {
+	b := NewMemory(logMock{})
+	ctx := context.Background()
+	if err := b.Send(ctx, queue, payload, PriorityNormal); err != nil {
+		t.Fatal(err)
+	}
+
+	var id string
+	handler := func(ctx context.Context, in string) error {
+		id = JobID(ctx)
+		if err := b.Release(ctx, queue, id); err != nil {
+			t.Fatal(err)
+		}
+		return nil
+	}
+	if err := b.Receive(ctx, queue, handler); err != nil {
+		t.Fatal(err)
+	}
+	err := b.Release(ctx, queue, id)
+	assertf(t, err == ErrNoJob, `expected err to be %v, got %v`, ErrNoJob, err)
+
+	handler = func(ctx context.Context, in string) error {
+		return errors.New("err")
+	}
+	if err := b.Receive(ctx, queue, handler); err != nil {
+		t.Fatal(err)
+	}
+	job, err := b.PopNextFailed(ctx, queue)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertf(t, job.ID == id, `expected released job to be %q, got %q`, id, job.ID)
+	assertf(t, job.Attempts == 2, `expected job attempts to be 2, got %d`, job.Attempts)
+	assertf(t, job.Errors[0].Error == ErrWorkerStale.Error(), `expected first job error to be %q, got %q`, ErrWorkerStale, job.Errors[0].Error)
+}
+
+func TestMemoryBrokerHeartbeats(t *testing.T) {
+	b := NewMemory(logMock{})
+	ctx := context.Background()
+	now := time.Now()
+	for _, h := range []*Heartbeat{
+		{ID: "b", SeenAt: now},
+		{ID: "a", SeenAt: now.Add(-2 * HeartbeatTimeout)},
+	} {
+		if err := b.Beat(ctx, h); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	heartbeats, err := b.ListHeartbeats(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertf(t, len(heartbeats) == 2, `expected 2 heartbeats, got %d`, len(heartbeats))
+	assertf(t, heartbeats[0].ID == "a", `expected heartbeats to be sorted by id, got %q first`, heartbeats[0].ID)
+	assertf(t, heartbeats[0].Stale(now), `expected heartbeat "a" to be stale`)
+	assertf(t, !heartbeats[1].Stale(now), `expected heartbeat "b" not to be stale`)
+
+	if err := b.RemoveHeartbeat(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+	heartbeats, err = b.ListHeartbeats(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertf(t, len(heartbeats) == 1, `expected 1 heartbeat, got %d`, len(heartbeats))
+}
+
+func TestMemoryBrokerReceivePriority(t *testing.T) {
+	b := NewMemory(logMock{})
+	ctx := context.Background()
+	for _, p := range []Priority{PriorityLow, PriorityNormal, PriorityHigh, PriorityNormal} {
+		if err := b.Send(ctx, queue, string(p), p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var received []string
+	handler := func(ctx context.Context, in string) error {
+		received = append(received, in)
+		return nil
+	}
+	for i := 0; i < 4; i++ {
+		if err := b.Receive(ctx, queue, handler); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expected := []string{"high", "normal", "normal", "low"}
+	for i := range expected {
+		assertf(t, i < len(received) && received[i] == expected[i], `expected jobs to be received in order %v, got %v`, expected, received)
+	}
+}
@@ -0,0 +1,487 @@
+package broker
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/yansal/sql/nest"
+	"github.com/yansal/sql/scan"
+	"github.com/yansal/youtube-ar/api/log"
+)
+
+// NewPostgres returns a new PostgresBroker. dsn is used to open the
+// connections listening to notifications.
+func NewPostgres(db nest.Querier, dsn string, log log.Logger) *PostgresBroker {
+	return &PostgresBroker{db: db, dsn: dsn, log: log}
+}
+
+// PostgresBroker is a broker backed by the postgres jobs table.
+type PostgresBroker struct {
+	db  nest.Querier
+	dsn string
+	log log.Logger
+}
+
+// PollInterval is the interval at which PostgresBroker polls for jobs when
+// a queue is empty.
+const PollInterval = 2 * time.Second
+
+type txContextKey struct{}
+
+// WithTx returns a copy of ctx associated with tx. PostgresBroker sends
+// payloads within the transaction associated with ctx, if any.
+func WithTx(ctx context.Context, tx nest.Querier) context.Context {
+	return context.WithValue(ctx, txContextKey{}, tx)
+}
+
+func (b *PostgresBroker) querier(ctx context.Context) nest.Querier {
+	if tx, ok := ctx.Value(txContextKey{}).(nest.Querier); ok {
+		return tx
+	}
+	return b.db
+}
+
+// Send sends payload to queue, with priority.
+func (b *PostgresBroker) Send(ctx context.Context, queue string, payload string, priority Priority) error {
+	return b.SendAt(ctx, queue, payload, priority, time.Now())
+}
+
+// SendAt schedules payload to be sent to queue at t, with priority.
+func (b *PostgresBroker) SendAt(ctx context.Context, queue string, payload string, priority Priority, t time.Time) error {
+	job, err := NewJob(ctx, queue, payload, priority).Encode()
+	if err != nil {
+		return err
+	}
+	_, err = b.querier(ctx).ExecContext(ctx,
+		`INSERT INTO jobs (queue, job, priority, run_at) VALUES ($1, $2, $3, $4)`,
+		queue, job, priority.rank(), t,
+	)
+	return err
+}
+
+// SendAfter schedules payload to be sent to queue after d, with priority.
+func (b *PostgresBroker) SendAfter(ctx context.Context, queue string, payload string, priority Priority, d time.Duration) error {
+	return b.SendAt(ctx, queue, payload, priority, time.Now().Add(d))
+}
+
+// Promote is a no-op, scheduled jobs are received as soon as they are due.
+func (b *PostgresBroker) Promote(ctx context.Context, queue string) (int, error) {
+	return 0, nil
+}
+
+type jobRow struct {
+	ID  int64  `scan:"id"`
+	Job string `scan:"job"`
+}
+
+const claimQuery = `UPDATE jobs
+SET status = 'running', locked_until = now() + $2 * interval '1 second'
+WHERE id = (
+	SELECT id FROM jobs
+	WHERE queue = $1 AND status = 'queued' AND run_at <= now()
+	ORDER BY priority, run_at, id
+	FOR UPDATE SKIP LOCKED
+	LIMIT 1
+)
+RETURNING id, job`
+
+// Receive claims next job from queue and calls handler.
+func (b *PostgresBroker) Receive(ctx context.Context, queue string, handler Handler) error {
+	var row jobRow
+	rows, err := b.db.QueryContext(ctx, claimQuery, queue, int64(LeaseTimeout/time.Second))
+	if err != nil {
+		return err
+	}
+	err = scan.Struct(rows, &row)
+	rows.Close()
+	if err == sql.ErrNoRows {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(PollInterval):
+			return nil
+		}
+	} else if err != nil {
+		return err
+	}
+
+	stoprenew := b.renew(ctx, row.ID)
+	job := ParseJob(queue, row.Job)
+	herr := handle(ctx, b.log, queue, job, handler)
+	stoprenew()
+
+	if ctx.Err() != nil {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+	}
+	if herr == nil {
+		_, err = b.db.ExecContext(ctx, `DELETE FROM jobs WHERE id = $1`, row.ID)
+	} else if herr == ErrRequeue {
+		err = b.update(ctx, row.ID, "queued", job)
+	} else {
+		err = b.update(ctx, row.ID, "failed", job)
+	}
+	if err != nil {
+		b.log.Log(ctx, err.Error())
+	}
+	return nil
+}
+
+// renew periodically renews the lease of the job with id, until the returned
+// func is called. The lease is renewed even after ctx is done, as the handler
+// may still be draining the job.
+func (b *PostgresBroker) renew(ctx context.Context, id int64) func() {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(LeaseTimeout / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if _, err := b.db.ExecContext(context.Background(),
+					`UPDATE jobs SET locked_until = now() + $2 * interval '1 second' WHERE id = $1 AND status = 'running'`,
+					id, int64(LeaseTimeout/time.Second),
+				); err != nil {
+					b.log.Log(ctx, err.Error())
+				}
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+func (b *PostgresBroker) update(ctx context.Context, id int64, status string, job *Job) error {
+	s, err := job.Encode()
+	if err != nil {
+		return err
+	}
+	_, err = b.db.ExecContext(ctx,
+		`UPDATE jobs SET status = $2, job = $3, locked_until = NULL WHERE id = $1`,
+		id, status, s,
+	)
+	return err
+}
+
+// Reap moves running jobs of queue whose lease has expired back to queue, or
+// to the failed queue if fail is true. It returns the number of reaped jobs.
+func (b *PostgresBroker) Reap(ctx context.Context, queue string, fail bool) (int, error) {
+	rows, err := b.db.QueryContext(ctx,
+		`SELECT id, job FROM jobs WHERE queue = $1 AND status = 'running' AND locked_until < now()`,
+		queue,
+	)
+	if err != nil {
+		return 0, err
+	}
+	var expired []jobRow
+	err = scan.StructSlice(rows, &expired)
+	rows.Close()
+	if err != nil {
+		return 0, err
+	}
+
+	status := "queued"
+	if fail {
+		status = "failed"
+	}
+	var n int
+	for _, row := range expired {
+		job := ParseJob(queue, row.Job)
+		job.Attempts++
+		job.Fail(ErrLeaseExpired)
+		s, err := job.Encode()
+		if err != nil {
+			return n, err
+		}
+		// The status and lock conditions ensure concurrent reapers don't
+		// requeue the same job twice.
+		res, err := b.db.ExecContext(ctx,
+			`UPDATE jobs SET status = $2, job = $3, locked_until = NULL, run_at = now() WHERE id = $1 AND status = 'running' AND locked_until < now()`,
+			row.ID, status, s,
+		)
+		if err != nil {
+			return n, err
+		}
+		if affected, err := res.RowsAffected(); err != nil {
+			return n, err
+		} else if affected == 0 {
+			continue
+		}
+		b.log.Log(ctx, "reaped "+queue+": "+job.Payload,
+			log.String("queue", queue),
+			log.String("payload", job.Payload),
+			log.String("job_id", job.ID),
+			log.String("status", status),
+		)
+		n++
+	}
+	return n, nil
+}
+
+// PopNextFailed pops next job from failed queue.
+func (b *PostgresBroker) PopNextFailed(ctx context.Context, queue string) (*Job, error) {
+	var row jobRow
+	rows, err := b.db.QueryContext(ctx, `DELETE FROM jobs
+WHERE id = (
+	SELECT id FROM jobs
+	WHERE queue = $1 AND status = 'failed'
+	ORDER BY id
+	FOR UPDATE SKIP LOCKED
+	LIMIT 1
+)
+RETURNING id, job`, queue)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	if err := scan.Struct(rows, &row); err == sql.ErrNoRows {
+		return nil, ErrNoJob
+	} else if err != nil {
+		return nil, err
+	}
+	return ParseJob(queue, row.Job), nil
+}
+
+// RemFailed removes the job wrapping payload from failed queue.
+func (b *PostgresBroker) RemFailed(ctx context.Context, queue string, payload string) error {
+	_, err := b.db.ExecContext(ctx, `DELETE FROM jobs
+WHERE id = (
+	SELECT id FROM jobs
+	WHERE queue = $1 AND status = 'failed' AND job->>'payload' = $2
+	ORDER BY id
+	LIMIT 1
+)`, queue, payload)
+	return err
+}
+
+// ListFailed lists the jobs of failed queue, most recent first.
+func (b *PostgresBroker) ListFailed(ctx context.Context, queue string, offset, limit int64) ([]*Job, error) {
+	rows, err := b.db.QueryContext(ctx,
+		`SELECT id, job FROM jobs WHERE queue = $1 AND status = 'failed' ORDER BY id DESC OFFSET $2 LIMIT $3`,
+		queue, offset, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var failed []jobRow
+	if err := scan.StructSlice(rows, &failed); err != nil {
+		return nil, err
+	}
+	jobs := make([]*Job, len(failed))
+	for i := range failed {
+		jobs[i] = ParseJob(queue, failed[i].Job)
+	}
+	return jobs, nil
+}
+
+// CountFailed counts the jobs of failed queue.
+func (b *PostgresBroker) CountFailed(ctx context.Context, queue string) (int64, error) {
+	rows, err := b.db.QueryContext(ctx,
+		`SELECT count(*) FROM jobs WHERE queue = $1 AND status = 'failed'`,
+		queue,
+	)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	var n int64
+	if rows.Next() {
+		if err := rows.Scan(&n); err != nil {
+			return 0, err
+		}
+	}
+	return n, rows.Err()
+}
+
+// GetFailed gets the job with id from failed queue.
+func (b *PostgresBroker) GetFailed(ctx context.Context, queue string, id string) (*Job, error) {
+	var row jobRow
+	rows, err := b.db.QueryContext(ctx,
+		`SELECT id, job FROM jobs WHERE queue = $1 AND status = 'failed' AND job->>'id' = $2 LIMIT 1`,
+		queue, id,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	if err := scan.Struct(rows, &row); err == sql.ErrNoRows {
+		return nil, ErrNoJob
+	} else if err != nil {
+		return nil, err
+	}
+	return ParseJob(queue, row.Job), nil
+}
+
+// RequeueFailed moves the job with id from failed queue back to queue.
+func (b *PostgresBroker) RequeueFailed(ctx context.Context, queue string, id string) error {
+	res, err := b.db.ExecContext(ctx,
+		`UPDATE jobs SET status = 'queued', run_at = now() WHERE queue = $1 AND status = 'failed' AND job->>'id' = $2`,
+		queue, id,
+	)
+	if err != nil {
+		return err
+	}
+	if affected, err := res.RowsAffected(); err != nil {
+		return err
+	} else if affected == 0 {
+		return ErrNoJob
+	}
+	return nil
+}
+
+// PurgeFailed removes all jobs from failed queue. It returns the number of
+// removed jobs.
+func (b *PostgresBroker) PurgeFailed(ctx context.Context, queue string) (int64, error) {
+	res, err := b.db.ExecContext(ctx,
+		`DELETE FROM jobs WHERE queue = $1 AND status = 'failed'`,
+		queue,
+	)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// Publish publishes message to the subscribers of channel, with a postgres
+// notification.
+func (b *PostgresBroker) Publish(ctx context.Context, channel string, message string) error {
+	_, err := b.querier(ctx).ExecContext(ctx, `SELECT pg_notify($1, $2)`, channel, message)
+	return err
+}
+
+// Subscribe subscribes to channel, by listening to postgres notifications.
+// The returned chan is closed when ctx is done.
+func (b *PostgresBroker) Subscribe(ctx context.Context, channel string) (<-chan string, error) {
+	listener := pq.NewListener(b.dsn, time.Second, time.Minute, func(event pq.ListenerEventType, err error) {
+		if err != nil {
+			b.log.Log(ctx, err.Error())
+		}
+	})
+	if err := listener.Listen(channel); err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	messages := make(chan string)
+	go func() {
+		defer close(messages)
+		defer listener.Close()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case n := <-listener.Notify:
+				// n is nil after the connection has been re-established
+				if n == nil {
+					continue
+				}
+				select {
+				case <-ctx.Done():
+					return
+				case messages <- n.Extra:
+				}
+			}
+		}
+	}()
+	return messages, nil
+}
+
+// Release moves the running job with id back to queue. It returns ErrNoJob if
+// the job isn't running.
+func (b *PostgresBroker) Release(ctx context.Context, queue string, id string) error {
+	var row jobRow
+	rows, err := b.db.QueryContext(ctx,
+		`SELECT id, job FROM jobs WHERE queue = $1 AND status = 'running' AND job->>'id' = $2 LIMIT 1`,
+		queue, id,
+	)
+	if err != nil {
+		return err
+	}
+	err = scan.Struct(rows, &row)
+	rows.Close()
+	if err == sql.ErrNoRows {
+		return ErrNoJob
+	} else if err != nil {
+		return err
+	}
+
+	job := ParseJob(queue, row.Job)
+	job.Attempts++
+	job.Fail(ErrWorkerStale)
+	s, err := job.Encode()
+	if err != nil {
+		return err
+	}
+	// The status condition ensures concurrent reapers don't requeue the
+	// same job twice.
+	res, err := b.db.ExecContext(ctx,
+		`UPDATE jobs SET status = 'queued', job = $2, locked_until = NULL, run_at = now() WHERE id = $1 AND status = 'running'`,
+		row.ID, s,
+	)
+	if err != nil {
+		return err
+	}
+	if affected, err := res.RowsAffected(); err != nil {
+		return err
+	} else if affected == 0 {
+		return ErrNoJob
+	}
+	return nil
+}
+
+// Beat records the heartbeat of a worker.
+func (b *PostgresBroker) Beat(ctx context.Context, h *Heartbeat) error {
+	s, err := json.Marshal(h)
+	if err != nil {
+		return err
+	}
+	_, err = b.db.ExecContext(ctx,
+		`INSERT INTO workers (id, heartbeat, seen_at) VALUES ($1, $2, $3)
+ON CONFLICT (id) DO UPDATE SET heartbeat = excluded.heartbeat, seen_at = excluded.seen_at`,
+		h.ID, string(s), h.SeenAt,
+	)
+	return err
+}
+
+type heartbeatRow struct {
+	Heartbeat string `scan:"heartbeat"`
+}
+
+// ListHeartbeats lists the last heartbeat of each worker, sorted by id.
+func (b *PostgresBroker) ListHeartbeats(ctx context.Context) ([]*Heartbeat, error) {
+	rows, err := b.db.QueryContext(ctx, `SELECT heartbeat FROM workers ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var hrows []heartbeatRow
+	if err := scan.StructSlice(rows, &hrows); err != nil {
+		return nil, err
+	}
+	heartbeats := make([]*Heartbeat, len(hrows))
+	for i := range hrows {
+		h, err := parseHeartbeat(hrows[i].Heartbeat)
+		if err != nil {
+			return nil, err
+		}
+		heartbeats[i] = h
+	}
+	return heartbeats, nil
+}
+
+// RemoveHeartbeat removes the heartbeat of the worker with id.
+func (b *PostgresBroker) RemoveHeartbeat(ctx context.Context, id string) error {
+	_, err := b.db.ExecContext(ctx, `DELETE FROM workers WHERE id = $1`, id)
+	return err
+}
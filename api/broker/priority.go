@@ -0,0 +1,52 @@
+package broker
+
+import "fmt"
+
+// Priority is the priority of a job. The jobs of a queue are received by
+// priority, highest first.
+type Priority string
+
+// Priority values.
+const (
+	PriorityHigh   Priority = "high"
+	PriorityNormal Priority = "normal"
+	PriorityLow    Priority = "low"
+)
+
+// Priorities lists the priorities, highest first.
+var Priorities = []Priority{PriorityHigh, PriorityNormal, PriorityLow}
+
+// ParsePriority parses a priority from s. The empty string is parsed as
+// PriorityNormal.
+func ParsePriority(s string) (Priority, error) {
+	if s == "" {
+		return PriorityNormal, nil
+	}
+	for _, p := range Priorities {
+		if string(p) == s {
+			return p, nil
+		}
+	}
+	return "", fmt.Errorf("invalid priority %q, expected one of %v", s, Priorities)
+}
+
+// rank returns the index of p in Priorities. Unknown priorities, e.g. of
+// legacy jobs, rank as PriorityNormal.
+func (p Priority) rank() int {
+	for i := range Priorities {
+		if Priorities[i] == p {
+			return i
+		}
+	}
+	return 1
+}
+
+// lane returns the key of the list of the jobs of queue with priority p.
+// Normal jobs are in the queue list, as before priorities existed.
+func lane(queue string, p Priority) string {
+	switch p {
+	case PriorityHigh, PriorityLow:
+		return queue + ":" + string(p)
+	}
+	return queue
+}
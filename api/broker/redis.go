@@ -0,0 +1,478 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/yansal/youtube-ar/api/log"
+)
+
+// NewRedis returns a new RedisBroker.
+func NewRedis(r Redis, log log.Logger) *RedisBroker {
+	return &RedisBroker{redis: r, log: log}
+}
+
+// Redis is the redis interface required by RedisBroker.
+type Redis interface {
+	LPush(key string, values ...interface{}) *redis.IntCmd
+	BRPopLPush(source, destination string, timeout time.Duration) *redis.StringCmd
+	RPopLPush(source, destination string) *redis.StringCmd
+	LRange(key string, start, stop int64) *redis.StringSliceCmd
+	LRem(key string, count int64, value interface{}) *redis.IntCmd
+	LLen(key string) *redis.IntCmd
+	Del(keys ...string) *redis.IntCmd
+	HSet(key, field string, value interface{}) *redis.BoolCmd
+	HGetAll(key string) *redis.StringStringMapCmd
+	HDel(key string, fields ...string) *redis.IntCmd
+	Publish(channel string, message interface{}) *redis.IntCmd
+	Subscribe(channels ...string) *redis.PubSub
+	RPop(key string) *redis.StringCmd
+	ZAdd(key string, members ...redis.Z) *redis.IntCmd
+	ZAddNX(key string, members ...redis.Z) *redis.IntCmd
+	ZAddXX(key string, members ...redis.Z) *redis.IntCmd
+	ZRangeByScore(key string, opt redis.ZRangeBy) *redis.StringSliceCmd
+	ZRem(key string, members ...interface{}) *redis.IntCmd
+	Eval(script string, keys []string, args ...interface{}) *redis.Cmd
+}
+
+// RedisBroker is a broker backed by redis lists.
+type RedisBroker struct {
+	log   log.Logger
+	redis Redis
+}
+
+// Send sends payload to queue, with priority.
+func (b *RedisBroker) Send(ctx context.Context, queue string, payload string, priority Priority) error {
+	job, err := NewJob(ctx, queue, payload, priority).Encode()
+	if err != nil {
+		return err
+	}
+	return b.redis.LPush(lane(queue, priority), job).Err()
+}
+
+// SendAt schedules payload to be sent to queue at t, with priority.
+func (b *RedisBroker) SendAt(ctx context.Context, queue string, payload string, priority Priority, t time.Time) error {
+	job, err := NewJob(ctx, queue, payload, priority).Encode()
+	if err != nil {
+		return err
+	}
+	return b.redis.ZAdd(queue+":scheduled", redis.Z{Score: float64(t.Unix()), Member: job}).Err()
+}
+
+// SendAfter schedules payload to be sent to queue after d, with priority.
+func (b *RedisBroker) SendAfter(ctx context.Context, queue string, payload string, priority Priority, d time.Duration) error {
+	return b.SendAt(ctx, queue, payload, priority, time.Now().Add(d))
+}
+
+// Promote sends the scheduled payloads of queue that are due. It returns the
+// number of promoted payloads.
+func (b *RedisBroker) Promote(ctx context.Context, queue string) (int, error) {
+	scheduled := queue + ":scheduled"
+	due, err := b.redis.ZRangeByScore(scheduled, redis.ZRangeBy{
+		Min: "-inf",
+		Max: strconv.FormatInt(time.Now().Unix(), 10),
+	}).Result()
+	if err != nil {
+		return 0, err
+	}
+
+	var n int
+	for _, job := range due {
+		moved, err := b.redis.Eval(promoteScript, []string{scheduled, lane(queue, ParseJob(queue, job).Priority)}, job).Int64()
+		if err != nil {
+			return n, err
+		}
+		n += int(moved)
+	}
+	return n, nil
+}
+
+// promoteScript moves ARGV[1] from the sorted set KEYS[1] to the list KEYS[2].
+// It returns 1, or 0 if ARGV[1] has already been moved by a concurrent
+// promoter.
+const promoteScript = `
+if redis.call('ZREM', KEYS[1], ARGV[1]) == 0 then return 0 end
+redis.call('LPUSH', KEYS[2], ARGV[1])
+return 1
+`
+
+// Receive pops next job from queue and calls handler.
+func (b *RedisBroker) Receive(ctx context.Context, queue string, handler Handler) error {
+	tmp := queue + ":tmp"
+	leases := queue + ":leases"
+
+	var (
+		raw string
+		err error
+	)
+	c := make(chan struct{})
+	go func() {
+		raw, err = b.pop(queue, tmp)
+		c <- struct{}{}
+	}()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-c:
+	}
+
+	if err == redis.Nil {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if err := b.redis.ZAdd(leases, lease(raw)).Err(); err != nil {
+		b.log.Log(ctx, err.Error(), log.String("queue", queue))
+	}
+	stoprenew := b.renew(ctx, leases, raw)
+	job := ParseJob(queue, raw)
+	herr := handle(ctx, b.log, queue, job, handler)
+	stoprenew()
+
+	// The job has been requeued by a reaper or a registry meanwhile if it
+	// isn't in-flight anymore, it must then be left where it has been moved.
+	if removed, err := b.redis.LRem(tmp, 1, raw).Result(); err != nil {
+		b.log.Log(ctx, err.Error())
+		return nil
+	} else if removed == 0 {
+		b.log.Log(ctx, "requeued meanwhile "+queue+": "+job.Payload,
+			log.String("queue", queue),
+			log.String("payload", job.Payload),
+			log.String("job_id", job.ID),
+		)
+		return nil
+	}
+	if err := b.redis.ZRem(leases, raw).Err(); err != nil {
+		b.log.Log(ctx, err.Error())
+	}
+	if herr != nil {
+		dest := queue + ":failed"
+		if herr == ErrRequeue {
+			dest = lane(queue, job.Priority)
+		}
+		if err := b.push(dest, job); err != nil {
+			b.log.Log(ctx, err.Error())
+		}
+	}
+	return nil
+}
+
+// laneTimeout is the duration pop blocks on the lane of normal jobs, before
+// checking the other lanes again.
+const laneTimeout = time.Second
+
+// pop moves next job from the lanes of queue to tmp, highest priority first.
+// When all lanes are empty, pop blocks on the lane of normal jobs for up to
+// laneTimeout, and returns redis.Nil if it is still empty.
+func (b *RedisBroker) pop(queue string, tmp string) (string, error) {
+	for _, p := range Priorities {
+		raw, err := b.redis.RPopLPush(lane(queue, p), tmp).Result()
+		if err != redis.Nil {
+			return raw, err
+		}
+	}
+	return b.redis.BRPopLPush(lane(queue, PriorityNormal), tmp, laneTimeout).Result()
+}
+
+// renew periodically renews the lease of payload, until the returned func is called.
+func (b *RedisBroker) renew(ctx context.Context, leases string, payload string) func() {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(LeaseTimeout / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				// XX: don't renew a lease that has been reaped meanwhile
+				if err := b.redis.ZAddXX(leases, lease(payload)).Err(); err != nil {
+					b.log.Log(ctx, err.Error())
+				}
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+func lease(payload string) redis.Z {
+	return redis.Z{Score: float64(time.Now().Unix()), Member: payload}
+}
+
+// Reap moves in-flight payloads of queue whose lease has expired back to
+// queue, or to the failed queue if fail is true. It returns the number of
+// reaped payloads.
+func (b *RedisBroker) Reap(ctx context.Context, queue string, fail bool) (int, error) {
+	tmp := queue + ":tmp"
+	leases := queue + ":leases"
+
+	// Jobs without a lease, e.g. claimed by a worker that died before
+	// recording it, start their lease now.
+	inflight, err := b.redis.LRange(tmp, 0, -1).Result()
+	if err != nil {
+		return 0, err
+	}
+	for _, raw := range inflight {
+		if err := b.redis.ZAddNX(leases, lease(raw)).Err(); err != nil {
+			return 0, err
+		}
+	}
+
+	expired, err := b.redis.ZRangeByScore(leases, redis.ZRangeBy{
+		Min: "-inf",
+		Max: strconv.FormatInt(time.Now().Add(-LeaseTimeout).Unix(), 10),
+	}).Result()
+	if err != nil {
+		return 0, err
+	}
+
+	var n int
+	for _, raw := range expired {
+		// Removing the lease first ensures concurrent reapers don't
+		// requeue the same job twice.
+		if removed, err := b.redis.ZRem(leases, raw).Result(); err != nil {
+			return n, err
+		} else if removed == 0 {
+			continue
+		}
+		if removed, err := b.redis.LRem(tmp, 1, raw).Result(); err != nil {
+			return n, err
+		} else if removed == 0 {
+			// the handler returned meanwhile
+			continue
+		}
+
+		job := ParseJob(queue, raw)
+		job.Attempts++
+		job.Fail(ErrLeaseExpired)
+		dest := lane(queue, job.Priority)
+		if fail {
+			dest = queue + ":failed"
+		}
+		if err := b.push(dest, job); err != nil {
+			return n, err
+		}
+		b.log.Log(ctx, "reaped "+queue+": "+job.Payload,
+			log.String("queue", queue),
+			log.String("payload", job.Payload),
+			log.String("job_id", job.ID),
+			log.String("destination", dest),
+		)
+		n++
+	}
+	return n, nil
+}
+
+func (b *RedisBroker) push(key string, job *Job) error {
+	s, err := job.Encode()
+	if err != nil {
+		return err
+	}
+	return b.redis.LPush(key, s).Err()
+}
+
+// PopNextFailed pops next job from failed queue.
+func (b *RedisBroker) PopNextFailed(ctx context.Context, queue string) (*Job, error) {
+	raw, err := b.redis.RPop(queue + ":failed").Result()
+	if err == redis.Nil {
+		return nil, ErrNoJob
+	} else if err != nil {
+		return nil, err
+	}
+	return ParseJob(queue, raw), nil
+}
+
+// RemFailed removes the job wrapping payload from failed queue.
+func (b *RedisBroker) RemFailed(ctx context.Context, queue string, payload string) error {
+	failed := queue + ":failed"
+	raws, err := b.redis.LRange(failed, 0, -1).Result()
+	if err != nil {
+		return err
+	}
+	for _, raw := range raws {
+		if ParseJob(queue, raw).Payload != payload {
+			continue
+		}
+		return b.redis.LRem(failed, 1, raw).Err()
+	}
+	return nil
+}
+
+// ListFailed lists the jobs of failed queue, most recent first.
+func (b *RedisBroker) ListFailed(ctx context.Context, queue string, offset, limit int64) ([]*Job, error) {
+	raws, err := b.redis.LRange(queue+":failed", offset, offset+limit-1).Result()
+	if err != nil {
+		return nil, err
+	}
+	jobs := make([]*Job, len(raws))
+	for i := range raws {
+		jobs[i] = ParseJob(queue, raws[i])
+	}
+	return jobs, nil
+}
+
+// CountFailed counts the jobs of failed queue.
+func (b *RedisBroker) CountFailed(ctx context.Context, queue string) (int64, error) {
+	return b.redis.LLen(queue + ":failed").Result()
+}
+
+// GetFailed gets the job with id from failed queue.
+func (b *RedisBroker) GetFailed(ctx context.Context, queue string, id string) (*Job, error) {
+	_, job, err := b.findFailed(queue, id)
+	return job, err
+}
+
+// findFailed returns the raw job with id from failed queue, and the parsed job.
+func (b *RedisBroker) findFailed(queue string, id string) (string, *Job, error) {
+	raws, err := b.redis.LRange(queue+":failed", 0, -1).Result()
+	if err != nil {
+		return "", nil, err
+	}
+	for _, raw := range raws {
+		if job := ParseJob(queue, raw); job.ID == id {
+			return raw, job, nil
+		}
+	}
+	return "", nil, ErrNoJob
+}
+
+// RequeueFailed moves the job with id from failed queue back to queue.
+func (b *RedisBroker) RequeueFailed(ctx context.Context, queue string, id string) error {
+	raw, _, err := b.findFailed(queue, id)
+	if err != nil {
+		return err
+	}
+	// Removing the job first ensures concurrent requeues don't send the
+	// same job twice.
+	if removed, err := b.redis.LRem(queue+":failed", 1, raw).Result(); err != nil {
+		return err
+	} else if removed == 0 {
+		return ErrNoJob
+	}
+	return b.redis.LPush(lane(queue, ParseJob(queue, raw).Priority), raw).Err()
+}
+
+// PurgeFailed removes all jobs from failed queue. It returns the number of
+// removed jobs.
+func (b *RedisBroker) PurgeFailed(ctx context.Context, queue string) (int64, error) {
+	failed := queue + ":failed"
+	n, err := b.redis.LLen(failed).Result()
+	if err != nil {
+		return 0, err
+	}
+	return n, b.redis.Del(failed).Err()
+}
+
+// Publish publishes message to the subscribers of channel.
+func (b *RedisBroker) Publish(ctx context.Context, channel string, message string) error {
+	return b.redis.Publish(channel, message).Err()
+}
+
+// Subscribe subscribes to channel. The returned chan is closed when ctx is done.
+func (b *RedisBroker) Subscribe(ctx context.Context, channel string) (<-chan string, error) {
+	pubsub := b.redis.Subscribe(channel)
+	// wait for the subscription to be confirmed
+	if _, err := pubsub.Receive(); err != nil {
+		pubsub.Close()
+		return nil, err
+	}
+
+	messages := make(chan string)
+	go func() {
+		defer close(messages)
+		defer pubsub.Close()
+		in := pubsub.Channel()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case msg, ok := <-in:
+				if !ok {
+					return
+				}
+				select {
+				case <-ctx.Done():
+					return
+				case messages <- msg.Payload:
+				}
+			}
+		}
+	}()
+	return messages, nil
+}
+
+// Release moves the in-flight job with id back to queue. It returns ErrNoJob
+// if the job isn't in flight.
+func (b *RedisBroker) Release(ctx context.Context, queue string, id string) error {
+	tmp := queue + ":tmp"
+	inflight, err := b.redis.LRange(tmp, 0, -1).Result()
+	if err != nil {
+		return err
+	}
+	for _, raw := range inflight {
+		job := ParseJob(queue, raw)
+		if job.ID != id {
+			continue
+		}
+		// Removing the job from the in-flight jobs first ensures
+		// concurrent reapers don't requeue the same job twice.
+		if removed, err := b.redis.LRem(tmp, 1, raw).Result(); err != nil {
+			return err
+		} else if removed == 0 {
+			return ErrNoJob
+		}
+		if err := b.redis.ZRem(queue+":leases", raw).Err(); err != nil {
+			return err
+		}
+		job.Attempts++
+		job.Fail(ErrWorkerStale)
+		return b.push(lane(queue, job.Priority), job)
+	}
+	return ErrNoJob
+}
+
+// workersKey is the key of the hash of worker heartbeats.
+const workersKey = "workers"
+
+// Beat records the heartbeat of a worker.
+func (b *RedisBroker) Beat(ctx context.Context, h *Heartbeat) error {
+	s, err := json.Marshal(h)
+	if err != nil {
+		return err
+	}
+	return b.redis.HSet(workersKey, h.ID, s).Err()
+}
+
+// ListHeartbeats lists the last heartbeat of each worker, sorted by id.
+func (b *RedisBroker) ListHeartbeats(ctx context.Context) ([]*Heartbeat, error) {
+	m, err := b.redis.HGetAll(workersKey).Result()
+	if err != nil {
+		return nil, err
+	}
+	heartbeats := make([]*Heartbeat, 0, len(m))
+	for _, s := range m {
+		h, err := parseHeartbeat(s)
+		if err != nil {
+			return nil, err
+		}
+		heartbeats = append(heartbeats, h)
+	}
+	sort.Slice(heartbeats, func(i, j int) bool { return heartbeats[i].ID < heartbeats[j].ID })
+	return heartbeats, nil
+}
+
+// RemoveHeartbeat removes the heartbeat of the worker with id.
+func (b *RedisBroker) RemoveHeartbeat(ctx context.Context, id string) error {
+	return b.redis.HDel(workersKey, id).Err()
+}
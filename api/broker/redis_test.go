@@ -0,0 +1,437 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/yansal/youtube-ar/api/log"
+)
+
+func assertf(t *testing.T, ok bool, msg string, args ...interface{}) {
+	t.Helper()
+	if !ok {
+		t.Errorf(msg, args...)
+	}
+}
+
+type redisMock struct {
+	brpoplpushFunc    func(source, destination string, timeout time.Duration) *redis.StringCmd
+	rpoplpushFunc     func(source, destination string) *redis.StringCmd
+	lrangeFunc        func(key string, start, stop int64) *redis.StringSliceCmd
+	lremFunc          func(key string, count int64, value interface{}) *redis.IntCmd
+	llenFunc          func(key string) *redis.IntCmd
+	delFunc           func(keys ...string) *redis.IntCmd
+	lpushFunc         func(key string, values ...interface{}) *redis.IntCmd
+	zaddnxFunc        func(key string, members ...redis.Z) *redis.IntCmd
+	zrangebyscoreFunc func(key string, opt redis.ZRangeBy) *redis.StringSliceCmd
+	zremFunc          func(key string, members ...interface{}) *redis.IntCmd
+	evalFunc          func(script string, keys []string, args ...interface{}) *redis.Cmd
+}
+
+func (r redisMock) LPush(key string, values ...interface{}) *redis.IntCmd {
+	return r.lpushFunc(key, values...)
+}
+func (r redisMock) BRPopLPush(source, destination string, timeout time.Duration) *redis.StringCmd {
+	return r.brpoplpushFunc(source, destination, timeout)
+}
+func (r redisMock) RPopLPush(source, destination string) *redis.StringCmd {
+	if r.rpoplpushFunc == nil {
+		return redis.NewStringResult("", redis.Nil)
+	}
+	return r.rpoplpushFunc(source, destination)
+}
+func (r redisMock) LRem(key string, count int64, value interface{}) *redis.IntCmd {
+	return r.lremFunc(key, count, value)
+}
+func (r redisMock) LLen(key string) *redis.IntCmd {
+	return r.llenFunc(key)
+}
+func (r redisMock) Del(keys ...string) *redis.IntCmd {
+	return r.delFunc(keys...)
+}
+func (r redisMock) HSet(key, field string, value interface{}) *redis.BoolCmd {
+	return redis.NewBoolResult(true, nil)
+}
+func (r redisMock) HGetAll(key string) *redis.StringStringMapCmd {
+	return redis.NewStringStringMapResult(nil, nil)
+}
+func (r redisMock) HDel(key string, fields ...string) *redis.IntCmd {
+	return redis.NewIntResult(0, nil)
+}
+func (r redisMock) Publish(channel string, message interface{}) *redis.IntCmd {
+	return redis.NewIntResult(0, nil)
+}
+func (r redisMock) Subscribe(channels ...string) *redis.PubSub {
+	return nil
+}
+func (r redisMock) RPop(key string) *redis.StringCmd {
+	return nil
+}
+func (r redisMock) LRange(key string, start, stop int64) *redis.StringSliceCmd {
+	return r.lrangeFunc(key, start, stop)
+}
+func (r redisMock) ZAdd(key string, members ...redis.Z) *redis.IntCmd {
+	return redis.NewIntResult(1, nil)
+}
+func (r redisMock) ZAddNX(key string, members ...redis.Z) *redis.IntCmd {
+	return r.zaddnxFunc(key, members...)
+}
+func (r redisMock) ZAddXX(key string, members ...redis.Z) *redis.IntCmd {
+	return redis.NewIntResult(0, nil)
+}
+func (r redisMock) ZRangeByScore(key string, opt redis.ZRangeBy) *redis.StringSliceCmd {
+	return r.zrangebyscoreFunc(key, opt)
+}
+func (r redisMock) ZRem(key string, members ...interface{}) *redis.IntCmd {
+	if r.zremFunc == nil {
+		return redis.NewIntResult(1, nil)
+	}
+	return r.zremFunc(key, members...)
+}
+func (r redisMock) Eval(script string, keys []string, args ...interface{}) *redis.Cmd {
+	return r.evalFunc(script, keys, args...)
+}
+
+type logMock struct {
+	logFunc func(ctx context.Context, msg string, fields ...log.Field)
+}
+
+func (l logMock) Log(ctx context.Context, msg string, fields ...log.Field) {
+	if l.logFunc != nil {
+		l.logFunc(ctx, msg, fields...)
+	}
+}
+
+const (
+	queue          = "queue"
+	queuetmp       = "queue:tmp"
+	queuefailed    = "queue:failed"
+	queueleases    = "queue:leases"
+	queuescheduled = "queue:scheduled"
+	payload        = "payload"
+)
+
+func TestRedisBrokerReceiveErr(t *testing.T) {
+	var (
+		lremed, lpushed bool
+		serr            = "err"
+	)
+	b := RedisBroker{
+		log: logMock{
+			logFunc: func(ctx context.Context, msg string, fields ...log.Field) {
+				assertf(t, msg == serr, `expected msg to be %q, got %q`, serr, msg)
+			},
+		},
+		redis: redisMock{
+			brpoplpushFunc: func(source, destination string, timeout time.Duration) *redis.StringCmd {
+				assertf(t, source == queue, `expected source to be %q, got %q`, queue, source)
+				assertf(t, destination == queuetmp, `expected destination to be %q, got %q`, queuetmp, destination)
+				return redis.NewStringResult(payload, nil)
+			},
+			lremFunc: func(key string, count int64, value interface{}) *redis.IntCmd {
+				lremed = true
+				assertf(t, key == queuetmp, `expected key to be %q, got %q`, queuetmp, key)
+				assertf(t, payload == value, `expected value to be %q, got %+v`, payload, value)
+				return redis.NewIntResult(1, nil)
+			},
+			lpushFunc: func(key string, values ...interface{}) *redis.IntCmd {
+				lpushed = true
+				assertf(t, key == queuefailed, `expected key to be %q, got %q`, queuefailed, key)
+				assertf(t, len(values) == 1, `expected values to have length 1, got %+v`, values)
+				job := ParseJob(queuefailed, values[0].(string))
+				assertf(t, job.Version == JobVersion, `expected job version to be %d, got %d`, JobVersion, job.Version)
+				assertf(t, job.Payload == payload, `expected job payload to be %q, got %q`, payload, job.Payload)
+				assertf(t, job.Attempts == 1, `expected job attempts to be 1, got %d`, job.Attempts)
+				assertf(t, job.LastError == serr, `expected job last error to be %q, got %q`, serr, job.LastError)
+				return redis.NewIntResult(0, nil)
+			},
+		},
+	}
+	handler := func(ctx context.Context, in string) error {
+		assertf(t, in == payload, `expected payload to be %q, got %q`, payload, in)
+		return errors.New(serr)
+	}
+
+	if err := b.Receive(context.Background(), queue, handler); err != nil {
+		t.Fatal(err)
+	}
+	assertf(t, lremed, `expected lrem to be called`)
+	assertf(t, lpushed, `expected lpush to be called`)
+}
+
+func TestRedisBrokerReceiveNoErr(t *testing.T) {
+	var lremed bool
+	b := RedisBroker{
+		log: logMock{},
+		redis: redisMock{
+			brpoplpushFunc: func(source, destination string, timeout time.Duration) *redis.StringCmd {
+				assertf(t, source == queue, `expected source to be %q, got %q`, queue, source)
+				assertf(t, destination == queuetmp, `expected destination to be %q, got %q`, queuetmp, destination)
+				return redis.NewStringResult(payload, nil)
+			},
+			lremFunc: func(key string, count int64, value interface{}) *redis.IntCmd {
+				lremed = true
+				assertf(t, key == queuetmp, `expected key to be %q, got %q`, queuetmp, key)
+				assertf(t, payload == value, `expected value to be %q, got %+v`, payload, value)
+				return redis.NewIntResult(1, nil)
+			},
+		},
+	}
+	handler := func(ctx context.Context, in string) error {
+		assertf(t, in == payload, `expected payload to be %q, got %q`, payload, in)
+		return nil
+	}
+
+	if err := b.Receive(context.Background(), queue, handler); err != nil {
+		t.Fatal(err)
+	}
+	assertf(t, lremed, `expected lrem to be called`)
+}
+
+func TestRedisBrokerReceivePanic(t *testing.T) {
+	var (
+		lremed, lpushed bool
+		serr            = "panic"
+	)
+	b := RedisBroker{
+		log: logMock{
+			logFunc: func(ctx context.Context, msg string, fields ...log.Field) {
+				assertf(t, msg == serr, `expected msg to be %q, got %q`, serr, msg)
+			},
+		},
+		redis: redisMock{
+			brpoplpushFunc: func(source, destination string, timeout time.Duration) *redis.StringCmd {
+				assertf(t, source == queue, `expected source to be %q, got %q`, queue, source)
+				assertf(t, destination == queuetmp, `expected destination to be %q, got %q`, queuetmp, destination)
+				return redis.NewStringResult(payload, nil)
+			},
+			lremFunc: func(key string, count int64, value interface{}) *redis.IntCmd {
+				lremed = true
+				assertf(t, key == queuetmp, `expected key to be %q, got %q`, queuetmp, key)
+				assertf(t, payload == value, `expected value to be %q, got %+v`, payload, value)
+				return redis.NewIntResult(1, nil)
+			},
+			lpushFunc: func(key string, values ...interface{}) *redis.IntCmd {
+				lpushed = true
+				assertf(t, key == queuefailed, `expected key to be %q, got %q`, queuefailed, key)
+				assertf(t, len(values) == 1, `expected values to have length 1, got %+v`, values)
+				job := ParseJob(queuefailed, values[0].(string))
+				assertf(t, job.Version == JobVersion, `expected job version to be %d, got %d`, JobVersion, job.Version)
+				assertf(t, job.Payload == payload, `expected job payload to be %q, got %q`, payload, job.Payload)
+				assertf(t, job.Attempts == 1, `expected job attempts to be 1, got %d`, job.Attempts)
+				assertf(t, job.LastError == serr, `expected job last error to be %q, got %q`, serr, job.LastError)
+				return redis.NewIntResult(0, nil)
+			},
+		},
+	}
+	handler := func(ctx context.Context, in string) error {
+		assertf(t, in == payload, `expected payload to be %q, got %q`, payload, in)
+		panic(serr)
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			t.Errorf("unexpected panic: %v", r)
+		}
+	}()
+	if err := b.Receive(context.Background(), queue, handler); err != nil {
+		t.Fatal(err)
+	}
+	assertf(t, lremed, `expected lrem to be called`)
+	assertf(t, lpushed, `expected lpush to be called`)
+}
+
+func TestRedisBrokerReceiveRequeued(t *testing.T) {
+	var zremed, lpushed bool
+	b := RedisBroker{
+		log: logMock{},
+		redis: redisMock{
+			brpoplpushFunc: func(source, destination string, timeout time.Duration) *redis.StringCmd {
+				return redis.NewStringResult(payload, nil)
+			},
+			lremFunc: func(key string, count int64, value interface{}) *redis.IntCmd {
+				// reaped while the handler was running
+				return redis.NewIntResult(0, nil)
+			},
+			zremFunc: func(key string, members ...interface{}) *redis.IntCmd {
+				zremed = true
+				return redis.NewIntResult(0, nil)
+			},
+			lpushFunc: func(key string, values ...interface{}) *redis.IntCmd {
+				lpushed = true
+				return redis.NewIntResult(0, nil)
+			},
+		},
+	}
+	handler := func(ctx context.Context, in string) error {
+		return errors.New("err")
+	}
+
+	if err := b.Receive(context.Background(), queue, handler); err != nil {
+		t.Fatal(err)
+	}
+	assertf(t, !lpushed, `expected lpush not to be called`)
+	assertf(t, !zremed, `expected zrem not to be called`)
+}
+
+func TestRedisBrokerReceiveCancel(t *testing.T) {
+	timeout := time.Millisecond
+	b := RedisBroker{
+		redis: redisMock{
+			brpoplpushFunc: func(string, string, time.Duration) *redis.StringCmd {
+				<-time.After(2 * timeout)
+				return redis.NewStringResult(payload, errors.New("test timeout"))
+			},
+		},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	err := b.Receive(ctx, queue, nil)
+	assertf(t, err == context.DeadlineExceeded,
+		"expected to get %v, got %v", context.DeadlineExceeded, err)
+}
+
+func TestRedisBrokerReap(t *testing.T) {
+	var (
+		adopted, lpushed bool
+		expired          = "expired"
+		finished         = "finished"
+	)
+	b := RedisBroker{
+		log: logMock{},
+		redis: redisMock{
+			lrangeFunc: func(key string, start, stop int64) *redis.StringSliceCmd {
+				assertf(t, key == queuetmp, `expected key to be %q, got %q`, queuetmp, key)
+				return redis.NewStringSliceResult([]string{payload}, nil)
+			},
+			zaddnxFunc: func(key string, members ...redis.Z) *redis.IntCmd {
+				adopted = true
+				assertf(t, key == queueleases, `expected key to be %q, got %q`, queueleases, key)
+				assertf(t, len(members) == 1 && members[0].Member == payload, `expected members to be %q, got %+v`, payload, members)
+				return redis.NewIntResult(1, nil)
+			},
+			zrangebyscoreFunc: func(key string, opt redis.ZRangeBy) *redis.StringSliceCmd {
+				assertf(t, key == queueleases, `expected key to be %q, got %q`, queueleases, key)
+				return redis.NewStringSliceResult([]string{expired, finished}, nil)
+			},
+			lremFunc: func(key string, count int64, value interface{}) *redis.IntCmd {
+				assertf(t, key == queuetmp, `expected key to be %q, got %q`, queuetmp, key)
+				if value == finished {
+					return redis.NewIntResult(0, nil)
+				}
+				return redis.NewIntResult(1, nil)
+			},
+			lpushFunc: func(key string, values ...interface{}) *redis.IntCmd {
+				lpushed = true
+				assertf(t, key == queue, `expected key to be %q, got %q`, queue, key)
+				assertf(t, len(values) == 1, `expected values to have length 1, got %+v`, values)
+				job := ParseJob(queue, values[0].(string))
+				assertf(t, job.Payload == expired, `expected job payload to be %q, got %q`, expired, job.Payload)
+				assertf(t, job.LastError == ErrLeaseExpired.Error(), `expected job last error to be %q, got %q`, ErrLeaseExpired, job.LastError)
+				return redis.NewIntResult(1, nil)
+			},
+		},
+	}
+
+	n, err := b.Reap(context.Background(), queue, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertf(t, n == 1, `expected 1 reaped payload, got %d`, n)
+	assertf(t, adopted, `expected zaddnx to be called`)
+	assertf(t, lpushed, `expected lpush to be called`)
+}
+
+func TestRedisBrokerPromote(t *testing.T) {
+	var (
+		lpushed []interface{}
+		due     = "due"
+		taken   = "taken"
+	)
+	b := RedisBroker{
+		log: logMock{},
+		redis: redisMock{
+			zrangebyscoreFunc: func(key string, opt redis.ZRangeBy) *redis.StringSliceCmd {
+				assertf(t, key == queuescheduled, `expected key to be %q, got %q`, queuescheduled, key)
+				assertf(t, opt.Min == "-inf", `expected min to be "-inf", got %q`, opt.Min)
+				return redis.NewStringSliceResult([]string{due, taken}, nil)
+			},
+			evalFunc: func(script string, keys []string, args ...interface{}) *redis.Cmd {
+				assertf(t, keys[0] == queuescheduled, `expected source to be %q, got %q`, queuescheduled, keys[0])
+				assertf(t, keys[1] == queue, `expected destination to be %q, got %q`, queue, keys[1])
+				if args[0] == taken {
+					return redis.NewCmdResult(int64(0), nil)
+				}
+				lpushed = append(lpushed, args...)
+				return redis.NewCmdResult(int64(1), nil)
+			},
+		},
+	}
+
+	n, err := b.Promote(context.Background(), queue)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertf(t, n == 1, `expected 1 promoted payload, got %d`, n)
+	assertf(t, len(lpushed) == 1 && lpushed[0] == due, `expected lpushed to be [%q], got %+v`, due, lpushed)
+}
+
+func TestRedisBrokerReceiveJob(t *testing.T) {
+	traceID := "trace"
+	raw, err := NewJob(WithTraceID(context.Background(), traceID), queue, payload, PriorityNormal).Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := RedisBroker{
+		log: logMock{},
+		redis: redisMock{
+			brpoplpushFunc: func(source, destination string, timeout time.Duration) *redis.StringCmd {
+				return redis.NewStringResult(raw, nil)
+			},
+			lremFunc: func(key string, count int64, value interface{}) *redis.IntCmd {
+				assertf(t, value == raw, `expected value to be %q, got %+v`, raw, value)
+				return redis.NewIntResult(1, nil)
+			},
+		},
+	}
+	handler := func(ctx context.Context, in string) error {
+		assertf(t, in == payload, `expected payload to be %q, got %q`, payload, in)
+		assertf(t, TraceID(ctx) == traceID, `expected trace id to be %q, got %q`, traceID, TraceID(ctx))
+		return nil
+	}
+
+	if err := b.Receive(context.Background(), queue, handler); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRedisBrokerReceivePriority(t *testing.T) {
+	var sources []string
+	b := RedisBroker{
+		log: logMock{},
+		redis: redisMock{
+			rpoplpushFunc: func(source, destination string) *redis.StringCmd {
+				sources = append(sources, source)
+				if source == queue {
+					return redis.NewStringResult(payload, nil)
+				}
+				return redis.NewStringResult("", redis.Nil)
+			},
+			lremFunc: func(key string, count int64, value interface{}) *redis.IntCmd {
+				return redis.NewIntResult(1, nil)
+			},
+		},
+	}
+	if err := b.Receive(context.Background(), queue, func(ctx context.Context, in string) error {
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	assertf(t, len(sources) == 2 && sources[0] == queue+":high" && sources[1] == queue,
+		`expected the high lane to be popped before the normal lane, got %v`, sources)
+}
@@ -0,0 +1,91 @@
+// Package canonical normalizes urls to canonical keys, so that different urls
+// of the same video can be detected as duplicates.
+package canonical
+
+import (
+	"errors"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// youtubeID matches youtube video ids.
+var youtubeID = regexp.MustCompile(`^[A-Za-z0-9_-]{11}$`)
+
+// trackingParams are the query parameters removed from urls, in addition to
+// the utm_ parameters.
+var trackingParams = map[string]bool{
+	"fbclid":  true,
+	"gclid":   true,
+	"feature": true,
+	"si":      true,
+	"ref":     true,
+}
+
+// Key returns the canonical key of rawurl. Youtube videos are keyed by their
+// id, e.g. youtube:dQw4w9WgXcQ. Other urls are keyed by their lowercase host
+// without www, path without trailing slash, and sorted query without tracking
+// parameters.
+func Key(rawurl string) (string, error) {
+	u, err := url.Parse(strings.TrimSpace(rawurl))
+	if err != nil {
+		return "", err
+	}
+	host := strings.TrimPrefix(strings.ToLower(u.Hostname()), "www.")
+	if host == "" {
+		return "", errors.New("canonical: url has no host")
+	}
+	if id := youtubeVideoID(host, u); id != "" {
+		return "youtube:" + id, nil
+	}
+
+	query := u.Query()
+	var keys []string
+	for k := range query {
+		if strings.HasPrefix(k, "utm_") || trackingParams[k] {
+			continue
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var params []string
+	for _, k := range keys {
+		vs := query[k]
+		sort.Strings(vs)
+		for _, v := range vs {
+			params = append(params, url.QueryEscape(k)+"="+url.QueryEscape(v))
+		}
+	}
+
+	key := host + strings.TrimSuffix(u.EscapedPath(), "/")
+	if len(params) > 0 {
+		key += "?" + strings.Join(params, "&")
+	}
+	return key, nil
+}
+
+// youtubeVideoID returns the id of the youtube video of u, or the empty
+// string if u isn't a youtube video url.
+func youtubeVideoID(host string, u *url.URL) string {
+	var id string
+	switch host {
+	case "youtube.com", "m.youtube.com", "music.youtube.com", "youtube-nocookie.com":
+		if u.Path == "/watch" {
+			id = u.Query().Get("v")
+			break
+		}
+		for _, prefix := range []string{"/shorts/", "/embed/", "/v/", "/live/"} {
+			if strings.HasPrefix(u.Path, prefix) {
+				id = strings.TrimSuffix(strings.TrimPrefix(u.Path, prefix), "/")
+				break
+			}
+		}
+	case "youtu.be":
+		id = strings.TrimSuffix(strings.TrimPrefix(u.Path, "/"), "/")
+	}
+	if !youtubeID.MatchString(id) {
+		return ""
+	}
+	return id
+}
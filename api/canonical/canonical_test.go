@@ -0,0 +1,32 @@
+package canonical
+
+import "testing"
+
+func TestKey(t *testing.T) {
+	for _, tc := range []struct {
+		url string
+		key string
+	}{
+		{url: "https://www.youtube.com/watch?v=dQw4w9WgXcQ", key: "youtube:dQw4w9WgXcQ"},
+		{url: "https://m.youtube.com/watch?v=dQw4w9WgXcQ&feature=share&t=42", key: "youtube:dQw4w9WgXcQ"},
+		{url: "https://youtu.be/dQw4w9WgXcQ?si=abc", key: "youtube:dQw4w9WgXcQ"},
+		{url: "https://www.youtube.com/shorts/dQw4w9WgXcQ", key: "youtube:dQw4w9WgXcQ"},
+		{url: "https://www.youtube.com/embed/dQw4w9WgXcQ", key: "youtube:dQw4w9WgXcQ"},
+		{url: "https://www.youtube.com/playlist?list=PL123", key: "youtube.com/playlist?list=PL123"},
+		{url: "HTTPS://Vimeo.com/123/?utm_source=x&b=2&a=1#t=10", key: "vimeo.com/123?a=1&b=2"},
+		{url: "http://vimeo.com/123", key: "vimeo.com/123"},
+	} {
+		key, err := Key(tc.url)
+		if err != nil {
+			t.Errorf("unexpected error for %q: %v", tc.url, err)
+			continue
+		}
+		if key != tc.key {
+			t.Errorf("expected key of %q to be %q, got %q", tc.url, tc.key, key)
+		}
+	}
+
+	if _, err := Key("not a url"); err == nil {
+		t.Errorf("expected an error for a url without host")
+	}
+}
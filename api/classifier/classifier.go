@@ -0,0 +1,155 @@
+// Package classifier classifies the errors of failed downloads.
+package classifier
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+)
+
+// Error categories.
+const (
+	RateLimited      = "rate_limited"
+	GeoBlocked       = "geo_blocked"
+	CopyrightBlocked = "copyright_blocked"
+	Unavailable      = "unavailable"
+	Private          = "private"
+	Network          = "network"
+	Timeout          = "timeout"
+	TooLarge         = "too_large"
+	Unknown          = "unknown"
+)
+
+// Categories are the error categories.
+var Categories = []string{
+	RateLimited,
+	GeoBlocked,
+	CopyrightBlocked,
+	Unavailable,
+	Private,
+	Network,
+	Timeout,
+	TooLarge,
+	Unknown,
+}
+
+// Rule is a classification rule. A rule matches when all its non-empty
+// patterns match.
+type Rule struct {
+	Category string `json:"category"`
+	// Error is a regexp matching the error.
+	Error string `json:"error,omitempty"`
+	// Log is a regexp matching one of the log lines.
+	Log string `json:"log,omitempty"`
+}
+
+type rule struct {
+	category string
+	err      *regexp.Regexp
+	log      *regexp.Regexp
+}
+
+// Classifier is a classifier.
+type Classifier struct {
+	rules []rule
+}
+
+// New returns a new Classifier with rules, evaluated in order.
+func New(rules []Rule) (*Classifier, error) {
+	c := new(Classifier)
+	for i, r := range rules {
+		if !IsCategory(r.Category) {
+			return nil, fmt.Errorf("rule %d: unknown category %q", i, r.Category)
+		}
+		if r.Error == "" && r.Log == "" {
+			return nil, fmt.Errorf("rule %d: error or log is required", i)
+		}
+		compiled := rule{category: r.Category}
+		var err error
+		if r.Error != "" {
+			if compiled.err, err = regexp.Compile(r.Error); err != nil {
+				return nil, fmt.Errorf("rule %d: %v", i, err)
+			}
+		}
+		if r.Log != "" {
+			if compiled.log, err = regexp.Compile(r.Log); err != nil {
+				return nil, fmt.Errorf("rule %d: %v", i, err)
+			}
+		}
+		c.rules = append(c.rules, compiled)
+	}
+	return c, nil
+}
+
+// Parse parses the json-encoded rules read from r and returns a new Classifier.
+func Parse(r io.Reader) (*Classifier, error) {
+	var rules []Rule
+	if err := json.NewDecoder(r).Decode(&rules); err != nil {
+		return nil, err
+	}
+	return New(rules)
+}
+
+// Load returns a new Classifier with the json-encoded rules of the file at
+// path, or with DefaultRules if path is empty.
+func Load(path string) (*Classifier, error) {
+	if path == "" {
+		return New(DefaultRules)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return Parse(f)
+}
+
+// Classify returns the category of a download that failed with err and logs.
+func (c *Classifier) Classify(err string, logs []string) string {
+	for _, r := range c.rules {
+		if r.err != nil && !r.err.MatchString(err) {
+			continue
+		}
+		if r.log != nil && !matchAny(r.log, logs) {
+			continue
+		}
+		return r.category
+	}
+	return Unknown
+}
+
+func matchAny(re *regexp.Regexp, logs []string) bool {
+	for _, log := range logs {
+		if re.MatchString(log) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsCategory returns whether category is one of Categories.
+func IsCategory(category string) bool {
+	for _, c := range Categories {
+		if c == category {
+			return true
+		}
+	}
+	return false
+}
+
+// DefaultRules are the default rules, matching youtube-dl errors.
+var DefaultRules = []Rule{
+	{Category: Timeout, Error: `^signal: killed$`},
+	{Category: Timeout, Error: `context deadline exceeded`},
+	{Category: Timeout, Error: `^youtube-dl: (job deadline exceeded|no output for too long)$`},
+	{Category: TooLarge, Error: `^youtube-dl: max file size exceeded$`},
+	{Category: RateLimited, Log: `^ERROR: .*HTTP Error 429: Too Many Requests`},
+	{Category: CopyrightBlocked, Log: `^ERROR: .*blocked it on copyright grounds`},
+	{Category: GeoBlocked, Log: `^ERROR: .*(not made this video available in your country|not available in your country|not available from your location)`},
+	{Category: Private, Log: `^ERROR: .*(Private video|This video is private)`},
+	{Category: Unavailable, Log: `^ERROR: .*(Video unavailable|This video is unavailable|This video has been removed|account associated with this video has been terminated|HTTP Error 404|Unsupported URL)`},
+	{Category: Timeout, Log: `^ERROR: .*timed out`},
+	{Category: Network, Log: `^ERROR: .*(urlopen error|Connection reset by peer|Connection refused|Name or service not known|Temporary failure in name resolution|Network is unreachable|Remote end closed connection)`},
+}
@@ -0,0 +1,73 @@
+package classifier
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func readFixture(t *testing.T, name string) []string {
+	t.Helper()
+	b, err := ioutil.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Split(strings.TrimSuffix(string(b), "\n"), "\n")
+}
+
+func TestClassify(t *testing.T) {
+	c, err := Load("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		fixture  string
+		err      string
+		category string
+	}{
+		{fixture: "rate_limited.log", err: "exit status 1", category: RateLimited},
+		{fixture: "geo_blocked.log", err: "exit status 1", category: GeoBlocked},
+		{fixture: "copyright_blocked.log", err: "exit status 1", category: CopyrightBlocked},
+		{fixture: "unavailable.log", err: "exit status 1", category: Unavailable},
+		{fixture: "unsupported.log", err: "exit status 1", category: Unavailable},
+		{fixture: "private.log", err: "exit status 1", category: Private},
+		{fixture: "network.log", err: "exit status 1", category: Network},
+		{fixture: "timeout.log", err: "exit status 1", category: Timeout},
+		{fixture: "killed.log", err: "signal: killed", category: Timeout},
+		{fixture: "killed.log", err: "youtube-dl: job deadline exceeded", category: Timeout},
+		{fixture: "killed.log", err: "youtube-dl: no output for too long", category: Timeout},
+		{fixture: "killed.log", err: "youtube-dl: max file size exceeded", category: TooLarge},
+		{fixture: "unknown.log", err: "exit status 1", category: Unknown},
+	} {
+		logs := readFixture(t, tc.fixture)
+		if category := c.Classify(tc.err, logs); category != tc.category {
+			t.Errorf("expected %s to be classified as %q, got %q", tc.fixture, tc.category, category)
+		}
+	}
+}
+
+func TestLoad(t *testing.T) {
+	c, err := Load(filepath.Join("testdata", "rules.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if category := c.Classify("exit status 1", readFixture(t, "rate_limited.log")); category != RateLimited {
+		t.Errorf("expected %q, got %q", RateLimited, category)
+	}
+	if category := c.Classify("exit status 1", readFixture(t, "geo_blocked.log")); category != Unknown {
+		t.Errorf("expected %q, got %q", Unknown, category)
+	}
+}
+
+func TestNewInvalidRules(t *testing.T) {
+	for _, rules := range [][]Rule{
+		{{Category: "nope", Log: "."}},
+		{{Category: Network}},
+		{{Category: Network, Log: "("}},
+	} {
+		if _, err := New(rules); err == nil {
+			t.Errorf("expected error for rules %+v", rules)
+		}
+	}
+}
@@ -2,18 +2,24 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"net/http"
 	"os"
+	"strings"
+	"time"
 
-	"github.com/yansal/youtube-ar/api/broker"
+	"github.com/yansal/sql/nest"
+	"github.com/yansal/youtube-ar/api/extractor"
 	"github.com/yansal/youtube-ar/api/log"
 	loghttp "github.com/yansal/youtube-ar/api/log/http"
 	"github.com/yansal/youtube-ar/api/manager"
+	"github.com/yansal/youtube-ar/api/model"
 	"github.com/yansal/youtube-ar/api/oembed"
 	"github.com/yansal/youtube-ar/api/payload"
+	"github.com/yansal/youtube-ar/api/postprocess"
 	"github.com/yansal/youtube-ar/api/query"
 	"github.com/yansal/youtube-ar/api/service"
 	"github.com/yansal/youtube-ar/api/store"
@@ -23,35 +29,75 @@ import (
 
 func createURL(ctx context.Context, args []string) error {
 	fs := flag.NewFlagSet("create-url", flag.ExitOnError)
-	var url string
+	var url, priority, duplicate string
 	fs.StringVar(&url, "url", "", "url to create")
+	fs.StringVar(&priority, "priority", "normal", "priority of the jobs of the url: high, normal or low")
+	fs.StringVar(&duplicate, "duplicate", os.Getenv("DUPLICATE_POLICY"), "policy if the url already exists: return, redownload or reject")
+	opts := optionsFlags(fs)
+	var steps, extractorName string
+	fs.StringVar(&steps, "postprocess", "", "comma-separated post-processing steps, e.g. transcode:mp4,normalize")
+	fs.StringVar(&extractorName, "extractor", "", extractorUsage)
 	if err := fs.Parse(args); err != nil {
 		return err
 	}
 	if url == "" {
 		return errors.New("url is required")
 	}
-
-	log := log.New()
-	redis, err := newRedis(log)
+	specs, err := postprocess.ParseSpecs(steps)
+	if err != nil {
+		return err
+	}
+	policy, err := manager.ParseDuplicatePolicy(duplicate)
 	if err != nil {
 		return err
 	}
-	broker := broker.New(redis, log)
+
+	log := log.New()
 	db, err := newDB(log)
 	if err != nil {
 		return err
 	}
-	m := manager.NewServer(broker, store.New())
+	m := manager.NewServer(store.New(), policy, nil)
 
-	p := payload.URL{URL: url}
+	p := payload.URL{URL: url, Priority: priority, Options: *opts, PostProcess: specs, Extractor: extractorName}
 	if err := p.Validate(); err != nil {
 		return err
 	}
 
-	if _, err := m.CreateURL(ctx, db, p); err != nil {
+	created, err := m.CreateURL(ctx, db, p)
+	if derr, ok := err.(*manager.DuplicateError); ok && !derr.Conflict {
+		fmt.Println(derr)
+		return nil
+	} else if err != nil {
 		return err
 	}
+	fmt.Printf("created url %d\n", created.ID)
+	return nil
+}
+
+// extractorUsage is the usage of the extractor flags.
+const extractorUsage = "extractor backend: youtube-dl, yt-dlp or direct, selected by host rules by default"
+
+// optionsFlags defines the download options flags in fs.
+func optionsFlags(fs *flag.FlagSet) *youtubedl.Options {
+	var opts youtubedl.Options
+	fs.BoolVar(&opts.AudioOnly, "audio-only", false, "download the audio only")
+	fs.IntVar(&opts.MaxHeight, "max-height", 0, "maximum height of the video, e.g. 720")
+	fs.StringVar(&opts.Container, "container", "", "preferred container, e.g. mp4, webm, mp3 or m4a")
+	fs.StringVar(&opts.Format, "format", "", "youtube-dl format expression")
+	fs.BoolVar(&opts.Thumbnail, "thumbnail", false, "download the thumbnail")
+	fs.Var((*languages)(&opts.Subtitles), "subtitles", "comma-separated languages of the subtitles to download, e.g. en,fr")
+	fs.BoolVar(&opts.Stream, "stream", false, "upload the file while it is downloaded, in a single file format")
+	return &opts
+}
+
+// languages is a flag of comma-separated languages.
+type languages []string
+
+func (l *languages) String() string { return strings.Join(*l, ",") }
+
+func (l *languages) Set(s string) error {
+	*l = strings.Split(s, ",")
 	return nil
 }
 
@@ -67,21 +113,16 @@ func createURLsFromPlaylist(ctx context.Context, args []string) error {
 	}
 
 	log := log.New()
-	redis, err := newRedis(log)
+	db, err := newDB(log)
 	if err != nil {
 		return err
 	}
-	broker := broker.New(redis, log)
 	store := store.New()
-	manager := manager.NewServer(broker, store)
+	manager := manager.NewServer(store, manager.DuplicateReturn, nil)
 	httpclient := loghttp.Wrap(new(http.Client), log)
 	youtube := youtube.New(os.Getenv("YOUTUBE_API_KEY"), httpclient)
 	playlistLoader := service.NewPlaylistLoader(manager, store, youtube)
 
-	db, err := newDB(log)
-	if err != nil {
-		return err
-	}
 	return playlistLoader.CreateURLsFromYoutube(ctx, db, playlist)
 }
 
@@ -112,23 +153,80 @@ func downloadURL(ctx context.Context, args []string) error {
 	fs := flag.NewFlagSet("download-url", flag.ExitOnError)
 	var url string
 	fs.StringVar(&url, "url", "", "url to download")
+	opts := optionsFlags(fs)
+	var steps string
+	fs.StringVar(&steps, "postprocess", "", "comma-separated post-processing steps, e.g. transcode:mp4,normalize")
+	var extractorName string
+	fs.StringVar(&extractorName, "extractor", "", extractorUsage)
 	if err := fs.Parse(args); err != nil {
 		return err
 	}
 	if url == "" {
 		return errors.New("url is required")
 	}
+	if err := opts.Validate(); err != nil {
+		return err
+	}
+	if err := extractor.Validate(extractorName); err != nil {
+		return err
+	}
+	specs, err := postprocess.ParseSpecs(steps)
+	if err != nil {
+		return err
+	}
 
-	d := youtubedl.New()
-	stream := d.Download(ctx, url, "")
+	extractors, err := newExtractors()
+	if err != nil {
+		return err
+	}
+	name, d, err := extractors.Select(url, extractorName)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("downloading url with %s\n", name)
+	// printEntries prints the entries of url, and returns whether it is a
+	// playlist
+	printEntries := func() (bool, error) {
+		entries, err := d.Entries(ctx, url, "")
+		if err != nil || entries == nil {
+			return false, err
+		}
+		fmt.Printf("url is a playlist of %d entries\n", len(entries))
+		for _, entry := range entries {
+			fmt.Println(entry.URL)
+		}
+		return true, nil
+	}
+	if youtubedl.IsPlaylist(url) {
+		if ok, err := printEntries(); ok || err != nil {
+			return err
+		}
+	}
+	stream := d.Download(ctx, url, "", *opts)
 	for event := range stream {
 		switch event.Type {
 		case youtubedl.Log:
 			fmt.Println(event.Log)
 		case youtubedl.Failure:
+			if event.Err == youtubedl.ErrPlaylist {
+				if ok, err := printEntries(); ok || err != nil {
+					return err
+				}
+			}
 			return event.Err
 		case youtubedl.Success:
 			fmt.Printf("downloaded url to %s\n", event.Path)
+			for _, artifact := range event.Artifacts {
+				fmt.Printf("downloaded %s to %s\n", artifact.Kind, artifact.Path)
+			}
+			if len(specs) == 0 {
+				continue
+			}
+			path, err := postprocess.New().Process(ctx, specs, event.Path, func(log string) { fmt.Println(log) })
+			if err != nil {
+				return err
+			}
+			fmt.Printf("post-processed url to %s\n", path)
 		}
 	}
 	return nil
@@ -152,7 +250,7 @@ func listLogs(ctx context.Context, args []string) error {
 	if err != nil {
 		return err
 	}
-	m := manager.NewServer(nil, store.New())
+	m := manager.NewServer(store.New(), manager.DuplicateReturn, nil)
 
 	logs, err := m.ListLogs(ctx, db, urlID, &query.Logs{Cursor: cursor})
 	if err != nil {
@@ -179,7 +277,7 @@ func listURLs(ctx context.Context, args []string) error {
 	if err != nil {
 		return err
 	}
-	m := manager.NewServer(nil, store.New())
+	m := manager.NewServer(store.New(), manager.DuplicateReturn, nil)
 
 	urls, err := m.ListURLs(ctx, db, &query.URLs{Cursor: cursor, Limit: limit})
 	if err != nil {
@@ -192,45 +290,387 @@ func listURLs(ctx context.Context, args []string) error {
 }
 
 func retryNextDownloadURL(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("retry-next-download-url", flag.ExitOnError)
+	var (
+		backoff    string
+		maxRetries int64
+	)
+	fs.StringVar(&backoff, "backoff", os.Getenv("RETRY_BACKOFF"), "semicolon-separated category=delays, e.g. rate_limited=5m,30m,2h;timeout=1m")
+	fs.Int64Var(&maxRetries, "max-retries", service.DefaultBackoffPolicy.MaxRetries, "maximum number of retries of a url")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	policy, err := service.ParseBackoffPolicy(backoff, maxRetries)
+	if err != nil {
+		return err
+	}
+
 	log := log.New()
-	redis, err := newRedis(log)
+	db, err := newDB(log)
+	if err != nil {
+		return err
+	}
+	broker, err := newBroker(log, db)
+	if err != nil {
+		return err
+	}
+	classifier, err := newClassifier()
+	if err != nil {
+		return err
+	}
+	store := store.New()
+	manager := manager.NewServer(store, manager.DuplicateReturn, txBroker(broker))
+
+	retrier := service.NewRetrier(broker, manager, store, classifier)
+	return retrier.RetryNextDownloadURL(ctx, db, policy)
+}
+
+func runRetrier(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("retrier", flag.ExitOnError)
+	var (
+		backoff    string
+		maxRetries int64
+		interval   time.Duration
+	)
+	fs.StringVar(&backoff, "backoff", os.Getenv("RETRY_BACKOFF"), "semicolon-separated category=delays, e.g. rate_limited=5m,30m,2h;timeout=1m")
+	fs.Int64Var(&maxRetries, "max-retries", service.DefaultBackoffPolicy.MaxRetries, "maximum number of retries of a url")
+	fs.DurationVar(&interval, "interval", 10*time.Second, "interval between checks when there are no failed urls")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	policy, err := service.ParseBackoffPolicy(backoff, maxRetries)
 	if err != nil {
 		return err
 	}
-	broker := broker.New(redis, log)
+
+	log := log.New()
 	db, err := newDB(log)
 	if err != nil {
 		return err
 	}
+	broker, err := newBroker(log, db)
+	if err != nil {
+		return err
+	}
+	classifier, err := newClassifier()
+	if err != nil {
+		return err
+	}
 	store := store.New()
-	manager := manager.NewServer(broker, store)
+	manager := manager.NewServer(store, manager.DuplicateReturn, txBroker(broker))
 
-	retrier := service.NewRetrier(broker, manager, store)
-	return retrier.RetryNextDownloadURL(ctx, db)
+	retrier := service.NewRetrier(broker, manager, store, classifier)
+	return retrier.Run(ctx, db, policy, interval)
 }
 
-func shouldRetry(ctx context.Context, args []string) error {
+func listOutbox(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("list-outbox", flag.ExitOnError)
+	var cursor, limit int64
+	fs.Int64Var(&cursor, "cursor", 0, "cursor")
+	fs.Int64Var(&limit, "limit", 10, "limit")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
 
-	fs := flag.NewFlagSet("should-retry", flag.ExitOnError)
-	var urlID int64
-	fs.Int64Var(&urlID, "url-id", 0, "url")
+	log := log.New()
+	db, err := newDB(log)
+	if err != nil {
+		return err
+	}
+
+	entries, err := store.New().ListPendingOutboxEntries(ctx, db, &query.Outbox{Cursor: cursor, Limit: limit})
+	if err != nil {
+		return err
+	}
+	for i := range entries {
+		fmt.Printf("%+v\n", entries[i])
+	}
+	return nil
+}
+
+func replayOutbox(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("replay-outbox", flag.ExitOnError)
+	var id int64
+	fs.Int64Var(&id, "id", 0, "outbox entry id")
 	if err := fs.Parse(args); err != nil {
 		return err
 	}
-	if urlID == 0 {
-		return errors.New("url-id is required")
+	if id == 0 {
+		return errors.New("id is required")
+	}
+
+	log := log.New()
+	db, err := newDB(log)
+	if err != nil {
+		return err
+	}
+	broker, err := newBroker(log, db)
+	if err != nil {
+		return err
+	}
+
+	relay := service.NewRelay(broker, store.New(), log)
+	return relay.Replay(ctx, db, id)
+}
+
+func listFailed(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("list-failed", flag.ExitOnError)
+	var (
+		queue         string
+		offset, limit int64
+	)
+	fs.StringVar(&queue, "queue", "download-url", "queue")
+	fs.Int64Var(&offset, "offset", 0, "offset")
+	fs.Int64Var(&limit, "limit", 10, "limit")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	retrier, _, err := newCmdRetrier()
+	if err != nil {
+		return err
+	}
+	jobs, err := retrier.ListFailed(ctx, queue, &query.Failed{Offset: offset, Limit: limit})
+	if err != nil {
+		return err
+	}
+	for i := range jobs {
+		fmt.Printf("%+v\n", jobs[i])
+	}
+	return nil
+}
+
+func countFailed(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("count-failed", flag.ExitOnError)
+	var queue string
+	fs.StringVar(&queue, "queue", "download-url", "queue")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	retrier, _, err := newCmdRetrier()
+	if err != nil {
+		return err
+	}
+	n, err := retrier.CountFailed(ctx, queue)
+	if err != nil {
+		return err
+	}
+	fmt.Println(n)
+	return nil
+}
+
+func getFailed(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("get-failed", flag.ExitOnError)
+	var queue, id string
+	fs.StringVar(&queue, "queue", "download-url", "queue")
+	fs.StringVar(&id, "id", "", "job id")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if id == "" {
+		return errors.New("id is required")
+	}
+
+	retrier, _, err := newCmdRetrier()
+	if err != nil {
+		return err
+	}
+	job, err := retrier.GetFailed(ctx, queue, id)
+	if err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(job, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s\n", b)
+	return nil
+}
+
+func requeueFailed(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("requeue-failed", flag.ExitOnError)
+	var (
+		queue, id, errorFilter string
+		all                    bool
+	)
+	fs.StringVar(&queue, "queue", "download-url", "queue")
+	fs.StringVar(&id, "id", "", "requeue the job with id")
+	fs.StringVar(&errorFilter, "error", "", "requeue the jobs whose last error contains error")
+	fs.BoolVar(&all, "all", false, "requeue all jobs")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if id == "" && errorFilter == "" && !all {
+		return errors.New("one of id, error or all is required")
+	}
+
+	retrier, db, err := newCmdRetrier()
+	if err != nil {
+		return err
+	}
+	if id != "" {
+		return retrier.RequeueFailed(ctx, db, queue, id)
+	}
+	n, err := retrier.RequeueFailedWhere(ctx, db, queue, service.FailedFilter{Error: errorFilter})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("requeued %d jobs\n", n)
+	return nil
+}
+
+func purgeFailed(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("purge-failed", flag.ExitOnError)
+	var queue string
+	fs.StringVar(&queue, "queue", "download-url", "queue")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	retrier, _, err := newCmdRetrier()
+	if err != nil {
+		return err
+	}
+	n, err := retrier.PurgeFailed(ctx, queue)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("purged %d jobs\n", n)
+	return nil
+}
+
+// newCmdRetrier returns a new retrier for the failed jobs commands, and its
+// db.
+func newCmdRetrier() (*service.Retrier, nest.Querier, error) {
+	log := log.New()
+	db, err := newDB(log)
+	if err != nil {
+		return nil, nil, err
+	}
+	broker, err := newBroker(log, db)
+	if err != nil {
+		return nil, nil, err
+	}
+	classifier, err := newClassifier()
+	if err != nil {
+		return nil, nil, err
 	}
 	store := store.New()
+	return service.NewRetrier(broker, manager.NewServer(store, manager.DuplicateReturn, txBroker(broker)), store, classifier), db, nil
+}
+
+func reap(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("reap", flag.ExitOnError)
+	var (
+		queues string
+		fail   bool
+	)
+	fs.StringVar(&queues, "queues", "download-url,get-oembed", "comma-separated queues")
+	fs.BoolVar(&fail, "fail", false, "move expired payloads to the failed queues instead of requeuing them")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
 	log := log.New()
 	db, err := newDB(log)
 	if err != nil {
 		return err
 	}
-	url, err := store.GetURL(ctx, db, urlID)
+	broker, err := newBroker(log, db)
+	if err != nil {
+		return err
+	}
+
+	reaper := service.NewReaper(broker, log)
+	return reaper.Reap(ctx, strings.Split(queues, ","), fail)
+}
+
+func listWorkers(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("list-workers", flag.ExitOnError)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	log := log.New()
+	db, err := newDB(log)
+	if err != nil {
+		return err
+	}
+	broker, err := newBroker(log, db)
+	if err != nil {
+		return err
+	}
+
+	registry := service.NewRegistry(broker, log)
+	heartbeats, err := registry.ListWorkers(ctx)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, h := range heartbeats {
+		fmt.Printf("%s\tpid=%d\tqueues=%s\tstarted_at=%s\tseen_at=%s\tstale=%t\n",
+			h.ID, h.PID, strings.Join(h.Queues, ","), h.StartedAt.Format(time.RFC3339), h.SeenAt.Format(time.RFC3339), h.Stale(now))
+		for _, job := range h.Jobs {
+			fmt.Printf("\t%s\t%s\tstarted_at=%s\n", job.Queue, job.ID, job.StartedAt.Format(time.RFC3339))
+		}
+	}
+	return nil
+}
+
+func classifyURL(ctx context.Context, args []string) error {
+	url, category, err := classifyCmdURL(ctx, "classify-url", args)
+	if err != nil {
+		return err
+	}
+	fmt.Println(url.URL)
+	fmt.Println(category)
+	return nil
+}
+
+// shouldRetry prints whether the url would be retried by the retrier, i.e.
+// whether the category of its error has delays in RETRY_BACKOFF. It predates
+// classify-url, and is kept for compatibility.
+func shouldRetry(ctx context.Context, args []string) error {
+	url, category, err := classifyCmdURL(ctx, "should-retry", args)
+	if err != nil {
+		return err
+	}
+	policy, err := service.ParseBackoffPolicy(os.Getenv("RETRY_BACKOFF"), service.DefaultBackoffPolicy.MaxRetries)
 	if err != nil {
 		return err
 	}
+	_, ok := policy.Delays[category]
 	fmt.Println(url.URL)
-	fmt.Println(url.ShouldRetry())
+	fmt.Println(ok)
 	return nil
 }
+
+// classifyCmdURL returns the url with the url-id flag of args, and the
+// category of its error.
+func classifyCmdURL(ctx context.Context, name string, args []string) (*model.URL, string, error) {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	var urlID int64
+	fs.Int64Var(&urlID, "url-id", 0, "url")
+	if err := fs.Parse(args); err != nil {
+		return nil, "", err
+	}
+	if urlID == 0 {
+		return nil, "", errors.New("url-id is required")
+	}
+	classifier, err := newClassifier()
+	if err != nil {
+		return nil, "", err
+	}
+	store := store.New()
+	log := log.New()
+	db, err := newDB(log)
+	if err != nil {
+		return nil, "", err
+	}
+	url, err := store.GetURL(ctx, db, urlID)
+	if err != nil {
+		return nil, "", err
+	}
+	return url, classifier.Classify(url.Error.String, url.Logs), nil
+}
@@ -0,0 +1,277 @@
+// Package direct downloads plain media links over http, without extracting
+// them. It implements the event stream of package youtubedl.
+package direct
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/yansal/youtube-ar/api/youtubedl"
+)
+
+// New returns a new Fetcher. Downloads larger than maxFileSize bytes, or not
+// receiving anything for idleTimeout, are aborted. Zero values disable the
+// limits.
+func New(maxFileSize int64, idleTimeout time.Duration) *Fetcher {
+	return &Fetcher{maxFileSize: maxFileSize, idleTimeout: idleTimeout}
+}
+
+// Fetcher is a downloader of plain media links.
+type Fetcher struct {
+	maxFileSize int64
+	idleTimeout time.Duration
+}
+
+// progressInterval is the interval between two progress events.
+const progressInterval = time.Second
+
+// Entries returns nil, plain media links are single files.
+func (f *Fetcher) Entries(ctx context.Context, rawurl string, proxyaddr string) ([]youtubedl.Entry, error) {
+	return nil, nil
+}
+
+// Download downloads rawurl and returns a stream of youtubedl.Event. The
+// format options are ignored.
+func (f *Fetcher) Download(ctx context.Context, rawurl string, proxyaddr string, opts youtubedl.Options) <-chan youtubedl.Event {
+	stream := make(chan youtubedl.Event)
+	go func() {
+		defer close(stream)
+		path, err := f.download(ctx, rawurl, proxyaddr, opts, stream)
+		if err != nil {
+			stream <- youtubedl.Event{Type: youtubedl.Failure, Err: err}
+			return
+		}
+		stream <- youtubedl.Event{Type: youtubedl.Success, Path: path}
+	}()
+	return stream
+}
+
+func (f *Fetcher) download(ctx context.Context, rawurl string, proxyaddr string, opts youtubedl.Options, stream chan<- youtubedl.Event) (string, error) {
+	logf := func(format string, args ...interface{}) {
+		stream <- youtubedl.Event{Type: youtubedl.Log, Log: "direct: " + fmt.Sprintf(format, args...)}
+	}
+	if !opts.IsZero() {
+		logf("ignoring download options %+v", opts)
+	}
+
+	transport := &http.Transport{}
+	if proxyaddr != "" {
+		proxy, err := url.Parse(proxyaddr)
+		if err != nil {
+			return "", err
+		}
+		transport.Proxy = http.ProxyURL(proxy)
+	}
+	client := &http.Client{Transport: transport}
+	defer transport.CloseIdleConnections()
+
+	reqctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	w := &watchdog{timeout: f.idleTimeout, cancel: cancel}
+	w.reset()
+	defer w.stop()
+
+	req, err := http.NewRequest(http.MethodGet, rawurl, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := client.Do(req.WithContext(reqctx))
+	if err != nil {
+		return "", f.err(ctx, w, err)
+	}
+	defer resp.Body.Close()
+	logf("GET %s: %s, %s, %d bytes", rawurl, resp.Status, resp.Header.Get("Content-Type"), resp.ContentLength)
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("direct: %s", resp.Status)
+	}
+	if f.maxFileSize > 0 && resp.ContentLength > f.maxFileSize {
+		return "", youtubedl.ErrFileTooLarge
+	}
+
+	dir, err := ioutil.TempDir("", "youtube-ar-direct-")
+	if err != nil {
+		return "", err
+	}
+	var success bool
+	defer func() {
+		// on success, the caller removes dir after using the file
+		if !success {
+			os.RemoveAll(dir)
+		}
+	}()
+	path := filepath.Join(dir, filename(req.URL, resp))
+	file, err := os.Create(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	var (
+		r        io.Reader = resp.Body
+		written  int64
+		reported time.Time
+		started  = time.Now()
+	)
+	if f.maxFileSize > 0 {
+		r = io.LimitReader(r, f.maxFileSize+1)
+	}
+	buf := make([]byte, 32*1024)
+	for {
+		n, rerr := r.Read(buf)
+		if n > 0 {
+			w.reset()
+			if _, err := file.Write(buf[:n]); err != nil {
+				return "", err
+			}
+			written += int64(n)
+			if f.maxFileSize > 0 && written > f.maxFileSize {
+				return "", youtubedl.ErrFileTooLarge
+			}
+			if time.Since(reported) >= progressInterval {
+				stream <- youtubedl.Event{Type: youtubedl.ProgressUpdate, Progress: progress(written, resp.ContentLength, started)}
+				reported = time.Now()
+			}
+		}
+		if rerr == io.EOF {
+			break
+		} else if rerr != nil {
+			return "", f.err(ctx, w, rerr)
+		}
+	}
+	if err := file.Close(); err != nil {
+		return "", err
+	}
+	p := progress(written, written, started)
+	p.Phase = youtubedl.Downloaded
+	stream <- youtubedl.Event{Type: youtubedl.ProgressUpdate, Progress: p}
+	success = true
+	return path, nil
+}
+
+// err returns the error of an aborted download.
+func (f *Fetcher) err(ctx context.Context, w *watchdog, err error) error {
+	if w.fired() {
+		return youtubedl.ErrIdle
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		return youtubedl.ErrDeadlineExceeded
+	}
+	return err
+}
+
+// progress returns the progress of a download of total bytes, or of unknown
+// size if total is negative.
+func progress(written, total int64, started time.Time) youtubedl.Progress {
+	p := youtubedl.Progress{Phase: youtubedl.Downloading, DownloadedBytes: written}
+	if elapsed := time.Since(started).Seconds(); elapsed > 0 {
+		p.Speed = int64(float64(written) / elapsed)
+	}
+	if total > 0 {
+		p.TotalBytes = total
+		p.Percent = float64(written) * 100 / float64(total)
+		if p.Speed > 0 {
+			p.ETA = (total - written) / p.Speed
+		}
+	}
+	return p
+}
+
+// filename returns the name of the file of resp, from its Content-Disposition
+// header or the path of u. An extension is added from the content type when
+// missing.
+func filename(u *url.URL, resp *http.Response) string {
+	var name string
+	if _, params, err := mime.ParseMediaType(resp.Header.Get("Content-Disposition")); err == nil {
+		name = params["filename"]
+	}
+	if name == "" {
+		name = path.Base(u.Path)
+	}
+	name = filepath.Base(strings.Replace(name, "\\", "/", -1))
+	if name == "." || name == "/" || name == "" {
+		name = "download"
+	}
+	if filepath.Ext(name) == "" {
+		name += extension(resp.Header.Get("Content-Type"))
+	}
+	return name
+}
+
+// extensions are the preferred extensions of media types, as the mime
+// package returns them in alphabetical order.
+var extensions = map[string]string{
+	"audio/mp4":  ".m4a",
+	"audio/mpeg": ".mp3",
+	"audio/ogg":  ".ogg",
+	"audio/webm": ".weba",
+	"video/mp4":  ".mp4",
+	"video/webm": ".webm",
+}
+
+// extension returns the extension of contentType, or the empty string.
+func extension(contentType string) string {
+	typ, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return ""
+	}
+	if ext, ok := extensions[typ]; ok {
+		return ext
+	}
+	if exts, err := mime.ExtensionsByType(typ); err == nil && len(exts) > 0 {
+		return exts[0]
+	}
+	return ""
+}
+
+// watchdog cancels a download not receiving anything for timeout.
+type watchdog struct {
+	timeout time.Duration
+	cancel  context.CancelFunc
+
+	mu     sync.Mutex
+	timer  *time.Timer
+	killed bool
+}
+
+func (w *watchdog) reset() {
+	if w.timeout <= 0 {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.timer == nil {
+		w.timer = time.AfterFunc(w.timeout, func() {
+			w.mu.Lock()
+			w.killed = true
+			w.mu.Unlock()
+			w.cancel()
+		})
+		return
+	}
+	w.timer.Reset(w.timeout)
+}
+
+func (w *watchdog) stop() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.timer != nil {
+		w.timer.Stop()
+	}
+}
+
+func (w *watchdog) fired() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.killed
+}
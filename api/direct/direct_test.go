@@ -0,0 +1,82 @@
+package direct
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/yansal/youtube-ar/api/youtubedl"
+)
+
+func assertf(t *testing.T, ok bool, msg string, args ...interface{}) {
+	t.Helper()
+	if !ok {
+		t.Errorf(msg, args...)
+	}
+}
+
+func TestDownload(t *testing.T) {
+	body := strings.Repeat("a", 1024)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/video":
+			w.Header().Set("Content-Type", "video/mp4")
+		case "/attachment":
+			w.Header().Set("Content-Disposition", `attachment; filename="../clip.webm"`)
+		case "/missing":
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(body))
+	}))
+	defer ts.Close()
+
+	for _, tc := range []struct {
+		path, filename string
+	}{
+		{path: "/video", filename: "video.mp4"},
+		{path: "/attachment", filename: "clip.webm"},
+		{path: "/dir/song.mp3", filename: "song.mp3"},
+	} {
+		var success youtubedl.Event
+		var progress bool
+		for event := range New(0, 0).Download(context.Background(), ts.URL+tc.path, "", youtubedl.Options{}) {
+			switch event.Type {
+			case youtubedl.Failure:
+				t.Fatal(event.Err)
+			case youtubedl.Success:
+				success = event
+			case youtubedl.ProgressUpdate:
+				progress = true
+			}
+		}
+		assertf(t, progress, "expected progress events")
+		assertf(t, filepath.Base(success.Path) == tc.filename, "expected %s, got %s", tc.filename, success.Path)
+		b, err := ioutil.ReadFile(success.Path)
+		assertf(t, err == nil, "expected nil, got %v", err)
+		assertf(t, string(b) == body, "expected body to be downloaded")
+		os.RemoveAll(filepath.Dir(success.Path))
+	}
+
+	for _, tc := range []struct {
+		path        string
+		maxFileSize int64
+		err         string
+	}{
+		{path: "/missing", err: "direct: 404 Not Found"},
+		{path: "/video", maxFileSize: 512, err: youtubedl.ErrFileTooLarge.Error()},
+	} {
+		var err error
+		for event := range New(tc.maxFileSize, 0).Download(context.Background(), ts.URL+tc.path, "", youtubedl.Options{}) {
+			if event.Type == youtubedl.Failure {
+				err = event.Err
+			}
+		}
+		assertf(t, err != nil && err.Error() == tc.err, "expected %s, got %v", tc.err, err)
+	}
+}
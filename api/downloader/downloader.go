@@ -2,24 +2,33 @@ package downloader
 
 import (
 	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
 	"io"
+	"mime"
 	"os"
 	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/yansal/sql/nest"
+	"github.com/yansal/youtube-ar/api/extractor"
 	"github.com/yansal/youtube-ar/api/log"
 	"github.com/yansal/youtube-ar/api/model"
+	"github.com/yansal/youtube-ar/api/postprocess"
 	"github.com/yansal/youtube-ar/api/tor"
 	"github.com/yansal/youtube-ar/api/youtubedl"
 )
 
 // Downloader is a downloader implementation.
 type Downloader struct {
-	tor       Tor
-	youtubedl YoutubeDL
-	storage   Storage
-	store     Store
-	log       log.Logger
+	tor         Tor
+	extractors  Extractors
+	postprocess PostProcessor
+	storage     Storage
+	store       Store
+	log         log.Logger
 }
 
 // Tor is the tor interface required by Downloader.
@@ -27,28 +36,81 @@ type Tor interface {
 	Start(ctx context.Context) <-chan tor.Event
 }
 
-// YoutubeDL is the youtubedl interface required by Downloader.
-type YoutubeDL interface {
-	Download(ctx context.Context, url string, proxyurl string) <-chan youtubedl.Event
+// Extractors is the extractor registry interface required by Downloader.
+type Extractors interface {
+	Select(url string, name string) (string, extractor.Extractor, error)
+}
+
+// Streamer is implemented by extractors able to stream the downloaded file,
+// instead of writing it to disk.
+type Streamer interface {
+	Stream(ctx context.Context, url string, proxyurl string, opts youtubedl.Options, w io.Writer) <-chan youtubedl.Event
+}
+
+// PlaylistError is returned by DownloadURL when the url is a playlist, or an
+// url with multiple videos, whose entries must be downloaded instead.
+type PlaylistError struct {
+	Entries []youtubedl.Entry
+}
+
+func (e *PlaylistError) Error() string {
+	return fmt.Sprintf("url is a playlist of %d entries", len(e.Entries))
+}
+
+// PostProcessor is the post-processor interface required by Downloader.
+type PostProcessor interface {
+	Process(ctx context.Context, specs []postprocess.Spec, path string, log func(string)) (string, error)
 }
 
 // Storage is the storage interface required by Downloader.
 type Storage interface {
 	Save(ctx context.Context, path string, reader io.ReadSeeker) error
+	Upload(ctx context.Context, path string, reader io.Reader) (string, error)
 }
 
 // Store is the store interface required by Downloader.
 type Store interface {
 	AppendLog(ctx context.Context, db nest.Querier, urlID int64, log *model.Log) error
+	SetProgress(ctx context.Context, db nest.Querier, url *model.URL) error
+	SetMetadata(ctx context.Context, db nest.Querier, url *model.URL) error
+	SetExtractor(ctx context.Context, db nest.Querier, url *model.URL) error
+	CreateArtifact(ctx context.Context, db nest.Querier, artifact *model.Artifact) error
 }
 
+// progressInterval is the minimum interval between two progress updates of
+// the same phase.
+const progressInterval = time.Second
+
 // New returns a new Downloader.
-func New(tor Tor, youtubedl YoutubeDL, storage Storage, store Store, log log.Logger) *Downloader {
-	return &Downloader{tor: tor, youtubedl: youtubedl, storage: storage, store: store, log: log}
+func New(tor Tor, extractors Extractors, postprocess PostProcessor, storage Storage, store Store, log log.Logger) *Downloader {
+	return &Downloader{tor: tor, extractors: extractors, postprocess: postprocess, storage: storage, store: store, log: log}
 }
 
-// DownloadURL downloads an url.
+// DownloadURL downloads an url with its extractor and options, and
+// post-processes the downloaded file before saving it. The extractor
+// selected for the url is recorded on it.
 func (p *Downloader) DownloadURL(ctx context.Context, db nest.Querier, url *model.URL) (string, error) {
+	name, extractor, err := p.extractors.Select(url.URL, url.Extractor.String)
+	if err != nil {
+		return "", err
+	}
+	url.Extractor = sql.NullString{Valid: true, String: name}
+	if err := p.store.SetExtractor(ctx, db, url); err != nil {
+		p.log.Log(ctx, err.Error())
+	}
+	var opts youtubedl.Options
+	if url.Options != nil {
+		if err := json.Unmarshal(url.Options, &opts); err != nil {
+			return "", err
+		}
+	}
+	var specs []postprocess.Spec
+	if url.PostProcess != nil {
+		if err := json.Unmarshal(url.PostProcess, &specs); err != nil {
+			return "", err
+		}
+	}
+
 	torready := make(chan tor.Event)
 	torctx, shutdowntor := context.WithCancel(ctx)
 	defer shutdowntor()
@@ -87,27 +149,120 @@ func (p *Downloader) DownloadURL(ctx context.Context, db nest.Querier, url *mode
 
 	// TODO: fetch and save tor output geoip
 
+	// list the entries of urls shaped like playlists before downloading
+	// them, other playlists are detected by the download
+	if youtubedl.IsPlaylist(url.URL) {
+		if err := p.playlist(ctx, db, url, extractor, proxyurl); err != nil {
+			return "", err
+		}
+	}
+
+	streamer, ok := extractor.(Streamer)
+	if opts.Stream && !ok {
+		p.appendLog(ctx, db, url, fmt.Sprintf("downloader: %s can't stream, downloading to disk", name))
+	}
+	streaming := opts.Stream && ok && len(specs) == 0
+
 	var (
-		path string
-		err  error
+		path      string
+		artifacts []youtubedl.Artifact
+
+		progress youtubedl.Progress
+		saved    time.Time
+		unsaved  bool
+
+		// the streamed file is uploaded from pr while it is written to pw
+		pr, pw   = io.Pipe()
+		uploaded chan upload
 	)
-	stream := p.youtubedl.Download(ctx, url.URL, proxyurl)
+	downloadctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var stream <-chan youtubedl.Event
+	if streaming {
+		stream = streamer.Stream(downloadctx, url.URL, proxyurl, opts, pw)
+	} else {
+		stream = extractor.Download(downloadctx, url.URL, proxyurl, opts)
+	}
 	for event := range stream {
 		switch event.Type {
 		case youtubedl.Log:
+			// keep the logs of youtube-dl to classify failures
+			url.Logs = append(url.Logs, event.Log)
 			if err := p.store.AppendLog(ctx, db, url.ID, &model.Log{Log: event.Log}); err != nil {
 				p.log.Log(ctx, err.Error())
 			}
 		case youtubedl.Failure:
 			err = event.Err
 		case youtubedl.Success:
-			path = event.Path
+			path, artifacts = event.Path, event.Artifacts
+			if event.Metadata != nil {
+				p.setMetadata(ctx, db, url, event.Metadata)
+			}
+		case youtubedl.ProgressUpdate:
+			// throttle updates, except on phase changes
+			phase := progress.Phase
+			progress, unsaved = event.Progress, true
+			if progress.Phase == phase && time.Since(saved) < progressInterval {
+				continue
+			}
+			p.setProgress(ctx, db, url, progress)
+			saved, unsaved = time.Now(), false
+		case youtubedl.Streaming:
+			uploaded = make(chan upload, 1)
+			go func(filename string) {
+				checksum, err := p.storage.Upload(ctx, filename, pr)
+				if err != nil {
+					// stop the download writing to pw
+					pr.CloseWithError(err)
+					cancel()
+				}
+				uploaded <- upload{checksum: checksum, err: err}
+			}(filepath.Base(event.Path))
+		}
+	}
+	if unsaved {
+		p.setProgress(ctx, db, url, progress)
+	}
+	var checksum string
+	if uploaded != nil {
+		// complete the upload, or abort it if the download failed
+		if err != nil {
+			pw.CloseWithError(err)
+		} else {
+			pw.Close()
+		}
+		u := <-uploaded
+		if u.err != nil && u.err != err {
+			// the download failed because the upload did
+			err = u.err
+		}
+		checksum = u.checksum
+	}
+	if err == youtubedl.ErrPlaylist {
+		if perr := p.playlist(ctx, db, url, extractor, proxyurl); perr != nil {
+			return "", perr
 		}
 	}
-	defer os.RemoveAll(filepath.Dir(path))
 	if err != nil {
 		return "", err
 	}
+	defer os.RemoveAll(filepath.Dir(path))
+
+	if uploaded != nil {
+		filename := filepath.Base(path)
+		p.appendLog(ctx, db, url, fmt.Sprintf("downloader: uploaded %s while downloading it, sha256 %s", filename, checksum))
+		p.saveArtifacts(ctx, db, url, artifacts)
+		return filename, nil
+	}
+
+	if len(specs) > 0 {
+		path, err = p.postprocess.Process(ctx, specs, path, func(log string) {
+			p.appendLog(ctx, db, url, log)
+		})
+		if err != nil {
+			return "", err
+		}
+	}
 
 	f, err := os.Open(path)
 	if err != nil {
@@ -119,5 +274,123 @@ func (p *Downloader) DownloadURL(ctx context.Context, db nest.Querier, url *mode
 	if err := p.storage.Save(ctx, filename, f); err != nil {
 		return "", err
 	}
+
+	p.saveArtifacts(ctx, db, url, artifacts)
 	return filename, nil
 }
+
+// playlist returns a PlaylistError if url is a playlist, or an url with
+// multiple videos, listing its entries with e.
+func (p *Downloader) playlist(ctx context.Context, db nest.Querier, url *model.URL, e extractor.Extractor, proxyurl string) error {
+	entries, err := e.Entries(ctx, url.URL, proxyurl)
+	if err != nil {
+		return err
+	}
+	if entries == nil {
+		return nil
+	}
+	p.appendLog(ctx, db, url, fmt.Sprintf("downloader: url is a playlist of %d entries", len(entries)))
+	return &PlaylistError{Entries: entries}
+}
+
+// upload is the result of the upload of a streamed file.
+type upload struct {
+	checksum string
+	err      error
+}
+
+// saveArtifacts saves the artifacts of url. Artifacts are optional, errors
+// are logged and don't fail the download.
+func (p *Downloader) saveArtifacts(ctx context.Context, db nest.Querier, url *model.URL, artifacts []youtubedl.Artifact) {
+	for _, artifact := range artifacts {
+		if err := p.saveArtifact(ctx, db, url, artifact); err != nil {
+			p.appendLog(ctx, db, url, fmt.Sprintf("downloader: couldn't save %s %s: %v", artifact.Kind, filepath.Base(artifact.Path), err))
+		}
+	}
+}
+
+// mimeTypes are the mime types of the artifacts extensions missing from the
+// mime package.
+var mimeTypes = map[string]string{
+	".json": "application/json",
+	".vtt":  "text/vtt",
+	".srt":  "application/x-subrip",
+	".ass":  "text/x-ssa",
+	".ttml": "application/ttml+xml",
+	".webp": "image/webp",
+}
+
+// mimeType returns the mime type of the file at path.
+func mimeType(path string) string {
+	ext := strings.ToLower(filepath.Ext(path))
+	if typ, ok := mimeTypes[ext]; ok {
+		return typ
+	}
+	if typ := mime.TypeByExtension(ext); typ != "" {
+		return typ
+	}
+	return "application/octet-stream"
+}
+
+// saveArtifact saves artifact of url to storage, and creates it in store.
+func (p *Downloader) saveArtifact(ctx context.Context, db nest.Querier, url *model.URL, artifact youtubedl.Artifact) error {
+	f, err := os.Open(artifact.Path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	filename := filepath.Base(artifact.Path)
+	if err := p.storage.Save(ctx, filename, f); err != nil {
+		return err
+	}
+	m := &model.Artifact{
+		URLID:    url.ID,
+		Kind:     string(artifact.Kind),
+		File:     filename,
+		MimeType: mimeType(filename),
+		Size:     fi.Size(),
+	}
+	if artifact.Language != "" {
+		m.Language = sql.NullString{Valid: true, String: artifact.Language}
+	}
+	return p.store.CreateArtifact(ctx, db, m)
+}
+
+// appendLog appends log to the logs of url, logging errors.
+func (p *Downloader) appendLog(ctx context.Context, db nest.Querier, url *model.URL, log string) {
+	url.Logs = append(url.Logs, log)
+	if err := p.store.AppendLog(ctx, db, url.ID, &model.Log{Log: log}); err != nil {
+		p.log.Log(ctx, err.Error())
+	}
+}
+
+// setProgress sets the progress of url, logging errors.
+func (p *Downloader) setProgress(ctx context.Context, db nest.Querier, url *model.URL, progress youtubedl.Progress) {
+	b, err := json.Marshal(progress)
+	if err != nil {
+		p.log.Log(ctx, err.Error())
+		return
+	}
+	url.Progress = b
+	if err := p.store.SetProgress(ctx, db, url); err != nil {
+		p.log.Log(ctx, err.Error())
+	}
+}
+
+// setMetadata sets the metadata of url, logging errors.
+func (p *Downloader) setMetadata(ctx context.Context, db nest.Querier, url *model.URL, metadata *youtubedl.Metadata) {
+	b, err := json.Marshal(metadata)
+	if err != nil {
+		p.log.Log(ctx, err.Error())
+		return
+	}
+	url.Metadata = b
+	if err := p.store.SetMetadata(ctx, db, url); err != nil {
+		p.log.Log(ctx, err.Error())
+	}
+}
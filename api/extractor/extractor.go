@@ -0,0 +1,146 @@
+// Package extractor implements the selection of the extractor backend of an
+// url, e.g. youtube-dl or a direct http download.
+package extractor
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/yansal/youtube-ar/api/youtubedl"
+)
+
+// Extractor is an extractor backend. It implements the event stream of
+// package youtubedl.
+type Extractor interface {
+	Entries(ctx context.Context, url string, proxyurl string) ([]youtubedl.Entry, error)
+	Download(ctx context.Context, url string, proxyurl string, opts youtubedl.Options) <-chan youtubedl.Event
+}
+
+// Names of the extractor backends.
+const (
+	YoutubeDL = "youtube-dl"
+	YtDlp     = "yt-dlp"
+	Direct    = "direct"
+)
+
+// Names returns the names of the extractor backends.
+func Names() []string {
+	return []string{Direct, YoutubeDL, YtDlp}
+}
+
+// Validate returns an error if name isn't the name of an extractor backend.
+// The empty name is valid, the backend is then selected by rules.
+func Validate(name string) error {
+	if name == "" {
+		return nil
+	}
+	for _, n := range Names() {
+		if n == name {
+			return nil
+		}
+	}
+	return fmt.Errorf("extractor: unknown extractor %q, expected one of %v", name, Names())
+}
+
+// Rule selects Extractor for the urls matching Pattern. Pattern is either a
+// host, matching the host and its subdomains, or *.ext, matching the urls
+// whose path has the extension ext.
+type Rule struct {
+	Pattern   string
+	Extractor string
+}
+
+// DefaultRules download plain media links directly.
+var DefaultRules = []Rule{
+	{Pattern: "*.mp4", Extractor: Direct},
+	{Pattern: "*.m4v", Extractor: Direct},
+	{Pattern: "*.mov", Extractor: Direct},
+	{Pattern: "*.webm", Extractor: Direct},
+	{Pattern: "*.mkv", Extractor: Direct},
+	{Pattern: "*.mp3", Extractor: Direct},
+	{Pattern: "*.m4a", Extractor: Direct},
+	{Pattern: "*.ogg", Extractor: Direct},
+	{Pattern: "*.opus", Extractor: Direct},
+	{Pattern: "*.flac", Extractor: Direct},
+	{Pattern: "*.wav", Extractor: Direct},
+}
+
+// ParseRules parses comma-separated rules, e.g.
+// youtube.com=yt-dlp,*.mp4=direct.
+func ParseRules(s string) ([]Rule, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var rules []Rule
+	for _, pair := range strings.Split(s, ",") {
+		i := strings.Index(pair, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid rule %q, expected pattern=extractor", pair)
+		}
+		rule := Rule{Pattern: strings.ToLower(pair[:i]), Extractor: pair[i+1:]}
+		if rule.Extractor == "" {
+			return nil, fmt.Errorf("invalid rule %q, expected pattern=extractor", pair)
+		}
+		if err := Validate(rule.Extractor); err != nil {
+			return nil, fmt.Errorf("invalid rule %q: %v", pair, err)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// match returns whether r matches u.
+func (r Rule) match(u *url.URL) bool {
+	if strings.HasPrefix(r.Pattern, "*.") {
+		return strings.ToLower(path.Ext(u.Path)) == r.Pattern[1:]
+	}
+	host := strings.ToLower(u.Hostname())
+	return host == r.Pattern || strings.HasSuffix(host, "."+r.Pattern)
+}
+
+// Registry is a registry of extractor backends.
+type Registry struct {
+	extractors map[string]Extractor
+	rules      []Rule
+	fallback   string
+}
+
+// NewRegistry returns a new Registry selecting extractors by rules, in
+// order, and fallback when no rule matches.
+func NewRegistry(fallback string, rules []Rule) *Registry {
+	return &Registry{
+		extractors: make(map[string]Extractor),
+		rules:      rules,
+		fallback:   fallback,
+	}
+}
+
+// Register registers e with name.
+func (r *Registry) Register(name string, e Extractor) {
+	r.extractors[name] = e
+}
+
+// Select returns the name of the extractor of rawurl, and the extractor. It
+// returns the extractor with name if name isn't empty, and selects it by
+// rules otherwise. Rules of unregistered extractors are skipped.
+func (r *Registry) Select(rawurl string, name string) (string, Extractor, error) {
+	if name == "" {
+		name = r.fallback
+		if u, err := url.Parse(rawurl); err == nil {
+			for _, rule := range r.rules {
+				if _, ok := r.extractors[rule.Extractor]; ok && rule.match(u) {
+					name = rule.Extractor
+					break
+				}
+			}
+		}
+	}
+	e, ok := r.extractors[name]
+	if !ok {
+		return "", nil, fmt.Errorf("extractor: extractor %q not registered", name)
+	}
+	return name, e, nil
+}
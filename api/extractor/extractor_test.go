@@ -0,0 +1,66 @@
+package extractor
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/yansal/youtube-ar/api/youtubedl"
+)
+
+func assertf(t *testing.T, ok bool, msg string, args ...interface{}) {
+	t.Helper()
+	if !ok {
+		t.Errorf(msg, args...)
+	}
+}
+
+type extractorMock struct{}
+
+func (extractorMock) Entries(ctx context.Context, url string, proxyurl string) ([]youtubedl.Entry, error) {
+	return nil, nil
+}
+
+func (extractorMock) Download(ctx context.Context, url string, proxyurl string, opts youtubedl.Options) <-chan youtubedl.Event {
+	return nil
+}
+
+func TestParseRules(t *testing.T) {
+	rules, err := ParseRules("YouTube.com=yt-dlp,*.mp4=direct")
+	assertf(t, err == nil, "expected nil, got %v", err)
+	expected := []Rule{{Pattern: "youtube.com", Extractor: YtDlp}, {Pattern: "*.mp4", Extractor: Direct}}
+	assertf(t, reflect.DeepEqual(rules, expected), "expected %v, got %v", expected, rules)
+
+	for _, s := range []string{"youtube.com", "=yt-dlp", "youtube.com=", "youtube.com=gallery-dl"} {
+		_, err := ParseRules(s)
+		assertf(t, err != nil, "expected an error for %q, got nil", s)
+	}
+}
+
+func TestSelect(t *testing.T) {
+	rules := append([]Rule{{Pattern: "youtube.com", Extractor: YtDlp}, {Pattern: "vimeo.com", Extractor: "unregistered"}}, DefaultRules...)
+	r := NewRegistry(YoutubeDL, rules)
+	for _, name := range Names() {
+		r.Register(name, extractorMock{})
+	}
+
+	for _, tc := range []struct {
+		url, name, expected string
+	}{
+		{url: "https://www.youtube.com/watch?v=id", expected: YtDlp},
+		{url: "https://youtube.com/watch?v=id", expected: YtDlp},
+		{url: "https://notyoutube.com/watch?v=id", expected: YoutubeDL},
+		{url: "https://vimeo.com/1", expected: YoutubeDL},
+		{url: "https://example.com/video.MP4?token=t", expected: Direct},
+		{url: "https://example.com/video", expected: YoutubeDL},
+		{url: "https://www.youtube.com/watch?v=id", name: YoutubeDL, expected: YoutubeDL},
+	} {
+		name, e, err := r.Select(tc.url, tc.name)
+		assertf(t, err == nil, "expected nil, got %v", err)
+		assertf(t, e != nil, "expected an extractor for %s", tc.url)
+		assertf(t, name == tc.expected, "expected %s for %s, got %s", tc.expected, tc.url, name)
+	}
+
+	_, _, err := NewRegistry(YoutubeDL, nil).Select("https://example.com", "")
+	assertf(t, err != nil, "expected an error, got nil")
+}
@@ -15,15 +15,27 @@ import (
 
 func main() {
 	cmds := map[string]cmd{
+		"all-in-one":                runAllInOne,
+		"classify-url":              classifyURL,
+		"count-failed":              countFailed,
 		"create-url":                createURL,
 		"create-urls-from-playlist": createURLsFromPlaylist,
 		"download-url":              downloadURL,
+		"get-failed":                getFailed,
 		"get-oembed":                getOembed,
+		"list-failed":               listFailed,
 		"list-logs":                 listLogs,
+		"list-outbox":               listOutbox,
 		"list-urls":                 listURLs,
+		"list-workers":              listWorkers,
+		"purge-failed":              purgeFailed,
+		"reap":                      reap,
+		"replay-outbox":             replayOutbox,
+		"requeue-failed":            requeueFailed,
+		"retrier":                   runRetrier,
 		"retry-next-download-url":   retryNextDownloadURL,
-		"should-retry":              shouldRetry,
 		"server":                    runServer,
+		"should-retry":              shouldRetry,
 		"worker":                    runWorker,
 	}
 
@@ -4,66 +4,242 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
 
 	"github.com/yansal/sql/nest"
+	"github.com/yansal/youtube-ar/api/broker"
+	"github.com/yansal/youtube-ar/api/canonical"
 	"github.com/yansal/youtube-ar/api/event"
 	"github.com/yansal/youtube-ar/api/model"
 	"github.com/yansal/youtube-ar/api/payload"
 	"github.com/yansal/youtube-ar/api/query"
+	"github.com/yansal/youtube-ar/api/store"
 )
 
 // Server is the manager used for server features.
 type Server struct {
-	broker BrokerServer
 	store  StoreServer
+	policy DuplicatePolicy
+	broker ServerBroker
 }
 
-// BrokerServer is the broker interface required by Server.
-type BrokerServer interface {
-	Send(context.Context, string, string) error
+// DuplicatePolicy is the policy of CreateURL when the url has already been
+// created.
+type DuplicatePolicy string
+
+// DuplicatePolicy values.
+const (
+	// DuplicateReturn returns the existing url.
+	DuplicateReturn DuplicatePolicy = "return"
+	// DuplicateRedownload creates and downloads the url again.
+	DuplicateRedownload DuplicatePolicy = "redownload"
+	// DuplicateReject rejects the url.
+	DuplicateReject DuplicatePolicy = "reject"
+)
+
+// ParseDuplicatePolicy parses a duplicate policy from s. The empty string is
+// parsed as DuplicateReturn.
+func ParseDuplicatePolicy(s string) (DuplicatePolicy, error) {
+	switch p := DuplicatePolicy(s); p {
+	case "":
+		return DuplicateReturn, nil
+	case DuplicateReturn, DuplicateRedownload, DuplicateReject:
+		return p, nil
+	}
+	return "", fmt.Errorf("invalid duplicate policy %q, expected return, redownload or reject", s)
+}
+
+// DuplicateError is returned by CreateURL when the url has already been
+// created.
+type DuplicateError struct {
+	// URL is the existing url.
+	URL *model.URL
+	// Conflict is true if the url is rejected, false if the existing url
+	// is returned instead of creating a new one.
+	Conflict bool
+}
+
+func (e *DuplicateError) Error() string {
+	return fmt.Sprintf("url already exists as url %d", e.URL.ID)
 }
 
+// ErrIdempotencyKeyReused is returned by CreateURL when the idempotency key
+// has already been used for another url.
+var ErrIdempotencyKeyReused = errors.New("idempotency key already used for another url")
+
 // StoreServer is the store interface required by Server.
 type StoreServer interface {
 	CreateURL(context.Context, nest.Querier, *model.URL) error
+	CreateOutboxEntry(context.Context, nest.Querier, *model.OutboxEntry) error
 	GetURL(context.Context, nest.Querier, int64) (*model.URL, error)
 	DeleteURL(context.Context, nest.Querier, int64) error
 	ListURLs(context.Context, nest.Querier, *query.URLs) ([]model.URL, error)
 	ListLogs(context.Context, nest.Querier, int64, *query.Logs) ([]model.Log, error)
+	GetURLByIdempotencyKey(context.Context, nest.Querier, string) (*model.URL, error)
+	LockCanonicalKey(context.Context, nest.Querier, string) error
+	FindURLByCanonicalKey(context.Context, nest.Querier, string) (*model.URL, error)
+	ListArtifacts(context.Context, nest.Querier, []int64) ([]model.Artifact, error)
+}
+
+// ServerBroker is the broker interface required by Server, to send jobs
+// within the transaction of their url.
+type ServerBroker interface {
+	Send(context.Context, string, string, broker.Priority) error
+	SendAt(context.Context, string, string, broker.Priority, time.Time) error
 }
 
-// NewServer returns a new Server.
-func NewServer(broker BrokerServer, store StoreServer) *Server {
-	return &Server{broker: broker, store: store}
+// NewServer returns a new Server, creating duplicate urls according to
+// policy. The jobs of created urls are sent within the transaction of the url
+// by b if not nil, e.g. with a postgres broker, or written to the outbox.
+func NewServer(store StoreServer, policy DuplicatePolicy, b ServerBroker) *Server {
+	return &Server{store: store, policy: policy, broker: b}
 }
 
-// CreateURL creates an URL.
+// CreateURL creates an URL. If an url has already been created with the
+// idempotency key of p, or with the same canonical key, CreateURL returns a
+// *DuplicateError according to the duplicate policy of m. Retries and entries
+// of other urls are always created, unless their idempotency key is reused.
 func (m *Server) CreateURL(ctx context.Context, db nest.Querier, p payload.URL) (*model.URL, error) {
-	url := &model.URL{URL: p.URL}
+	key, err := canonical.Key(p.URL)
+	if err != nil {
+		return nil, err
+	}
+	url := &model.URL{URL: p.URL, CanonicalKey: sql.NullString{Valid: true, String: key}}
+	if p.IdempotencyKey != "" {
+		url.IdempotencyKey = sql.NullString{Valid: true, String: p.IdempotencyKey}
+	}
+	priority, err := broker.ParsePriority(p.Priority)
+	if err != nil {
+		return nil, err
+	}
 	if p.Retries != 0 {
 		url.Retries = sql.NullInt64{Valid: true, Int64: p.Retries}
 	}
-	if err := m.store.CreateURL(ctx, db, url); err != nil {
-		return nil, err
+	if p.ParentID != 0 {
+		url.ParentID = sql.NullInt64{Valid: true, Int64: p.ParentID}
+	}
+	if p.Extractor != "" {
+		url.Extractor = sql.NullString{Valid: true, String: p.Extractor}
+	}
+	if !p.Options.IsZero() {
+		if url.Options, err = json.Marshal(p.Options); err != nil {
+			return nil, err
+		}
 	}
+	if len(p.PostProcess) > 0 {
+		if url.PostProcess, err = json.Marshal(p.PostProcess); err != nil {
+			return nil, err
+		}
+	}
+	if err := store.Transaction(ctx, db, func(ctx context.Context, tx nest.Querier) error {
+		if err := m.checkDuplicate(ctx, tx, url); err != nil {
+			return err
+		}
+		if err := m.store.CreateURL(ctx, tx, url); err != nil {
+			return err
+		}
 
-	e := &event.URL{ID: url.ID, URL: url.URL}
-	b, err := json.Marshal(e)
-	if err != nil {
+		e := &event.URL{ID: url.ID, URL: url.URL}
+		b, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+
+		if m.broker != nil {
+			// The jobs are sent within tx, so that they are
+			// received if and only if the url is created.
+			ctx := broker.WithTx(ctx, tx)
+			if err := m.broker.SendAt(ctx, "download-url", string(b), priority, time.Now().Add(p.Delay)); err != nil {
+				return err
+			}
+			return m.broker.Send(ctx, "get-oembed", string(b), priority)
+		}
+
+		// The jobs are written to the outbox within tx, so that they are
+		// sent by the relay if and only if the url is created.
+		if err := m.store.CreateOutboxEntry(ctx, tx, &model.OutboxEntry{
+			Queue:    "download-url",
+			Payload:  string(b),
+			Priority: string(priority),
+			RunAt:    time.Now().Add(p.Delay),
+		}); err != nil {
+			return err
+		}
+		return m.store.CreateOutboxEntry(ctx, tx, &model.OutboxEntry{
+			Queue:    "get-oembed",
+			Payload:  string(b),
+			Priority: string(priority),
+		})
+	}); err == store.ErrIdempotencyKeyExists {
+		// the url has been created by a concurrent request with the
+		// same key
+		if err := m.checkIdempotencyKey(ctx, db, url); err != nil {
+			return nil, err
+		}
+		return nil, err
+	} else if err != nil {
 		return nil, err
 	}
-	if err := m.broker.Send(ctx, "download-url", string(b)); err != nil {
-		// TODO: log err
+	return url, nil
+}
+
+// checkDuplicate returns a *DuplicateError if url has already been created.
+// db should be the transaction creating url.
+func (m *Server) checkDuplicate(ctx context.Context, db nest.Querier, url *model.URL) error {
+	if err := m.checkIdempotencyKey(ctx, db, url); err != nil {
+		return err
 	}
-	if err := m.broker.Send(ctx, "get-oembed", string(b)); err != nil {
-		// TODO: log err
+	if url.Retries.Valid || url.ParentID.Valid || m.policy == DuplicateRedownload {
+		return nil
 	}
-	return url, nil
+
+	// Concurrent requests with the same canonical key wait for each other,
+	// so that the url created by the first one is found by the others.
+	if err := m.store.LockCanonicalKey(ctx, db, url.CanonicalKey.String); err != nil {
+		return err
+	}
+	existing, err := m.store.FindURLByCanonicalKey(ctx, db, url.CanonicalKey.String)
+	if err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return &DuplicateError{URL: existing, Conflict: m.policy == DuplicateReject}
+}
+
+// checkIdempotencyKey returns a *DuplicateError if url has already been
+// created with its idempotency key, or ErrIdempotencyKeyReused if the key was
+// used for another url.
+func (m *Server) checkIdempotencyKey(ctx context.Context, db nest.Querier, url *model.URL) error {
+	if !url.IdempotencyKey.Valid {
+		return nil
+	}
+	existing, err := m.store.GetURLByIdempotencyKey(ctx, db, url.IdempotencyKey.String)
+	if err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if existing.CanonicalKey != url.CanonicalKey {
+		return ErrIdempotencyKeyReused
+	}
+	// the request is replayed, whatever the policy
+	return &DuplicateError{URL: existing}
 }
 
 // GetURL gets an url.
 func (m *Server) GetURL(ctx context.Context, db nest.Querier, id int64) (*model.URL, error) {
-	return m.store.GetURL(ctx, db, id)
+	url, err := m.store.GetURL(ctx, db, id)
+	if err != nil {
+		return nil, err
+	}
+	urls := []model.URL{*url}
+	if err := m.listArtifacts(ctx, db, urls); err != nil {
+		return nil, err
+	}
+	return &urls[0], nil
 }
 
 // DeleteURL deletes an url.
@@ -73,7 +249,36 @@ func (m *Server) DeleteURL(ctx context.Context, db nest.Querier, id int64) error
 
 // ListURLs lists urls.
 func (m *Server) ListURLs(ctx context.Context, db nest.Querier, q *query.URLs) ([]model.URL, error) {
-	return m.store.ListURLs(ctx, db, q)
+	urls, err := m.store.ListURLs(ctx, db, q)
+	if err != nil {
+		return nil, err
+	}
+	if err := m.listArtifacts(ctx, db, urls); err != nil {
+		return nil, err
+	}
+	return urls, nil
+}
+
+// listArtifacts sets the artifacts of urls.
+func (m *Server) listArtifacts(ctx context.Context, db nest.Querier, urls []model.URL) error {
+	if len(urls) == 0 {
+		return nil
+	}
+	ids := make([]int64, len(urls))
+	index := make(map[int64]int, len(urls))
+	for i := range urls {
+		ids[i] = urls[i].ID
+		index[urls[i].ID] = i
+	}
+	artifacts, err := m.store.ListArtifacts(ctx, db, ids)
+	if err != nil {
+		return err
+	}
+	for _, artifact := range artifacts {
+		i := index[artifact.URLID]
+		urls[i].Artifacts = append(urls[i].Artifacts, artifact)
+	}
+	return nil
 }
 
 // ListLogs lists logs.
@@ -3,12 +3,23 @@ package manager
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"sync"
 	"time"
 
 	"github.com/yansal/sql/nest"
+	"github.com/yansal/youtube-ar/api/broker"
+	"github.com/yansal/youtube-ar/api/canonical"
+	"github.com/yansal/youtube-ar/api/classifier"
+	"github.com/yansal/youtube-ar/api/downloader"
 	"github.com/yansal/youtube-ar/api/event"
+	"github.com/yansal/youtube-ar/api/log"
 	"github.com/yansal/youtube-ar/api/model"
+	"github.com/yansal/youtube-ar/api/payload"
+	"github.com/yansal/youtube-ar/api/store"
+	"github.com/yansal/youtube-ar/api/youtubedl"
 )
 
 // Worker is the manager used for worker features.
@@ -16,6 +27,19 @@ type Worker struct {
 	downloader Downloader
 	oembed     OEmbed
 	store      StoreWorker
+	classifier Classifier
+	limiter    Limiter
+	creator    Creator
+	log        log.Logger
+
+	mu      sync.Mutex
+	running map[int64]*running
+}
+
+// running is a running download.
+type running struct {
+	cancel   context.CancelFunc
+	canceled bool
 }
 
 // Downloader is the downloader interface required by Worker.
@@ -28,36 +52,79 @@ type OEmbed interface {
 	Get(context.Context, string) ([]byte, error)
 }
 
+// Classifier is the classifier interface required by Worker.
+type Classifier interface {
+	Classify(err string, logs []string) string
+}
+
+// Limiter is the rate limiter interface required by Worker.
+type Limiter interface {
+	Wait(ctx context.Context, queue string, url string) error
+	Tighten(ctx context.Context, queue string, url string) error
+}
+
+// Creator is the url creator interface required by Worker.
+type Creator interface {
+	CreateURL(context.Context, nest.Querier, payload.URL) (*model.URL, error)
+}
+
 // StoreWorker is the store interface required by Worker.
 type StoreWorker interface {
 	LockURL(context.Context, nest.Querier, *model.URL) error
 	UnlockURL(context.Context, nest.Querier, *model.URL) error
 	SetOEmbed(context.Context, nest.Querier, *model.URL) error
+	UpdateParentStatus(context.Context, nest.Querier, int64) error
 }
 
-// NewWorker returns a new Worker.
-func NewWorker(downloader Downloader, oembed OEmbed, store StoreWorker) *Worker {
-	return &Worker{downloader: downloader, oembed: oembed, store: store}
+// NewWorker returns a new Worker. The entries of playlists are created with
+// creator.
+func NewWorker(downloader Downloader, oembed OEmbed, store StoreWorker, classifier Classifier, limiter Limiter, creator Creator, log log.Logger) *Worker {
+	return &Worker{downloader: downloader, oembed: oembed, store: store, classifier: classifier, limiter: limiter, creator: creator, log: log}
 }
 
-// DownloadURL downloads e.
+// DownloadURL downloads e, once allowed by the rate limiter. It returns nil
+// without downloading if e has been canceled. If ctx is canceled, e.g. on
+// shutdown, the url is reset to pending, so that it can be downloaded again.
+// Downloads failing because of rate limiting tighten the rate limit.
+// Playlists are expanded into child urls, one per entry, and the status of
+// the parent url aggregates the statuses of its children.
 func (m *Worker) DownloadURL(ctx context.Context, db nest.Querier, e event.URL) error {
 	url := &model.URL{ID: e.ID, URL: e.URL, Status: "processing"}
-	if err := m.store.LockURL(ctx, db, url); err != nil {
+	if err := m.store.LockURL(ctx, db, url); err == store.ErrNotLocked {
+		return nil
+	} else if err != nil {
 		return err
 	}
 
+	parent := ctx
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	r := m.start(url.ID, cancel)
+	defer m.stop(url.ID)
+
 	var (
-		perr error
-		file string
+		perr        error
+		file        string
+		canceled    bool
+		interrupted bool
+		expanded    bool
 	)
 	defer func() {
 		r := recover()
 		if r != nil {
 			perr = fmt.Errorf("%s", r)
 		}
-		if perr != nil {
+		if canceled {
+			url.Status = "canceled"
+		} else if interrupted {
+			url.Status = "pending"
+		} else if expanded {
+			// the status of url is updated with the statuses of its
+			// children
+			url.Status = "processing"
+		} else if perr != nil {
 			url.Error = sql.NullString{Valid: true, String: perr.Error()}
+			url.ErrorCategory = sql.NullString{Valid: true, String: m.classifier.Classify(perr.Error(), url.Logs)}
 			url.Status = "failure"
 		} else {
 			url.File = sql.NullString{Valid: true, String: file}
@@ -69,8 +136,18 @@ func (m *Worker) DownloadURL(ctx context.Context, db nest.Querier, e event.URL)
 			ctx, cancel = context.WithTimeout(context.Background(), time.Second)
 			defer cancel()
 		}
+		if url.ErrorCategory.String == classifier.RateLimited {
+			if err := m.limiter.Tighten(ctx, "download-url", url.URL); err != nil {
+				m.log.Log(ctx, err.Error())
+			}
+		}
 		if err := m.store.UnlockURL(ctx, db, url); err != nil {
-			// TODO: log err
+			m.log.Log(ctx, err.Error())
+		}
+		if url.ParentID.Valid {
+			if err := m.store.UpdateParentStatus(ctx, db, url.ParentID.Int64); err != nil {
+				m.log.Log(ctx, err.Error())
+			}
 		}
 
 		if r != nil {
@@ -78,10 +155,102 @@ func (m *Worker) DownloadURL(ctx context.Context, db nest.Querier, e event.URL)
 		}
 	}()
 
-	file, perr = m.downloader.DownloadURL(ctx, db, url)
+	// wait once locked, so that urls that won't be downloaded don't take
+	// a token
+	perr = m.limiter.Wait(ctx, "download-url", url.URL)
+	if perr == nil {
+		file, perr = m.downloader.DownloadURL(ctx, db, url)
+	}
+	if playlist, ok := perr.(*downloader.PlaylistError); ok {
+		perr = m.expand(ctx, db, url, playlist.Entries)
+		expanded = perr == nil
+	}
+	if perr != nil && m.canceled(r) {
+		// the url has been canceled, it must not be retried
+		canceled = true
+		return nil
+	}
+	if perr != nil && parent.Err() == context.Canceled {
+		interrupted = true
+	}
 	return perr
 }
 
+// expand creates the children of url, one per entry. The children have the
+// options, post-processing steps and extractor of url, and idempotency keys so that they
+// are created once if url is downloaded again, even if the order of the
+// entries changed.
+func (m *Worker) expand(ctx context.Context, db nest.Querier, url *model.URL, entries []youtubedl.Entry) error {
+	if len(entries) == 0 {
+		return errors.New("url is a playlist without entries")
+	}
+	child := payload.URL{Priority: string(broker.PriorityLow), ParentID: url.ID, Extractor: url.Extractor.String}
+	if url.Options != nil {
+		if err := json.Unmarshal(url.Options, &child.Options); err != nil {
+			return err
+		}
+	}
+	if url.PostProcess != nil {
+		if err := json.Unmarshal(url.PostProcess, &child.PostProcess); err != nil {
+			return err
+		}
+	}
+	for _, entry := range entries {
+		key, err := canonical.Key(entry.URL)
+		if err != nil {
+			return err
+		}
+		child.URL = entry.URL
+		child.IdempotencyKey = fmt.Sprintf("url-%d-entry-%s", url.ID, key)
+		if _, err := m.creator.CreateURL(ctx, db, child); err != nil {
+			if derr, ok := err.(*DuplicateError); ok && !derr.Conflict {
+				continue
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// start registers the running download of the url with id.
+func (m *Worker) start(id int64, cancel context.CancelFunc) *running {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.running == nil {
+		m.running = make(map[int64]*running)
+	}
+	r := &running{cancel: cancel}
+	m.running[id] = r
+	return r
+}
+
+// stop unregisters the running download of the url with id.
+func (m *Worker) stop(id int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.running, id)
+}
+
+func (m *Worker) canceled(r *running) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return r.canceled
+}
+
+// CancelURL cancels the running download of the url with id. It returns
+// false if the url isn't being downloaded by m.
+func (m *Worker) CancelURL(id int64) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	r, ok := m.running[id]
+	if !ok {
+		return false
+	}
+	r.canceled = true
+	r.cancel()
+	return true
+}
+
 // GetOEmbed gets oembed.
 func (m *Worker) GetOEmbed(ctx context.Context, db nest.Querier, e event.URL) error {
 	data, err := m.oembed.Get(ctx, e.URL)
@@ -7,8 +7,14 @@ import (
 	"testing"
 
 	"github.com/yansal/sql/nest"
+	"github.com/yansal/youtube-ar/api/classifier"
+	"github.com/yansal/youtube-ar/api/downloader"
 	"github.com/yansal/youtube-ar/api/event"
+	"github.com/yansal/youtube-ar/api/log"
 	"github.com/yansal/youtube-ar/api/model"
+	"github.com/yansal/youtube-ar/api/payload"
+	"github.com/yansal/youtube-ar/api/store"
+	"github.com/yansal/youtube-ar/api/youtubedl"
 )
 
 func assertf(t *testing.T, ok bool, msg string, args ...interface{}) {
@@ -18,6 +24,10 @@ func assertf(t *testing.T, ok bool, msg string, args ...interface{}) {
 	}
 }
 
+type logMock struct{}
+
+func (logMock) Log(ctx context.Context, msg string, fields ...log.Field) {}
+
 type dowloaderMock struct {
 	downloadURLFunc func(context.Context, *model.URL) (string, error)
 }
@@ -26,11 +36,43 @@ func (p dowloaderMock) DownloadURL(ctx context.Context, db nest.Querier, url *mo
 	return p.downloadURLFunc(ctx, url)
 }
 
+type classifierMock struct {
+	category string
+}
+
+func (c classifierMock) Classify(err string, logs []string) string {
+	return c.category
+}
+
+type limiterMock struct {
+	waitFunc    func(queue string, url string) error
+	tightenFunc func(queue string, url string)
+}
+
+func (l limiterMock) Wait(ctx context.Context, queue string, url string) error {
+	if l.waitFunc != nil {
+		return l.waitFunc(queue, url)
+	}
+	return nil
+}
+
+func (l limiterMock) Tighten(ctx context.Context, queue string, url string) error {
+	if l.tightenFunc != nil {
+		l.tightenFunc(queue, url)
+	}
+	return nil
+}
+
 type storeMock struct {
-	unlockURLFunc func(context.Context, *model.URL) error
+	lockURLFunc            func(context.Context, *model.URL) error
+	unlockURLFunc          func(context.Context, *model.URL) error
+	updateParentStatusFunc func(context.Context, int64) error
 }
 
 func (s storeMock) LockURL(ctx context.Context, db nest.Querier, url *model.URL) error {
+	if s.lockURLFunc != nil {
+		return s.lockURLFunc(ctx, url)
+	}
 	return nil
 }
 
@@ -42,14 +84,32 @@ func (s storeMock) SetOEmbed(ctx context.Context, db nest.Querier, url *model.UR
 	return nil
 }
 
+func (s storeMock) UpdateParentStatus(ctx context.Context, db nest.Querier, id int64) error {
+	return s.updateParentStatusFunc(ctx, id)
+}
+
+type creatorMock struct {
+	createURLFunc func(context.Context, payload.URL) (*model.URL, error)
+}
+
+func (c creatorMock) CreateURL(ctx context.Context, db nest.Querier, p payload.URL) (*model.URL, error) {
+	return c.createURLFunc(ctx, p)
+}
+
 func TestDownloadURLFailure(t *testing.T) {
-	serr := "err"
+	var (
+		serr     = "err"
+		category = "unknown"
+	)
 	m := Worker{
+		log:     logMock{},
+		limiter: limiterMock{},
 		downloader: dowloaderMock{
 			downloadURLFunc: func(ctx context.Context, url *model.URL) (string, error) {
 				return "", errors.New(serr)
 			},
 		},
+		classifier: classifierMock{category: category},
 		store: storeMock{
 			unlockURLFunc: func(ctx context.Context, url *model.URL) error {
 				assertf(t, url.Status == "failure",
@@ -58,6 +118,9 @@ func TestDownloadURLFailure(t *testing.T) {
 				assertf(t, url.Error == sql.NullString{Valid: true, String: serr},
 					`expected error to be valid and equal to %q, got %+v`, serr, url.Error,
 				)
+				assertf(t, url.ErrorCategory == sql.NullString{Valid: true, String: category},
+					`expected error category to be valid and equal to %q, got %+v`, category, url.ErrorCategory,
+				)
 				assertf(t, !url.File.Valid,
 					`expected file to not be valid, got %+v`, url.File,
 				)
@@ -75,6 +138,8 @@ func TestDownloadURLFailure(t *testing.T) {
 func TestDownloadURLSuccess(t *testing.T) {
 	file := "file.go"
 	m := Worker{
+		log:     logMock{},
+		limiter: limiterMock{},
 		downloader: dowloaderMock{
 			downloadURLFunc: func(ctx context.Context, url *model.URL) (string, error) {
 				return file, nil
@@ -106,11 +171,14 @@ func TestDownloadURLPanic(t *testing.T) {
 		serr     = "panic"
 	)
 	m := Worker{
+		log:     logMock{},
+		limiter: limiterMock{},
 		downloader: dowloaderMock{
 			downloadURLFunc: func(ctx context.Context, url *model.URL) (string, error) {
 				panic(serr)
 			},
 		},
+		classifier: classifierMock{},
 		store: storeMock{
 			unlockURLFunc: func(ctx context.Context, url *model.URL) error {
 				unlocked = true
@@ -139,3 +207,160 @@ func TestDownloadURLPanic(t *testing.T) {
 	_ = m.DownloadURL(context.Background(), nil, event.URL{})
 	t.Error("expected panic")
 }
+
+func TestDownloadURLInterrupted(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var unlocked bool
+	m := Worker{
+		log:     logMock{},
+		limiter: limiterMock{},
+		downloader: dowloaderMock{
+			downloadURLFunc: func(ctx context.Context, url *model.URL) (string, error) {
+				cancel()
+				<-ctx.Done()
+				return "", ctx.Err()
+			},
+		},
+		classifier: classifierMock{},
+		store: storeMock{
+			unlockURLFunc: func(ctx context.Context, url *model.URL) error {
+				unlocked = true
+				assertf(t, url.Status == "pending",
+					`expected status to be "pending", got %q`, url.Status,
+				)
+				assertf(t, !url.Error.Valid,
+					`expected error to not be valid, got %+v`, url.Error,
+				)
+				return nil
+			},
+		},
+	}
+
+	err := m.DownloadURL(ctx, nil, event.URL{})
+	assertf(t, err == context.Canceled,
+		`expected err to be %v, got %+v`, context.Canceled, err,
+	)
+	assertf(t, unlocked, `expected the unlock method to be called`)
+}
+
+func TestDownloadURLNotLocked(t *testing.T) {
+	m := Worker{
+		log: logMock{},
+		limiter: limiterMock{
+			waitFunc: func(queue string, url string) error {
+				t.Error("expected wait to not be called")
+				return nil
+			},
+		},
+		store: storeMock{
+			lockURLFunc: func(ctx context.Context, url *model.URL) error {
+				return store.ErrNotLocked
+			},
+		},
+	}
+
+	err := m.DownloadURL(context.Background(), nil, event.URL{ID: 1})
+	assertf(t, err == nil, `expected err to be nil, got %+v`, err)
+}
+
+func TestDownloadURLRateLimited(t *testing.T) {
+	var tightened bool
+	m := Worker{
+		log: logMock{},
+		downloader: dowloaderMock{
+			downloadURLFunc: func(ctx context.Context, url *model.URL) (string, error) {
+				return "", errors.New("HTTP Error 429: Too Many Requests")
+			},
+		},
+		classifier: classifierMock{category: classifier.RateLimited},
+		limiter: limiterMock{
+			tightenFunc: func(queue string, url string) {
+				tightened = true
+				assertf(t, queue == "download-url", `expected queue to be "download-url", got %q`, queue)
+				assertf(t, url == "https://example.com", `expected url to be "https://example.com", got %q`, url)
+			},
+		},
+		store: storeMock{
+			unlockURLFunc: func(ctx context.Context, url *model.URL) error { return nil },
+		},
+	}
+	err := m.DownloadURL(context.Background(), nil, event.URL{ID: 1, URL: "https://example.com"})
+	assertf(t, err != nil, `expected an error`)
+	assertf(t, tightened, `expected the rate limit to be tightened`)
+}
+
+func TestDownloadURLPlaylist(t *testing.T) {
+	var created []payload.URL
+	m := Worker{
+		log:     logMock{},
+		limiter: limiterMock{},
+		downloader: dowloaderMock{
+			downloadURLFunc: func(ctx context.Context, url *model.URL) (string, error) {
+				url.Options = []byte(`{"audio_only":true}`)
+				return "", &downloader.PlaylistError{Entries: []youtubedl.Entry{{URL: "https://a"}, {URL: "https://b"}}}
+			},
+		},
+		creator: creatorMock{
+			createURLFunc: func(ctx context.Context, p payload.URL) (*model.URL, error) {
+				created = append(created, p)
+				if p.URL == "https://b" {
+					// already created by a previous download
+					return nil, &DuplicateError{URL: &model.URL{}}
+				}
+				return &model.URL{}, nil
+			},
+		},
+		store: storeMock{
+			unlockURLFunc: func(ctx context.Context, url *model.URL) error {
+				assertf(t, url.Status == "processing",
+					`expected status to be "processing", got %q`, url.Status,
+				)
+				assertf(t, !url.Error.Valid,
+					`expected error to not be valid, got %+v`, url.Error,
+				)
+				return nil
+			},
+		},
+	}
+
+	err := m.DownloadURL(context.Background(), nil, event.URL{ID: 1})
+	assertf(t, err == nil, `expected err to be nil, got %+v`, err)
+	if len(created) != 2 {
+		t.Fatalf("expected 2 children, got %d", len(created))
+	}
+	for i, p := range created {
+		assertf(t, p.ParentID == 1, `expected child %d parent id to be 1, got %d`, i, p.ParentID)
+		assertf(t, p.Options.AudioOnly, `expected child %d to inherit the options, got %+v`, i, p.Options)
+	}
+	assertf(t, created[0].IdempotencyKey != created[1].IdempotencyKey, `expected children to have different idempotency keys`)
+}
+
+func TestDownloadURLChild(t *testing.T) {
+	var updated int64
+	m := Worker{
+		log:     logMock{},
+		limiter: limiterMock{},
+		downloader: dowloaderMock{
+			downloadURLFunc: func(ctx context.Context, url *model.URL) (string, error) {
+				return "file", nil
+			},
+		},
+		store: storeMock{
+			lockURLFunc: func(ctx context.Context, url *model.URL) error {
+				url.ParentID = sql.NullInt64{Valid: true, Int64: 7}
+				return nil
+			},
+			unlockURLFunc: func(ctx context.Context, url *model.URL) error {
+				return nil
+			},
+			updateParentStatusFunc: func(ctx context.Context, id int64) error {
+				updated = id
+				return nil
+			},
+		},
+	}
+
+	err := m.DownloadURL(context.Background(), nil, event.URL{ID: 8})
+	assertf(t, err == nil, `expected err to be nil, got %+v`, err)
+	assertf(t, updated == 7, `expected the status of parent 7 to be updated, got %d`, updated)
+}
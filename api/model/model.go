@@ -2,8 +2,6 @@ package model
 
 import (
 	"database/sql"
-	"regexp"
-	"strings"
 	"time"
 
 	"github.com/lib/pq"
@@ -11,16 +9,28 @@ import (
 
 // URL is the url model.
 type URL struct {
-	ID        int64          `scan:"id"`
-	URL       string         `scan:"url"`
-	CreatedAt time.Time      `scan:"created_at"`
-	UpdatedAt time.Time      `scan:"updated_at"`
-	Status    string         `scan:"status"`
-	Error     sql.NullString `scan:"error"`
-	File      sql.NullString `scan:"file"`
-	Retries   sql.NullInt64  `scan:"retries"`
-	Logs      pq.StringArray `scan:"logs"`
-	OEmbed    []byte         `scan:"oembed"` // json-encoded
+	ID            int64          `scan:"id"`
+	URL           string         `scan:"url"`
+	CreatedAt     time.Time      `scan:"created_at"`
+	UpdatedAt     time.Time      `scan:"updated_at"`
+	Status        string         `scan:"status"`
+	Error         sql.NullString `scan:"error"`
+	ErrorCategory sql.NullString `scan:"error_category"`
+	File          sql.NullString `scan:"file"`
+	Retries       sql.NullInt64  `scan:"retries"`
+	Logs          pq.StringArray `scan:"logs"`
+	OEmbed        []byte         `scan:"oembed"`      // json-encoded
+	Options       []byte         `scan:"options"`     // json-encoded
+	PostProcess   []byte         `scan:"postprocess"` // json-encoded
+	Progress      []byte         `scan:"progress"`    // json-encoded
+	Metadata      []byte         `scan:"metadata"`    // json-encoded
+
+	CanonicalKey   sql.NullString `scan:"canonical_key"`
+	IdempotencyKey sql.NullString `scan:"idempotency_key"`
+	ParentID       sql.NullInt64  `scan:"parent_id"`
+	Extractor      sql.NullString `scan:"extractor"`
+
+	Artifacts []Artifact // not a column
 }
 
 // Columns returns URL column names.
@@ -32,36 +42,46 @@ func (URL) Columns() []string {
 		"updated_at",
 		"status",
 		"error",
+		"error_category",
 		"file",
 		"retries",
 		"logs",
 		"oembed",
+		"options",
+		"postprocess",
+		"progress",
+		"metadata",
+		"canonical_key",
+		"idempotency_key",
+		"parent_id",
+		"extractor",
 	}
 }
 
-// ShouldRetry reports whether u failed because of a rate limiter or a geo limitation.
-func (u URL) ShouldRetry() bool {
-	if u.Error.String == "signal: killed" {
-		return true
-	}
-
-	if u.Error.String != "exit status 1" {
-		return false
-	}
-
-	log := strings.Join(u.Logs, "\n")
-	for _, re := range shouldRetryRegexps {
-		if re.MatchString(log) {
-			return true
-		}
-	}
-	return false
+// Artifact is the artifact model, a file stored alongside the file of an url.
+type Artifact struct {
+	ID        int64          `scan:"id"`
+	URLID     int64          `scan:"url_id"`
+	Kind      string         `scan:"kind"`
+	Language  sql.NullString `scan:"language"`
+	File      string         `scan:"file"`
+	MimeType  string         `scan:"mime_type"`
+	Size      int64          `scan:"size"`
+	CreatedAt time.Time      `scan:"created_at"`
 }
 
-var shouldRetryRegexps = []*regexp.Regexp{
-	regexp.MustCompile(`ERROR: Unable to download webpage: HTTP Error 429: Too Many Requests`),
-	regexp.MustCompile(`ERROR: The uploader has not made this video available in your country\.`),
-	regexp.MustCompile(`ERROR: .*: YouTube said: This video contains content from .*, who has blocked it on copyright grounds\.`),
+// Columns returns Artifact column names.
+func (Artifact) Columns() []string {
+	return []string{
+		"id",
+		"url_id",
+		"kind",
+		"language",
+		"file",
+		"mime_type",
+		"size",
+		"created_at",
+	}
 }
 
 // Log is the log model.
@@ -85,6 +105,38 @@ func (YoutubeVideo) Columns() []string {
 	}
 }
 
+// OutboxEntry is the outbox entry model.
+type OutboxEntry struct {
+	ID            int64          `scan:"id"`
+	Queue         string         `scan:"queue"`
+	Payload       string         `scan:"payload"`
+	Priority      string         `scan:"priority"`
+	RunAt         time.Time      `scan:"run_at"`
+	CreatedAt     time.Time      `scan:"created_at"`
+	SentAt        pq.NullTime    `scan:"sent_at"`
+	Attempts      int64          `scan:"attempts"`
+	LastError     sql.NullString `scan:"last_error"`
+	NextAttemptAt time.Time      `scan:"next_attempt_at"`
+	DeadAt        pq.NullTime    `scan:"dead_at"`
+}
+
+// Columns returns OutboxEntry column names.
+func (OutboxEntry) Columns() []string {
+	return []string{
+		"id",
+		"queue",
+		"payload",
+		"priority",
+		"run_at",
+		"created_at",
+		"sent_at",
+		"attempts",
+		"last_error",
+		"next_attempt_at",
+		"dead_at",
+	}
+}
+
 // Page is the page model.
 type Page struct {
 	Limit  int64
@@ -3,22 +3,37 @@ package main
 import (
 	"context"
 	"database/sql"
+	"fmt"
 	"os"
+	"strconv"
+	"time"
 
 	"github.com/go-redis/redis"
 	"github.com/lib/pq"
 	"github.com/yansal/sql/nest"
+	"github.com/yansal/youtube-ar/api/broker"
 	brokerredis "github.com/yansal/youtube-ar/api/broker/redis"
+	"github.com/yansal/youtube-ar/api/classifier"
+	"github.com/yansal/youtube-ar/api/direct"
+	"github.com/yansal/youtube-ar/api/extractor"
 	"github.com/yansal/youtube-ar/api/log"
 	logsql "github.com/yansal/youtube-ar/api/log/sql"
+	"github.com/yansal/youtube-ar/api/manager"
+	"github.com/yansal/youtube-ar/api/ratelimit"
+	"github.com/yansal/youtube-ar/api/youtubedl"
 )
 
-func newDB(log log.Logger) (nest.Querier, error) {
+// databaseURL returns the postgres dsn.
+func databaseURL() string {
 	dsn := os.Getenv("DATABASE_URL")
 	if dsn == "" {
 		dsn = `sslmode=disable`
 	}
-	pqconnector, err := pq.NewConnector(dsn)
+	return dsn
+}
+
+func newDB(log log.Logger) (nest.Querier, error) {
+	pqconnector, err := pq.NewConnector(databaseURL())
 	if err != nil {
 		return nil, err
 	}
@@ -46,3 +61,124 @@ func newRedis(log log.Logger) (*redis.Client, error) {
 	}
 	return client, nil
 }
+
+// newBroker returns the broker selected by the BROKER env var, either redis
+// (the default) or postgres.
+func newBroker(log log.Logger, db nest.Querier) (broker.Broker, error) {
+	switch b := os.Getenv("BROKER"); b {
+	case "", "redis":
+		redis, err := newRedis(log)
+		if err != nil {
+			return nil, err
+		}
+		return broker.NewRedis(redis, log), nil
+	case "postgres":
+		return broker.NewPostgres(db, databaseURL(), log), nil
+	default:
+		return nil, fmt.Errorf("unknown broker %q", b)
+	}
+}
+
+// txBroker returns b if it sends jobs within the transaction of their url,
+// i.e. if it is backed by postgres, or nil so that the jobs are written to the
+// outbox and relayed to b.
+func txBroker(b broker.Broker) manager.ServerBroker {
+	if b, ok := b.(*broker.PostgresBroker); ok {
+		return b
+	}
+	return nil
+}
+
+// newClassifier returns a classifier with the rules of the file at the
+// CLASSIFIER_RULES env var, or with the default rules.
+func newClassifier() (*classifier.Classifier, error) {
+	return classifier.Load(os.Getenv("CLASSIFIER_RULES"))
+}
+
+// newExtractors returns a registry of the youtube-dl, yt-dlp and direct
+// extractors, limited by the YOUTUBEDL_MAX_FILESIZE (in bytes) and
+// YOUTUBEDL_IDLE_TIMEOUT env vars. Extractors are selected by the rules of the
+// EXTRACTOR_RULES env var, e.g. youtube.com=yt-dlp, then by the default rules,
+// and fall back to the EXTRACTOR env var, youtube-dl by default.
+func newExtractors() (*extractor.Registry, error) {
+	var maxFileSize int64
+	if s := os.Getenv("YOUTUBEDL_MAX_FILESIZE"); s != "" {
+		var err error
+		maxFileSize, err = strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid YOUTUBEDL_MAX_FILESIZE: %v", err)
+		}
+	}
+	idleTimeout := 10 * time.Minute
+	if s := os.Getenv("YOUTUBEDL_IDLE_TIMEOUT"); s != "" {
+		var err error
+		idleTimeout, err = time.ParseDuration(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid YOUTUBEDL_IDLE_TIMEOUT: %v", err)
+		}
+	}
+	rules, err := extractor.ParseRules(os.Getenv("EXTRACTOR_RULES"))
+	if err != nil {
+		return nil, err
+	}
+	fallback := os.Getenv("EXTRACTOR")
+	if fallback == "" {
+		fallback = extractor.YoutubeDL
+	} else if err := extractor.Validate(fallback); err != nil {
+		return nil, err
+	}
+	registry := extractor.NewRegistry(fallback, append(rules, extractor.DefaultRules...))
+	registry.Register(extractor.YoutubeDL, youtubedl.New("youtube-dl", maxFileSize, idleTimeout))
+	registry.Register(extractor.YtDlp, youtubedl.New("yt-dlp", maxFileSize, idleTimeout))
+	registry.Register(extractor.Direct, direct.New(maxFileSize, idleTimeout))
+	return registry, nil
+}
+
+// defaultTimeouts returns the default job deadlines of the worker, from the
+// WORKER_TIMEOUT env var.
+func defaultTimeouts() string {
+	if s := os.Getenv("WORKER_TIMEOUT"); s != "" {
+		return s
+	}
+	return "download-url=2h,get-oembed=1m"
+}
+
+// defaultGracePeriod returns the default grace period of running jobs on
+// shutdown, from the WORKER_GRACE_PERIOD env var. Heroku kills processes 30
+// seconds after asking them to stop.
+func defaultGracePeriod() time.Duration {
+	if d, err := time.ParseDuration(os.Getenv("WORKER_GRACE_PERIOD")); err == nil {
+		return d
+	}
+	return 25 * time.Second
+}
+
+// newLimiter returns a rate limiter of the rates of the RATE_LIMIT env var,
+// e.g. download-url=10/1m. The rates are by host if RATE_LIMIT_PER_HOST is
+// set, and tightened for RATE_LIMIT_COOLDOWN after rate limited downloads.
+// The buckets are shared in redis when b is a redis broker, and in memory
+// otherwise.
+func newLimiter(log log.Logger, b broker.Broker) (*ratelimit.Limiter, error) {
+	rates, err := ratelimit.ParseRates(os.Getenv("RATE_LIMIT"))
+	if err != nil {
+		return nil, err
+	}
+	cooldown := ratelimit.DefaultCooldown
+	if s := os.Getenv("RATE_LIMIT_COOLDOWN"); s != "" {
+		cooldown.Window, err = time.ParseDuration(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid RATE_LIMIT_COOLDOWN: %v", err)
+		}
+	}
+	perHost := os.Getenv("RATE_LIMIT_PER_HOST") != ""
+
+	var store ratelimit.Store = ratelimit.NewMemory()
+	if _, ok := b.(*broker.RedisBroker); ok {
+		redis, err := newRedis(log)
+		if err != nil {
+			return nil, err
+		}
+		store = ratelimit.NewRedis(redis)
+	}
+	return ratelimit.New(store, rates, perHost, cooldown), nil
+}
@@ -1,16 +1,58 @@
 package payload
 
-import "net/url"
+import (
+	"errors"
+	"time"
+
+	"github.com/yansal/youtube-ar/api/broker"
+	"github.com/yansal/youtube-ar/api/canonical"
+	"github.com/yansal/youtube-ar/api/extractor"
+	"github.com/yansal/youtube-ar/api/postprocess"
+	"github.com/yansal/youtube-ar/api/youtubedl"
+)
 
 // URL is the url payload.
 type URL struct {
 	URL string `json:"url"`
+	// Priority is the priority of the jobs of the url, normal by default.
+	Priority string `json:"priority"`
+	// Options are the format options of the download, e.g. audio only or
+	// max resolution.
+	Options youtubedl.Options `json:"options"`
+	// PostProcess are the post-processing steps of the downloaded file,
+	// e.g. transcoding.
+	PostProcess []postprocess.Spec `json:"postprocess"`
+	// Extractor is the name of the extractor backend of the url, selected
+	// by host rules if empty.
+	Extractor string `json:"extractor"`
+
+	// IdempotencyKey identifies the request creating the url, so that it
+	// can be retried safely.
+	IdempotencyKey string `json:"-"`
+
+	// ParentID is the id of the url the url is an entry of, e.g. a playlist.
+	ParentID int64 `json:"-"`
 
-	Retries int64 `json:"-"`
+	Retries int64         `json:"-"`
+	Delay   time.Duration `json:"-"`
 }
 
 // Validate returns an error if u is invalid.
 func (u *URL) Validate() error {
-	_, err := url.Parse(u.URL)
-	return err
+	if _, err := canonical.Key(u.URL); err != nil {
+		return err
+	}
+	if _, err := broker.ParsePriority(u.Priority); err != nil {
+		return err
+	}
+	if err := u.Options.Validate(); err != nil {
+		return err
+	}
+	if err := postprocess.Validate(u.PostProcess); err != nil {
+		return err
+	}
+	if u.Options.Stream && len(u.PostProcess) > 0 {
+		return errors.New("streamed downloads can't be post-processed")
+	}
+	return extractor.Validate(u.Extractor)
 }
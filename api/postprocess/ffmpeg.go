@@ -0,0 +1,179 @@
+package postprocess
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+func init() {
+	Register("transcode", newTranscode)
+	Register("extract-audio", newExtractAudio)
+	Register("normalize", newNormalize)
+}
+
+// encoders are the ffmpeg encoders of codecs.
+var (
+	videoEncoders = map[string]string{
+		"h264": "libx264",
+		"h265": "libx265",
+		"vp9":  "libvpx-vp9",
+		"av1":  "libaom-av1",
+		"copy": "copy",
+	}
+	audioEncoders = map[string]string{
+		"aac":    "aac",
+		"opus":   "libopus",
+		"mp3":    "libmp3lame",
+		"vorbis": "libvorbis",
+		"copy":   "copy",
+	}
+)
+
+// container is a video container, with its default and supported codecs.
+type container struct {
+	video, audio   string
+	videos, audios []string
+}
+
+var containers = map[string]container{
+	"mp4":  {video: "h264", audio: "aac", videos: []string{"h264", "h265", "av1", "copy"}, audios: []string{"aac", "mp3", "opus", "copy"}},
+	"webm": {video: "vp9", audio: "opus", videos: []string{"vp9", "av1", "copy"}, audios: []string{"opus", "vorbis", "copy"}},
+	"mkv":  {video: "h264", audio: "opus", videos: []string{"h264", "h265", "vp9", "av1", "copy"}, audios: []string{"aac", "opus", "mp3", "vorbis", "copy"}},
+}
+
+func contains(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// transcode transcodes files to a container and codecs.
+type transcode struct {
+	container, video, audio string
+}
+
+func newTranscode(spec Spec) (Step, error) {
+	c, ok := containers[spec.Container]
+	if !ok {
+		return nil, fmt.Errorf("invalid container %q, expected mp4, webm or mkv", spec.Container)
+	}
+	t := &transcode{container: spec.Container, video: c.video, audio: c.audio}
+	if spec.VideoCodec != "" {
+		if !contains(c.videos, spec.VideoCodec) {
+			return nil, fmt.Errorf("invalid video codec %q for %s, expected one of %v", spec.VideoCodec, spec.Container, c.videos)
+		}
+		t.video = spec.VideoCodec
+	}
+	if spec.AudioCodec != "" {
+		if !contains(c.audios, spec.AudioCodec) {
+			return nil, fmt.Errorf("invalid audio codec %q for %s, expected one of %v", spec.AudioCodec, spec.Container, c.audios)
+		}
+		t.audio = spec.AudioCodec
+	}
+	return t, nil
+}
+
+func (t *transcode) Run(ctx context.Context, path string, log func(string)) (string, error) {
+	args := []string{"-c:v", videoEncoders[t.video], "-c:a", audioEncoders[t.audio]}
+	if t.container == "mp4" {
+		args = append(args, "-movflags", "+faststart")
+	}
+	return ffmpeg(ctx, path, t.container, args, log)
+}
+
+// extractAudio extracts the audio of files.
+type extractAudio struct {
+	format string
+}
+
+// audioFormats are the ffmpeg arguments of the audio formats.
+var audioFormats = map[string][]string{
+	"mp3":  {"-c:a", "libmp3lame", "-q:a", "2"},
+	"opus": {"-c:a", "libopus", "-b:a", "128k"},
+	"m4a":  {"-c:a", "aac", "-b:a", "192k"},
+}
+
+func newExtractAudio(spec Spec) (Step, error) {
+	if _, ok := audioFormats[spec.Container]; !ok {
+		return nil, fmt.Errorf("invalid audio container %q, expected mp3, opus or m4a", spec.Container)
+	}
+	if spec.VideoCodec != "" || spec.AudioCodec != "" {
+		return nil, errors.New("codecs are set by the container")
+	}
+	return &extractAudio{format: spec.Container}, nil
+}
+
+func (e *extractAudio) Run(ctx context.Context, path string, log func(string)) (string, error) {
+	args := append([]string{"-vn"}, audioFormats[e.format]...)
+	return ffmpeg(ctx, path, e.format, args, log)
+}
+
+// normalize normalizes the loudness of files, keeping their container.
+type normalize struct{}
+
+// loudnorm is the EBU R128 loudness normalization filter.
+const loudnorm = "loudnorm=I=-16:TP=-1.5:LRA=11"
+
+func newNormalize(spec Spec) (Step, error) {
+	if spec.Container != "" || spec.VideoCodec != "" || spec.AudioCodec != "" {
+		return nil, errors.New("normalize has no options")
+	}
+	return normalize{}, nil
+}
+
+func (normalize) Run(ctx context.Context, path string, log func(string)) (string, error) {
+	ext := strings.TrimPrefix(filepath.Ext(path), ".")
+	encoder := "aac"
+	switch ext {
+	case "mp3":
+		encoder = "libmp3lame"
+	case "opus", "webm", "ogg":
+		encoder = "libopus"
+	}
+	args := []string{"-c:v", "copy", "-af", loudnorm, "-c:a", encoder}
+	return ffmpeg(ctx, path, ext, args, log)
+}
+
+// ffmpeg runs ffmpeg with args on the file at path, logging its output, and
+// returns the path of the output file with ext. The output file replaces the
+// file at path.
+func ffmpeg(ctx context.Context, path string, ext string, args []string, log func(string)) (string, error) {
+	base := strings.TrimSuffix(path, filepath.Ext(path))
+	out := base + "." + ext
+	tmp := base + ".postprocess." + ext
+
+	args = append([]string{"-hide_banner", "-nostats", "-nostdin", "-y", "-i", path}, args...)
+	cmd := exec.CommandContext(ctx, "ffmpeg", append(args, tmp)...)
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return "", err
+	}
+	if err := cmd.Start(); err != nil {
+		return "", err
+	}
+	s := bufio.NewScanner(stderr)
+	for s.Scan() {
+		log(s.Text())
+	}
+	if err := cmd.Wait(); err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+
+	if err := os.Remove(path); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmp, out); err != nil {
+		return "", err
+	}
+	return out, nil
+}
@@ -0,0 +1,138 @@
+// Package postprocess implements the post-processing of downloaded files,
+// e.g. transcoding, between download and upload.
+package postprocess
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Spec configures a step. Step is the name of a registered step, the other
+// fields are the options of the step.
+type Spec struct {
+	Step       string `json:"step"`
+	Container  string `json:"container,omitempty"`
+	VideoCodec string `json:"video_codec,omitempty"`
+	AudioCodec string `json:"audio_codec,omitempty"`
+}
+
+// Step is a post-processing step.
+type Step interface {
+	// Run processes the file at path, logging to log, and returns the path
+	// of the processed file.
+	Run(ctx context.Context, path string, log func(string)) (string, error)
+}
+
+// Factory returns the step configured by spec, or an error if spec is
+// invalid.
+type Factory func(spec Spec) (Step, error)
+
+var (
+	factoriesMu sync.RWMutex
+	factories   = make(map[string]Factory)
+)
+
+// Register registers the step factory with name. It panics if name is
+// already registered.
+func Register(name string, factory Factory) {
+	factoriesMu.Lock()
+	defer factoriesMu.Unlock()
+	if _, ok := factories[name]; ok {
+		panic("postprocess: step " + name + " registered twice")
+	}
+	factories[name] = factory
+}
+
+// Names returns the sorted names of the registered steps.
+func Names() []string {
+	factoriesMu.RLock()
+	defer factoriesMu.RUnlock()
+	var names []string
+	for name := range factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// MaxSteps is the maximum number of steps of a pipeline.
+const MaxSteps = 8
+
+// Steps returns the steps configured by specs.
+func Steps(specs []Spec) ([]Step, error) {
+	if len(specs) > MaxSteps {
+		return nil, fmt.Errorf("postprocess: too many steps, expected at most %d", MaxSteps)
+	}
+	steps := make([]Step, 0, len(specs))
+	for _, spec := range specs {
+		factoriesMu.RLock()
+		factory, ok := factories[spec.Step]
+		factoriesMu.RUnlock()
+		if !ok {
+			return nil, fmt.Errorf("postprocess: unknown step %q, expected one of %v", spec.Step, Names())
+		}
+		step, err := factory(spec)
+		if err != nil {
+			return nil, fmt.Errorf("postprocess: invalid step %s: %v", spec.Step, err)
+		}
+		steps = append(steps, step)
+	}
+	return steps, nil
+}
+
+// Validate returns an error if specs are invalid.
+func Validate(specs []Spec) error {
+	_, err := Steps(specs)
+	return err
+}
+
+// ParseSpecs parses specs from a comma-separated list of steps, each
+// optionally followed by a colon and a container, e.g.
+// "transcode:mp4,normalize".
+func ParseSpecs(s string) ([]Spec, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var specs []Spec
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			return nil, errors.New("postprocess: empty step")
+		}
+		i := strings.Index(field, ":")
+		if i < 0 {
+			specs = append(specs, Spec{Step: field})
+			continue
+		}
+		specs = append(specs, Spec{Step: field[:i], Container: field[i+1:]})
+	}
+	return specs, Validate(specs)
+}
+
+// New returns a new Processor.
+func New() *Processor {
+	return &Processor{}
+}
+
+// Processor runs the post-processing steps of downloaded files.
+type Processor struct{}
+
+// Process runs the steps configured by specs on the file at path, in order,
+// and returns the path of the processed file.
+func (*Processor) Process(ctx context.Context, specs []Spec, path string, log func(string)) (string, error) {
+	steps, err := Steps(specs)
+	if err != nil {
+		return "", err
+	}
+	for i, step := range steps {
+		log(fmt.Sprintf("postprocess: running step %s on %s", specs[i].Step, path))
+		if path, err = step.Run(ctx, path, log); err != nil {
+			return "", fmt.Errorf("postprocess: step %s: %v", specs[i].Step, err)
+		}
+	}
+	return path, nil
+}
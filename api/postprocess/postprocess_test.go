@@ -0,0 +1,74 @@
+package postprocess
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func assertf(t *testing.T, ok bool, msg string, args ...interface{}) {
+	t.Helper()
+	if !ok {
+		t.Errorf(msg, args...)
+	}
+}
+
+type stepFunc func(ctx context.Context, path string, log func(string)) (string, error)
+
+func (f stepFunc) Run(ctx context.Context, path string, log func(string)) (string, error) {
+	return f(ctx, path, log)
+}
+
+func init() {
+	Register("test-rename", func(spec Spec) (Step, error) {
+		if spec.Container == "" {
+			return nil, errors.New("container is required")
+		}
+		return stepFunc(func(ctx context.Context, path string, log func(string)) (string, error) {
+			log("renaming " + path)
+			return path + "." + spec.Container, nil
+		}), nil
+	})
+	Register("test-fail", func(spec Spec) (Step, error) {
+		return stepFunc(func(ctx context.Context, path string, log func(string)) (string, error) {
+			return "", errors.New("failed")
+		}), nil
+	})
+}
+
+func TestParseSpecs(t *testing.T) {
+	specs, err := ParseSpecs("transcode:mp4, extract-audio:mp3,normalize")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Spec{{Step: "transcode", Container: "mp4"}, {Step: "extract-audio", Container: "mp3"}, {Step: "normalize"}}
+	assertf(t, reflect.DeepEqual(specs, expected), `expected specs to be %+v, got %+v`, expected, specs)
+
+	for _, s := range []string{"unknown", "transcode", "transcode:avi", "extract-audio:flv", "normalize:mp4", "transcode:mp4,"} {
+		_, err := ParseSpecs(s)
+		assertf(t, err != nil, `expected an error parsing %q`, s)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	assertf(t, Validate([]Spec{{Step: "transcode", Container: "webm", VideoCodec: "vp9", AudioCodec: "opus"}}) == nil, `expected webm with vp9 and opus to be valid`)
+	assertf(t, Validate([]Spec{{Step: "transcode", Container: "webm", VideoCodec: "h264"}}) != nil, `expected webm with h264 to be invalid`)
+	assertf(t, Validate(make([]Spec, MaxSteps+1)) != nil, `expected too many steps to be invalid`)
+}
+
+func TestProcess(t *testing.T) {
+	var logs []string
+	log := func(s string) { logs = append(logs, s) }
+	ctx := context.Background()
+
+	path, err := New().Process(ctx, []Spec{{Step: "test-rename", Container: "a"}, {Step: "test-rename", Container: "b"}}, "file", log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertf(t, path == "file.a.b", `expected path to be "file.a.b", got %q`, path)
+	assertf(t, len(logs) == 4, `expected 4 logs, got %q`, logs)
+
+	_, err = New().Process(ctx, []Spec{{Step: "test-rename", Container: "a"}, {Step: "test-fail"}}, "file", log)
+	assertf(t, err != nil, `expected an error from the failing step`)
+}
@@ -4,6 +4,7 @@ import (
 	"net/url"
 
 	"github.com/yansal/query"
+	"github.com/yansal/youtube-ar/api/classifier"
 )
 
 // ParseURLs parses v and returns a new URLs.
@@ -11,8 +12,10 @@ func ParseURLs(v url.Values) (*URLs, error) {
 	q, err := query.Validate(v,
 		query.IntParam("limit"),
 		query.IntParam("cursor"),
-		query.StringsParam("status", []string{"pending", "processing", "failure", "success"}),
+		query.StringsParam("status", []string{"pending", "processing", "failure", "success", "canceled"}),
+		query.StringsParam("error_category", classifier.Categories),
 		query.StringParam("q"),
+		query.IntParam("parent_id"),
 	)
 	if err != nil {
 		return nil, err
@@ -29,9 +32,15 @@ func ParseURLs(v url.Values) (*URLs, error) {
 	if status, ok := q["status"]; ok {
 		u.Status = status.([]string)
 	}
+	if category, ok := q["error_category"]; ok {
+		u.ErrorCategory = category.([]string)
+	}
 	if q, ok := q["q"]; ok {
 		u.Q = q.(string)
 	}
+	if parentID, ok := q["parent_id"]; ok {
+		u.ParentID = parentID.(int64)
+	}
 	return &u, nil
 }
 
@@ -48,12 +57,47 @@ func ParseLogs(v url.Values) (*Logs, error) {
 	return &l, nil
 }
 
+// ParseFailed parses v and returns a new Failed.
+func ParseFailed(v url.Values) (*Failed, error) {
+	q, err := query.Validate(v,
+		query.IntParam("offset"),
+		query.IntParam("limit"),
+	)
+	if err != nil {
+		return nil, err
+	}
+	var f Failed
+	if offset, ok := q["offset"]; ok {
+		f.Offset = offset.(int64)
+	}
+	if limit, ok := q["limit"]; !ok {
+		f.Limit = DefaultLimit
+	} else {
+		f.Limit = limit.(int64)
+	}
+	return &f, nil
+}
+
 // URLs is the query for urls.
 type URLs struct {
+	Cursor        int64
+	Limit         int64
+	Status        []string
+	ErrorCategory []string
+	Q             string
+	ParentID      int64
+}
+
+// Outbox is the query for outbox entries.
+type Outbox struct {
 	Cursor int64
 	Limit  int64
-	Status []string
-	Q      string
+}
+
+// Failed is the query for failed jobs.
+type Failed struct {
+	Offset int64
+	Limit  int64
 }
 
 // Logs is the query for logs.
@@ -0,0 +1,71 @@
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+// NewMemory returns a new MemoryStore.
+func NewMemory() *MemoryStore {
+	return &MemoryStore{buckets: make(map[string]*bucket), now: time.Now}
+}
+
+// MemoryStore is an in-process store of token buckets, with the same
+// semantics as RedisStore. The buckets aren't shared with other processes.
+type MemoryStore struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	now     func() time.Time
+}
+
+type bucket struct {
+	tokens   float64
+	ts       time.Time
+	factor   float64
+	cooldown time.Time
+}
+
+// Take takes a token from the bucket with key, refilled at rate. It returns
+// the duration to wait before retrying if the bucket is empty.
+func (s *MemoryStore) Take(ctx context.Context, key string, rate Rate) (time.Duration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	burst := float64(rate.N)
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &bucket{tokens: burst, ts: now}
+		s.buckets[key] = b
+	}
+
+	perSecond := rate.perSecond()
+	if b.factor > 0 && now.Before(b.cooldown) {
+		perSecond /= b.factor
+	}
+	if elapsed := now.Sub(b.ts).Seconds(); elapsed > 0 {
+		b.tokens = math.Min(burst, b.tokens+elapsed*perSecond)
+	}
+	b.ts = now
+	if b.tokens < 1 {
+		ms := math.Ceil((1 - b.tokens) / perSecond * 1000)
+		return time.Duration(ms) * time.Millisecond, nil
+	}
+	b.tokens--
+	return 0, nil
+}
+
+// Tighten empties the bucket with key, and slows its refill down according
+// to cooldown.
+func (s *MemoryStore) Tighten(ctx context.Context, key string, cooldown Cooldown) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	s.buckets[key] = &bucket{
+		ts:       now,
+		factor:   cooldown.Factor,
+		cooldown: now.Add(cooldown.Window),
+	}
+	return nil
+}
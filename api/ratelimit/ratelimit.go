@@ -0,0 +1,139 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Rate is a rate of n events per duration. Up to n events can happen at once.
+type Rate struct {
+	N   int
+	Per time.Duration
+}
+
+// perSecond returns the number of events per second of r.
+func (r Rate) perSecond() float64 {
+	return float64(r.N) / r.Per.Seconds()
+}
+
+// Cooldown is the tightening of a rate limit, e.g. after the target host
+// asked to slow down. The rate is divided by Factor during Window.
+type Cooldown struct {
+	Factor float64
+	Window time.Duration
+}
+
+// DefaultCooldown is the default cooldown.
+var DefaultCooldown = Cooldown{Factor: 4, Window: 15 * time.Minute}
+
+// Store is the interface implemented by token bucket stores.
+type Store interface {
+	// Take takes a token from the bucket with key, refilled at rate. It
+	// returns the duration to wait before retrying if the bucket is empty.
+	Take(ctx context.Context, key string, rate Rate) (time.Duration, error)
+	// Tighten empties the bucket with key, and slows its refill down
+	// according to cooldown.
+	Tighten(ctx context.Context, key string, cooldown Cooldown) error
+}
+
+var (
+	_ Store = &RedisStore{}
+	_ Store = &MemoryStore{}
+)
+
+// New returns a new Limiter. rates maps queues to their rate, the jobs of
+// queues missing from rates aren't limited. If perHost is true, the jobs of a
+// queue are limited by the host of their url.
+func New(store Store, rates map[string]Rate, perHost bool, cooldown Cooldown) *Limiter {
+	return &Limiter{store: store, rates: rates, perHost: perHost, cooldown: cooldown}
+}
+
+// Limiter is a rate limiter of jobs.
+type Limiter struct {
+	store    Store
+	rates    map[string]Rate
+	perHost  bool
+	cooldown Cooldown
+}
+
+// key returns the bucket key of the jobs of queue with rawurl.
+func (l *Limiter) key(queue string, rawurl string) string {
+	key := "ratelimit:" + queue
+	if !l.perHost {
+		return key
+	}
+	if u, err := url.Parse(rawurl); err == nil && u.Hostname() != "" {
+		key += ":" + u.Hostname()
+	}
+	return key
+}
+
+// Wait waits until a job of queue with rawurl can start, or ctx is done.
+func (l *Limiter) Wait(ctx context.Context, queue string, rawurl string) error {
+	rate, ok := l.rates[queue]
+	if !ok {
+		return nil
+	}
+	key := l.key(queue, rawurl)
+	for {
+		d, err := l.store.Take(ctx, key, rate)
+		if err != nil {
+			return err
+		}
+		if d <= 0 {
+			return nil
+		}
+		timer := time.NewTimer(d)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// Tighten tightens the limit of the jobs of queue with rawurl for the cooldown
+// window.
+func (l *Limiter) Tighten(ctx context.Context, queue string, rawurl string) error {
+	if _, ok := l.rates[queue]; !ok {
+		return nil
+	}
+	return l.store.Tighten(ctx, l.key(queue, rawurl), l.cooldown)
+}
+
+// ParseRates parses a comma-separated list of queue=n/duration pairs, e.g.
+// "download-url=10/1m". The duration unit can be used alone, e.g. "10/m".
+func ParseRates(s string) (map[string]Rate, error) {
+	rates := make(map[string]Rate)
+	if s == "" {
+		return rates, nil
+	}
+	for _, pair := range strings.Split(s, ",") {
+		i := strings.Index(pair, "=")
+		j := strings.Index(pair, "/")
+		if i < 0 || j < i {
+			return nil, fmt.Errorf("invalid rate %q, expected queue=n/duration", pair)
+		}
+		n, err := strconv.Atoi(pair[i+1 : j])
+		if err != nil {
+			return nil, fmt.Errorf("invalid rate %q: %v", pair, err)
+		}
+		per, err := time.ParseDuration(pair[j+1:])
+		if err != nil {
+			per, err = time.ParseDuration("1" + pair[j+1:])
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid rate %q: %v", pair, err)
+		}
+		if n < 1 || per <= 0 {
+			return nil, fmt.Errorf("invalid rate %q, expected n and duration to be positive", pair)
+		}
+		rates[pair[:i]] = Rate{N: n, Per: per}
+	}
+	return rates, nil
+}
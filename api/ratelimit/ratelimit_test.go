@@ -0,0 +1,82 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func assertf(t *testing.T, ok bool, msg string, args ...interface{}) {
+	t.Helper()
+	if !ok {
+		t.Errorf(msg, args...)
+	}
+}
+
+func TestParseRates(t *testing.T) {
+	rates, err := ParseRates("download-url=10/1m,get-oembed=1/s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertf(t, rates["download-url"] == Rate{N: 10, Per: time.Minute}, `expected download-url rate to be 10/1m, got %+v`, rates["download-url"])
+	assertf(t, rates["get-oembed"] == Rate{N: 1, Per: time.Second}, `expected get-oembed rate to be 1/s, got %+v`, rates["get-oembed"])
+
+	for _, s := range []string{"download-url", "download-url=10", "download-url=0/1m", "download-url=x/1m", "download-url=1/x"} {
+		_, err := ParseRates(s)
+		assertf(t, err != nil, `expected an error parsing %q`, s)
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	s := NewMemory()
+	now := time.Now()
+	s.now = func() time.Time { return now }
+	ctx := context.Background()
+	rate := Rate{N: 2, Per: time.Minute}
+
+	for i := 0; i < 2; i++ {
+		d, err := s.Take(ctx, "key", rate)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertf(t, d == 0, `expected take %d within burst not to wait, got %v`, i, d)
+	}
+	d, err := s.Take(ctx, "key", rate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertf(t, d == 30*time.Second, `expected empty bucket to wait 30s, got %v`, d)
+
+	now = now.Add(30 * time.Second)
+	d, err = s.Take(ctx, "key", rate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertf(t, d == 0, `expected refilled bucket not to wait, got %v`, d)
+
+	if err := s.Tighten(ctx, "key", Cooldown{Factor: 4, Window: time.Hour}); err != nil {
+		t.Fatal(err)
+	}
+	d, err = s.Take(ctx, "key", rate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertf(t, d == 2*time.Minute, `expected tightened bucket to wait 2m, got %v`, d)
+
+	now = now.Add(2 * time.Hour)
+	d, err = s.Take(ctx, "key", rate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertf(t, d == 0, `expected bucket to be refilled at rate after the cooldown, got %v`, d)
+}
+
+func TestLimiterKey(t *testing.T) {
+	l := New(NewMemory(), nil, true, DefaultCooldown)
+	key := l.key("download-url", "https://www.youtube.com/watch?v=id")
+	assertf(t, key == "ratelimit:download-url:www.youtube.com", `expected key by host, got %q`, key)
+
+	l = New(NewMemory(), nil, false, DefaultCooldown)
+	key = l.key("download-url", "https://www.youtube.com/watch?v=id")
+	assertf(t, key == "ratelimit:download-url", `expected key by queue, got %q`, key)
+}
@@ -0,0 +1,79 @@
+package ratelimit
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// NewRedis returns a new RedisStore.
+func NewRedis(r Redis) *RedisStore {
+	return &RedisStore{redis: r}
+}
+
+// Redis is the redis interface required by RedisStore.
+type Redis interface {
+	Eval(script string, keys []string, args ...interface{}) *redis.Cmd
+}
+
+// RedisStore is a store of token buckets shared by processes, backed by
+// redis hashes. The buckets are updated by lua scripts, so that concurrent
+// takes are atomic, and timed with the redis clock.
+type RedisStore struct {
+	redis Redis
+}
+
+// takeScript takes a token from the bucket KEYS[1], refilled at ARGV[1]
+// tokens per second, divided by the cooldown factor KEYS[2] if any, up to
+// ARGV[2] tokens. It returns 0, or the number of milliseconds to wait before
+// retrying if the bucket is empty.
+const takeScript = `
+if redis.replicate_commands then redis.replicate_commands() end
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local factor = tonumber(redis.call('GET', KEYS[2]))
+if factor then rate = rate / factor end
+local t = redis.call('TIME')
+local now = tonumber(t[1]) + tonumber(t[2]) / 1000000
+local tokens, ts = burst, now
+local bucket = redis.call('HMGET', KEYS[1], 'tokens', 'ts')
+if bucket[1] then
+	tokens, ts = tonumber(bucket[1]), tonumber(bucket[2])
+end
+tokens = math.min(burst, tokens + math.max(0, now - ts) * rate)
+if tokens < 1 then
+	return math.ceil((1 - tokens) / rate * 1000)
+end
+redis.call('HMSET', KEYS[1], 'tokens', tokens - 1, 'ts', now)
+redis.call('PEXPIRE', KEYS[1], math.ceil(burst / rate * 1000) + 1000)
+return 0
+`
+
+// tightenScript empties the bucket KEYS[1], and sets the cooldown factor
+// KEYS[2] to ARGV[1] for ARGV[2] milliseconds.
+const tightenScript = `
+if redis.replicate_commands then redis.replicate_commands() end
+redis.call('SET', KEYS[2], ARGV[1], 'PX', ARGV[2])
+local t = redis.call('TIME')
+local now = tonumber(t[1]) + tonumber(t[2]) / 1000000
+redis.call('HMSET', KEYS[1], 'tokens', 0, 'ts', now)
+redis.call('PEXPIRE', KEYS[1], ARGV[2])
+return 0
+`
+
+// Take takes a token from the bucket with key, refilled at rate. It returns
+// the duration to wait before retrying if the bucket is empty.
+func (s *RedisStore) Take(ctx context.Context, key string, rate Rate) (time.Duration, error) {
+	ms, err := s.redis.Eval(takeScript, []string{key, key + ":cooldown"}, rate.perSecond(), rate.N).Int64()
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(ms) * time.Millisecond, nil
+}
+
+// Tighten empties the bucket with key, and slows its refill down according
+// to cooldown.
+func (s *RedisStore) Tighten(ctx context.Context, key string, cooldown Cooldown) error {
+	return s.redis.Eval(tightenScript, []string{key, key + ":cooldown"}, cooldown.Factor, cooldown.Window.Milliseconds()).Err()
+}
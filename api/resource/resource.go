@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"time"
 
+	"github.com/yansal/youtube-ar/api/broker"
 	"github.com/yansal/youtube-ar/api/model"
 )
 
@@ -21,32 +22,67 @@ func NewSerializer(mediaURL string) *Serializer {
 
 // URL is the url resource.
 type URL struct {
-	ID        int64           `json:"id,omitempty"`
-	URL       string          `json:"url,omitempty"`
-	CreatedAt time.Time       `json:"created_at,omitempty"`
-	UpdatedAt time.Time       `json:"updated_at,omitempty"`
-	Status    string          `json:"status,omitempty"`
-	Error     string          `json:"error,omitempty"`
-	File      string          `json:"file,omitempty"`
-	OEmbed    json.RawMessage `json:"oembed,omitempty"`
+	ID            int64           `json:"id,omitempty"`
+	URL           string          `json:"url,omitempty"`
+	ParentID      int64           `json:"parent_id,omitempty"`
+	Extractor     string          `json:"extractor,omitempty"`
+	CreatedAt     time.Time       `json:"created_at,omitempty"`
+	UpdatedAt     time.Time       `json:"updated_at,omitempty"`
+	Status        string          `json:"status,omitempty"`
+	Error         string          `json:"error,omitempty"`
+	ErrorCategory string          `json:"error_category,omitempty"`
+	File          string          `json:"file,omitempty"`
+	OEmbed        json.RawMessage `json:"oembed,omitempty"`
+	Options       json.RawMessage `json:"options,omitempty"`
+	PostProcess   json.RawMessage `json:"postprocess,omitempty"`
+	Progress      json.RawMessage `json:"progress,omitempty"`
+	Metadata      json.RawMessage `json:"metadata,omitempty"`
+	Artifacts     []Artifact      `json:"artifacts,omitempty"`
+}
+
+// Artifact is the artifact resource.
+type Artifact struct {
+	Kind     string `json:"kind"`
+	Language string `json:"language,omitempty"`
+	MimeType string `json:"mime_type"`
+	Size     int64  `json:"size"`
+	URL      string `json:"url"`
 }
 
 // NewURL returns a new URL.
 func (s *Serializer) NewURL(url *model.URL) *URL {
 	resource := URL{
-		ID:        url.ID,
-		URL:       url.URL,
-		CreatedAt: url.CreatedAt,
-		UpdatedAt: url.UpdatedAt,
-		Status:    url.Status,
-		OEmbed:    url.OEmbed,
+		ID:          url.ID,
+		URL:         url.URL,
+		ParentID:    url.ParentID.Int64,
+		Extractor:   url.Extractor.String,
+		CreatedAt:   url.CreatedAt,
+		UpdatedAt:   url.UpdatedAt,
+		Status:      url.Status,
+		OEmbed:      url.OEmbed,
+		Options:     url.Options,
+		PostProcess: url.PostProcess,
+		Progress:    url.Progress,
+		Metadata:    url.Metadata,
 	}
 	if url.Error.Valid {
 		resource.Error = url.Error.String
 	}
+	if url.ErrorCategory.Valid {
+		resource.ErrorCategory = url.ErrorCategory.String
+	}
 	if url.File.Valid {
 		resource.File = s.mediaURL + url.File.String
 	}
+	for _, artifact := range url.Artifacts {
+		resource.Artifacts = append(resource.Artifacts, Artifact{
+			Kind:     artifact.Kind,
+			Language: artifact.Language.String,
+			MimeType: artifact.MimeType,
+			Size:     artifact.Size,
+			URL:      s.mediaURL + artifact.File,
+		})
+	}
 	return &resource
 }
 
@@ -97,3 +133,78 @@ func (s *Serializer) NewLogs(logs []model.Log, cursor int64) *Logs {
 	resource.NextCursor = cursor + int64(len(logs))
 	return &resource
 }
+
+// FailedJob is the failed job resource.
+type FailedJob struct {
+	ID         string     `json:"id"`
+	Queue      string     `json:"queue"`
+	Payload    string     `json:"payload"`
+	Priority   string     `json:"priority,omitempty"`
+	Attempts   int        `json:"attempts"`
+	EnqueuedAt time.Time  `json:"enqueued_at"`
+	LastError  string     `json:"last_error,omitempty"`
+	Errors     []JobError `json:"errors,omitempty"`
+	TraceID    string     `json:"trace_id,omitempty"`
+}
+
+// JobError is the job error resource.
+type JobError struct {
+	Attempt int       `json:"attempt"`
+	At      time.Time `json:"at"`
+	Error   string    `json:"error"`
+}
+
+// NewFailedJob returns a new FailedJob.
+func (s *Serializer) NewFailedJob(job *broker.Job) *FailedJob {
+	resource := FailedJob{
+		ID:         job.ID,
+		Queue:      job.Queue,
+		Payload:    job.Payload,
+		Priority:   string(job.Priority),
+		Attempts:   job.Attempts,
+		EnqueuedAt: job.EnqueuedAt,
+		LastError:  job.LastError,
+		TraceID:    job.TraceID,
+	}
+	for _, e := range job.Errors {
+		resource.Errors = append(resource.Errors, JobError{Attempt: e.Attempt, At: e.At, Error: e.Error})
+	}
+	return &resource
+}
+
+// FailedJobs is the failed job list resource.
+type FailedJobs struct {
+	Jobs       []FailedJob `json:"jobs"`
+	Count      int64       `json:"count"`
+	NextOffset int64       `json:"next_offset"`
+}
+
+// NewFailedJobs returns a new FailedJob list.
+func (s *Serializer) NewFailedJobs(jobs []*broker.Job, count int64, offset int64) *FailedJobs {
+	resource := FailedJobs{Jobs: []FailedJob{}, Count: count}
+	for _, job := range jobs {
+		resource.Jobs = append(resource.Jobs, *s.NewFailedJob(job))
+	}
+	resource.NextOffset = offset + int64(len(jobs))
+	return &resource
+}
+
+// Worker is the worker resource.
+type Worker struct {
+	*broker.Heartbeat
+	Stale bool `json:"stale"`
+}
+
+// Workers is the worker list resource.
+type Workers struct {
+	Workers []Worker `json:"workers"`
+}
+
+// NewWorkers returns a new Worker list. Workers are flagged as stale at now.
+func (s *Serializer) NewWorkers(heartbeats []*broker.Heartbeat, now time.Time) *Workers {
+	resource := Workers{Workers: make([]Worker, len(heartbeats))}
+	for i, h := range heartbeats {
+		resource.Workers[i] = Worker{Heartbeat: h, Stale: h.Stale(now)}
+	}
+	return &resource
+}
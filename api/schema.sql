@@ -1,6 +1,6 @@
 begin;
 
-create table urls (
+create table if not exists urls (
     id serial primary key,
     url text not null,
     created_at timestamp with time zone not null default now(),
@@ -9,37 +9,126 @@ create table urls (
     logs text[],
     status text not null default 'pending',
     error text,
+    error_category text,
     file text,
     retries int,
     oembed jsonb,
-    tsv tsvector
+    options jsonb,
+    postprocess jsonb,
+    progress jsonb,
+    metadata jsonb,
+    tsv tsvector,
+    canonical_key text,
+    idempotency_key text unique,
+    parent_id int references urls (id),
+    extractor text
 );
 
-create function urls_update() returns trigger as $urls_update$
+-- columns added since urls was created, for existing databases
+alter table urls
+    add column if not exists error_category text,
+    add column if not exists options jsonb,
+    add column if not exists postprocess jsonb,
+    add column if not exists progress jsonb,
+    add column if not exists metadata jsonb,
+    add column if not exists canonical_key text,
+    add column if not exists idempotency_key text,
+    add column if not exists parent_id int references urls (id),
+    add column if not exists extractor text;
+
+create unique index if not exists urls_idempotency_key_key on urls (idempotency_key);
+create index if not exists urls_canonical_key on urls (canonical_key) where deleted_at is null;
+create index if not exists urls_parent_id on urls (parent_id) where parent_id is not null;
+
+create or replace function urls_update() returns trigger as $urls_update$
     begin
         NEW.updated_at := current_timestamp;
         return NEW;
     end;
 $urls_update$ language plpgsql;
 
+drop trigger if exists urls_update on urls;
 create trigger urls_update before update on urls
     for each row execute procedure urls_update();
 
-create function urls_update_tsv() returns trigger as $urls_update_tsv$
+create or replace function urls_update_tsv() returns trigger as $urls_update_tsv$
     begin
         NEW.tsv := to_tsvector(coalesce(new.oembed->>'title', '')) ||
-            to_tsvector(coalesce(new.oembed->>'author_name', ''));
+            to_tsvector(coalesce(new.oembed->>'author_name', '')) ||
+            to_tsvector(coalesce(new.metadata->>'title', '')) ||
+            to_tsvector(coalesce(new.metadata->>'uploader', '')) ||
+            to_tsvector(coalesce(new.metadata->>'channel', '')) ||
+            to_tsvector(coalesce((select string_agg(tag, ' ') from jsonb_array_elements_text(coalesce(new.metadata->'tags', '[]')) tag), '')) ||
+            to_tsvector(coalesce(new.metadata->>'description', ''));
         return NEW;
     end
 $urls_update_tsv$ LANGUAGE plpgsql;
 
+drop trigger if exists urls_update_tsv on urls;
 create trigger urls_update_tsv before insert or update on urls
     for each row execute procedure urls_update_tsv();
 
-create table youtube_videos (
+create table if not exists artifacts (
+    id bigserial primary key,
+    url_id int not null references urls (id) on delete cascade,
+    kind text not null,
+    language text,
+    file text not null,
+    mime_type text not null,
+    size bigint not null,
+    created_at timestamp with time zone not null default now()
+);
+
+create index if not exists artifacts_url_id on artifacts (url_id);
+
+create table if not exists youtube_videos (
     id serial primary key,
     youtube_id text not null unique,
     created_at timestamp with time zone not null default now()
 );
 
+create table if not exists jobs (
+    id bigserial primary key,
+    queue text not null,
+    status text not null default 'queued',
+    job jsonb not null,
+    priority smallint not null default 1,
+    run_at timestamp with time zone not null default now(),
+    locked_until timestamp with time zone,
+    created_at timestamp with time zone not null default now()
+);
+
+alter table jobs add column if not exists priority smallint not null default 1;
+
+drop index if exists jobs_queue_status_run_at;
+create index if not exists jobs_queue_status_priority_run_at on jobs (queue, status, priority, run_at);
+
+create table if not exists outbox (
+    id bigserial primary key,
+    queue text not null,
+    payload text not null,
+    priority text not null default 'normal',
+    run_at timestamp with time zone not null default now(),
+    created_at timestamp with time zone not null default now(),
+    sent_at timestamp with time zone,
+    attempts int not null default 0,
+    last_error text,
+    next_attempt_at timestamp with time zone not null default now(),
+    dead_at timestamp with time zone
+);
+
+alter table outbox
+    add column if not exists priority text not null default 'normal',
+    add column if not exists next_attempt_at timestamp with time zone not null default now(),
+    add column if not exists dead_at timestamp with time zone;
+
+drop index if exists outbox_pending;
+create index if not exists outbox_live on outbox (id) where sent_at is null and dead_at is null;
+
+create table if not exists workers (
+    id text primary key,
+    heartbeat jsonb not null,
+    seen_at timestamp with time zone not null
+);
+
 commit;
\ No newline at end of file
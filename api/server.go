@@ -10,6 +10,7 @@ import (
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/yansal/sql/nest"
 	"github.com/yansal/youtube-ar/api/broker"
 	"github.com/yansal/youtube-ar/api/log"
 	"github.com/yansal/youtube-ar/api/manager"
@@ -19,21 +20,35 @@ import (
 	"github.com/yansal/youtube-ar/api/server/middleware"
 	"github.com/yansal/youtube-ar/api/service"
 	"github.com/yansal/youtube-ar/api/store"
+	"golang.org/x/sync/errgroup"
 )
 
 func runServer(ctx context.Context, args []string) error {
 	log := log.New()
-	redis, err := newRedis(log)
+	db, err := newDB(log)
 	if err != nil {
 		return err
 	}
-	broker := broker.New(redis, log)
-	db, err := newDB(log)
+	broker, err := newBroker(log, db)
+	if err != nil {
+		return err
+	}
+	return serve(ctx, log, db, broker)
+}
+
+// serve runs the http server, and the relay sending the outbox entries to broker.
+func serve(ctx context.Context, log log.Logger, db nest.Querier, broker broker.Broker) error {
+	classifier, err := newClassifier()
+	if err != nil {
+		return err
+	}
+	policy, err := manager.ParseDuplicatePolicy(os.Getenv("DUPLICATE_POLICY"))
 	if err != nil {
 		return err
 	}
 	store := store.New()
-	manager := manager.NewServer(broker, store)
+	manager := manager.NewServer(store, policy, txBroker(broker))
+	relay := service.NewRelay(broker, store, log)
 
 	serializer := resource.NewSerializer(
 		"https://" + os.Getenv("S3_BUCKET") + ".s3." + os.Getenv("AWS_REGION") + ".amazonaws.com/",
@@ -51,9 +66,24 @@ func runServer(ctx context.Context, args []string) error {
 
 	mux.HandleFunc(http.MethodGet, regexp.MustCompile(`^/urls/(\d+)/logs$`), handler.ListLogs(manager, db, serializer))
 
-	retrier := service.NewRetrier(broker, manager, store)
+	retrier := service.NewRetrier(broker, manager, store, classifier)
 	mux.HandleFunc(http.MethodPost, regexp.MustCompile(`^/urls/(\d+)/retry$`), handler.RetryDownloadURL(retrier, db, serializer))
 
+	canceler := service.NewCanceler(broker, store)
+	mux.HandleFunc(http.MethodPost, regexp.MustCompile(`^/urls/(\d+)/cancel$`), handler.CancelURL(canceler, db, serializer))
+
+	mux.HandleFunc(http.MethodGet, regexp.MustCompile(`^/queues/([a-z-]+)/failed$`), handler.ListFailed(retrier, serializer))
+	mux.HandleFunc(http.MethodDelete, regexp.MustCompile(`^/queues/([a-z-]+)/failed$`), handler.PurgeFailed(retrier))
+	mux.HandleFunc(http.MethodOptions, regexp.MustCompile(`^/queues/([a-z-]+)/failed$`), func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Methods", http.MethodDelete)
+	})
+	mux.HandleFunc(http.MethodPost, regexp.MustCompile(`^/queues/([a-z-]+)/failed/requeue$`), handler.RequeueFailedWhere(retrier, db))
+	mux.HandleFunc(http.MethodGet, regexp.MustCompile(`^/queues/([a-z-]+)/failed/([0-9a-f]+)$`), handler.DetailFailed(retrier, serializer))
+	mux.HandleFunc(http.MethodPost, regexp.MustCompile(`^/queues/([a-z-]+)/failed/([0-9a-f]+)/requeue$`), handler.RequeueFailed(retrier, db))
+
+	registry := service.NewRegistry(broker, log)
+	mux.HandleFunc(http.MethodGet, regexp.MustCompile(`^/workers$`), handler.ListWorkers(registry, serializer))
+
 	handler := middleware.Log(mux, log)
 	handler = middleware.CORS(handler)
 	server := http.Server{Handler: handler}
@@ -67,22 +97,27 @@ func runServer(ctx context.Context, args []string) error {
 		return err
 	}
 
-	cerr := make(chan error)
-	go func() {
-		cerr <- server.Serve(l)
-	}()
-
-	select {
-	case <-ctx.Done():
-		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
-		defer cancel()
-		if err := server.Shutdown(ctx); err != nil {
-			log.Log(ctx, err.Error())
+	g, ctx := errgroup.WithContext(ctx)
+	g.Go(func() error { return relay.Run(ctx, db, time.Second) })
+	g.Go(func() error {
+		cerr := make(chan error)
+		go func() {
+			cerr <- server.Serve(l)
+		}()
+
+		select {
+		case <-ctx.Done():
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			if err := server.Shutdown(ctx); err != nil {
+				log.Log(ctx, err.Error())
+			}
+			return nil
+		case err := <-cerr:
+			return err
 		}
-		return nil
-	case err := <-cerr:
-		return err
-	}
+	})
+	return g.Wait()
 }
 
 func runPprofServer(ctx context.Context, port string) error {
@@ -0,0 +1,184 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/yansal/sql/nest"
+	"github.com/yansal/youtube-ar/api/broker"
+	"github.com/yansal/youtube-ar/api/query"
+	"github.com/yansal/youtube-ar/api/resource"
+	"github.com/yansal/youtube-ar/api/server"
+	"github.com/yansal/youtube-ar/api/service"
+)
+
+// FailedJobSerializer is the serializer interface required by failed job
+// handlers.
+type FailedJobSerializer interface {
+	NewFailedJob(job *broker.Job) *resource.FailedJob
+	NewFailedJobs(jobs []*broker.Job, count int64, offset int64) *resource.FailedJobs
+}
+
+// ListFailedRetrier is the retrier interface required by ListFailed.
+type ListFailedRetrier interface {
+	ListFailed(context.Context, string, *query.Failed) ([]*broker.Job, error)
+	CountFailed(context.Context, string) (int64, error)
+}
+
+// ListFailed is the GET /queues/:queue/failed handler.
+func ListFailed(retrier ListFailedRetrier, s FailedJobSerializer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		serveHTTP(w, r, listFailed(retrier, s))
+	}
+}
+
+func listFailed(retrier ListFailedRetrier, s FailedJobSerializer) handlerFunc {
+	return func(r *http.Request) (*response, error) {
+		ctx := r.Context()
+		queue := server.ContextMatch(ctx)[1]
+
+		q, err := query.ParseFailed(r.URL.Query())
+		if err != nil {
+			return nil, httpError{
+				err:  err,
+				code: http.StatusBadRequest,
+			}
+		}
+
+		jobs, err := retrier.ListFailed(ctx, queue, q)
+		if err != nil {
+			return nil, err
+		}
+		count, err := retrier.CountFailed(ctx, queue)
+		if err != nil {
+			return nil, err
+		}
+		resource := s.NewFailedJobs(jobs, count, q.Offset)
+		b, err := json.Marshal(resource)
+		if err != nil {
+			return nil, err
+		}
+		return &response{body: b, code: http.StatusOK}, nil
+	}
+}
+
+// DetailFailedRetrier is the retrier interface required by DetailFailed.
+type DetailFailedRetrier interface {
+	GetFailed(context.Context, string, string) (*broker.Job, error)
+}
+
+// DetailFailed is the GET /queues/:queue/failed/:id handler.
+func DetailFailed(retrier DetailFailedRetrier, s FailedJobSerializer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		serveHTTP(w, r, detailFailed(retrier, s))
+	}
+}
+
+func detailFailed(retrier DetailFailedRetrier, s FailedJobSerializer) handlerFunc {
+	return func(r *http.Request) (*response, error) {
+		ctx := r.Context()
+		match := server.ContextMatch(ctx)
+
+		job, err := retrier.GetFailed(ctx, match[1], match[2])
+		if err == broker.ErrNoJob {
+			return nil, httpError{code: http.StatusNotFound}
+		} else if err != nil {
+			return nil, err
+		}
+		resource := s.NewFailedJob(job)
+		b, err := json.Marshal(resource)
+		if err != nil {
+			return nil, err
+		}
+		return &response{body: b, code: http.StatusOK}, nil
+	}
+}
+
+// RequeueFailedRetrier is the retrier interface required by RequeueFailed.
+type RequeueFailedRetrier interface {
+	RequeueFailed(context.Context, nest.Querier, string, string) error
+}
+
+// RequeueFailed is the POST /queues/:queue/failed/:id/requeue handler.
+func RequeueFailed(retrier RequeueFailedRetrier, db nest.Querier) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		serveHTTP(w, r, requeueFailed(retrier, db))
+	}
+}
+
+func requeueFailed(retrier RequeueFailedRetrier, db nest.Querier) handlerFunc {
+	return func(r *http.Request) (*response, error) {
+		ctx := r.Context()
+		match := server.ContextMatch(ctx)
+
+		err := retrier.RequeueFailed(ctx, db, match[1], match[2])
+		if err == broker.ErrNoJob {
+			return nil, httpError{code: http.StatusNotFound}
+		} else if err != nil {
+			return nil, err
+		}
+		return &response{code: http.StatusNoContent}, nil
+	}
+}
+
+// RequeueFailedWhereRetrier is the retrier interface required by RequeueFailedWhere.
+type RequeueFailedWhereRetrier interface {
+	RequeueFailedWhere(context.Context, nest.Querier, string, service.FailedFilter) (int, error)
+}
+
+// RequeueFailedWhere is the POST /queues/:queue/failed/requeue handler. It
+// requeues the failed jobs whose last error contains the error query
+// parameter, or all failed jobs if it is empty.
+func RequeueFailedWhere(retrier RequeueFailedWhereRetrier, db nest.Querier) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		serveHTTP(w, r, requeueFailedWhere(retrier, db))
+	}
+}
+
+func requeueFailedWhere(retrier RequeueFailedWhereRetrier, db nest.Querier) handlerFunc {
+	return func(r *http.Request) (*response, error) {
+		ctx := r.Context()
+		queue := server.ContextMatch(ctx)[1]
+
+		f := service.FailedFilter{Error: r.URL.Query().Get("error")}
+		n, err := retrier.RequeueFailedWhere(ctx, db, queue, f)
+		if err != nil {
+			return nil, err
+		}
+		b, err := json.Marshal(map[string]int{"requeued": n})
+		if err != nil {
+			return nil, err
+		}
+		return &response{body: b, code: http.StatusOK}, nil
+	}
+}
+
+// PurgeFailedRetrier is the retrier interface required by PurgeFailed.
+type PurgeFailedRetrier interface {
+	PurgeFailed(context.Context, string) (int64, error)
+}
+
+// PurgeFailed is the DELETE /queues/:queue/failed handler.
+func PurgeFailed(retrier PurgeFailedRetrier) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		serveHTTP(w, r, purgeFailed(retrier))
+	}
+}
+
+func purgeFailed(retrier PurgeFailedRetrier) handlerFunc {
+	return func(r *http.Request) (*response, error) {
+		ctx := r.Context()
+		queue := server.ContextMatch(ctx)[1]
+
+		n, err := retrier.PurgeFailed(ctx, queue)
+		if err != nil {
+			return nil, err
+		}
+		b, err := json.Marshal(map[string]int64{"purged": n})
+		if err != nil {
+			return nil, err
+		}
+		return &response{body: b, code: http.StatusOK}, nil
+	}
+}
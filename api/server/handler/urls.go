@@ -8,11 +8,13 @@ import (
 	"strconv"
 
 	"github.com/yansal/sql/nest"
+	"github.com/yansal/youtube-ar/api/manager"
 	"github.com/yansal/youtube-ar/api/model"
 	"github.com/yansal/youtube-ar/api/payload"
 	"github.com/yansal/youtube-ar/api/query"
 	"github.com/yansal/youtube-ar/api/resource"
 	"github.com/yansal/youtube-ar/api/server"
+	"github.com/yansal/youtube-ar/api/service"
 )
 
 // URLSerializer is the serializer interface required by url handlers.
@@ -62,7 +64,8 @@ type CreateURLManager interface {
 	CreateURL(context.Context, nest.Querier, payload.URL) (*model.URL, error)
 }
 
-// CreateURL is the POST /urls handler.
+// CreateURL is the POST /urls handler. The Idempotency-Key header identifies
+// the request, so that it can be retried without creating the url twice.
 func CreateURL(m CreateURLManager, db nest.Querier, s URLSerializer) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		serveHTTP(w, r, createURL(m, db, s))
@@ -84,10 +87,19 @@ func createURL(m CreateURLManager, db nest.Querier, s URLSerializer) handlerFunc
 				code: http.StatusBadRequest,
 			}
 		}
+		payload.IdempotencyKey = r.Header.Get("Idempotency-Key")
 
 		ctx := r.Context()
+		code := http.StatusCreated
 		url, err := m.CreateURL(ctx, db, payload)
-		if err != nil {
+		if derr, ok := err.(*manager.DuplicateError); ok {
+			if derr.Conflict {
+				return nil, httpError{err: derr, code: http.StatusConflict}
+			}
+			url, code = derr.URL, http.StatusOK
+		} else if err == manager.ErrIdempotencyKeyReused {
+			return nil, httpError{err: err, code: http.StatusUnprocessableEntity}
+		} else if err != nil {
 			return nil, err
 		}
 		resource := s.NewURL(url)
@@ -95,7 +107,7 @@ func createURL(m CreateURLManager, db nest.Querier, s URLSerializer) handlerFunc
 		if err != nil {
 			return nil, err
 		}
-		return &response{body: b, code: http.StatusCreated}, nil
+		return &response{body: b, code: code}, nil
 	}
 }
 
@@ -197,3 +209,42 @@ func retryURL(retrier Retrier, db nest.Querier, s URLSerializer) handlerFunc {
 		return &response{body: b, code: http.StatusCreated}, nil
 	}
 }
+
+// CancelURLCanceler is the canceler interface required by CancelURL.
+type CancelURLCanceler interface {
+	CancelURL(context.Context, nest.Querier, int64) (*model.URL, error)
+}
+
+// CancelURL is the POST /urls/:id/cancel handler.
+func CancelURL(canceler CancelURLCanceler, db nest.Querier, s URLSerializer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		serveHTTP(w, r, cancelURL(canceler, db, s))
+	}
+}
+
+func cancelURL(canceler CancelURLCanceler, db nest.Querier, s URLSerializer) handlerFunc {
+	return func(r *http.Request) (*response, error) {
+		ctx := r.Context()
+		match := server.ContextMatch(ctx)
+		id, err := strconv.ParseInt(match[1], 0, 0)
+		if err != nil {
+			return nil, httpError{code: http.StatusNotFound}
+		}
+
+		url, err := canceler.CancelURL(ctx, db, id)
+		if err == sql.ErrNoRows {
+			return nil, httpError{code: http.StatusNotFound}
+		} else if err == service.ErrNotCancelable {
+			return nil, httpError{err: err, code: http.StatusConflict}
+		} else if err != nil {
+			return nil, err
+		}
+
+		resource := s.NewURL(url)
+		b, err := json.Marshal(resource)
+		if err != nil {
+			return nil, err
+		}
+		return &response{body: b, code: http.StatusOK}, nil
+	}
+}
@@ -5,10 +5,13 @@ import (
 	"net/http"
 	"net/url"
 	"strconv"
+	"strings"
 	"testing"
 
 	"github.com/yansal/sql/nest"
+	"github.com/yansal/youtube-ar/api/manager"
 	"github.com/yansal/youtube-ar/api/model"
+	"github.com/yansal/youtube-ar/api/payload"
 	"github.com/yansal/youtube-ar/api/query"
 	"github.com/yansal/youtube-ar/api/resource"
 )
@@ -21,7 +24,12 @@ func assertf(t *testing.T, ok bool, msg string, args ...interface{}) {
 }
 
 type mockManager struct {
-	listURLsFunc func(context.Context, *query.URLs) ([]model.URL, error)
+	listURLsFunc  func(context.Context, *query.URLs) ([]model.URL, error)
+	createURLFunc func(context.Context, payload.URL) (*model.URL, error)
+}
+
+func (m mockManager) CreateURL(ctx context.Context, db nest.Querier, p payload.URL) (*model.URL, error) {
+	return m.createURLFunc(ctx, p)
 }
 
 func (m mockManager) ListURLs(ctx context.Context, db nest.Querier, q *query.URLs) ([]model.URL, error) {
@@ -87,3 +95,40 @@ func TestListURLsQuery(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestCreateURLDuplicate(t *testing.T) {
+	existing := &model.URL{ID: 1, URL: "https://youtu.be/dQw4w9WgXcQ"}
+	for _, tc := range []struct {
+		err  error
+		code int
+	}{
+		{err: nil, code: http.StatusCreated},
+		{err: &manager.DuplicateError{URL: existing}, code: http.StatusOK},
+		{err: &manager.DuplicateError{URL: existing, Conflict: true}, code: http.StatusConflict},
+		{err: manager.ErrIdempotencyKeyReused, code: http.StatusUnprocessableEntity},
+	} {
+		h := createURL(mockManager{
+			createURLFunc: func(ctx context.Context, p payload.URL) (*model.URL, error) {
+				assertf(t, p.IdempotencyKey == "key", `expected idempotency key to be "key", got %q`, p.IdempotencyKey)
+				if tc.err != nil {
+					return nil, tc.err
+				}
+				return &model.URL{ID: 2, URL: p.URL}, nil
+			},
+		}, nil, mockSerializer{})
+
+		req, err := http.NewRequest(http.MethodPost, "/urls", strings.NewReader(`{"url":"https://www.youtube.com/watch?v=dQw4w9WgXcQ"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Idempotency-Key", "key")
+		resp, err := h(req)
+		code := http.StatusInternalServerError
+		if herr, ok := err.(httpError); ok {
+			code = herr.code
+		} else if err == nil {
+			code = resp.code
+		}
+		assertf(t, code == tc.code, `expected code to be %d with err %v, got %d`, tc.code, tc.err, code)
+	}
+}
@@ -0,0 +1,43 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/yansal/youtube-ar/api/broker"
+	"github.com/yansal/youtube-ar/api/resource"
+)
+
+// WorkerSerializer is the serializer interface required by ListWorkers.
+type WorkerSerializer interface {
+	NewWorkers(heartbeats []*broker.Heartbeat, now time.Time) *resource.Workers
+}
+
+// ListWorkersRegistry is the registry interface required by ListWorkers.
+type ListWorkersRegistry interface {
+	ListWorkers(context.Context) ([]*broker.Heartbeat, error)
+}
+
+// ListWorkers is the GET /workers handler.
+func ListWorkers(registry ListWorkersRegistry, s WorkerSerializer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		serveHTTP(w, r, listWorkers(registry, s))
+	}
+}
+
+func listWorkers(registry ListWorkersRegistry, s WorkerSerializer) handlerFunc {
+	return func(r *http.Request) (*response, error) {
+		heartbeats, err := registry.ListWorkers(r.Context())
+		if err != nil {
+			return nil, err
+		}
+		resource := s.NewWorkers(heartbeats, time.Now())
+		b, err := json.Marshal(resource)
+		if err != nil {
+			return nil, err
+		}
+		return &response{body: b, code: http.StatusOK}, nil
+	}
+}
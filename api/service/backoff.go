@@ -0,0 +1,85 @@
+package service
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/yansal/youtube-ar/api/classifier"
+)
+
+// BackoffPolicy is the policy deciding when failed urls are retried.
+type BackoffPolicy struct {
+	// MaxRetries is the maximum number of retries of a url.
+	MaxRetries int64
+	// Delays are the delays before each retry, by error category. The last
+	// delay of a category is used for the retries beyond its schedule. Urls
+	// failed with a category without delays aren't retried.
+	Delays map[string][]time.Duration
+}
+
+// DefaultBackoffPolicy is the default backoff policy.
+var DefaultBackoffPolicy = BackoffPolicy{
+	MaxRetries: 5,
+	Delays: map[string][]time.Duration{
+		classifier.Timeout:          {time.Minute, 10 * time.Minute, time.Hour},
+		classifier.Network:          {time.Minute, 10 * time.Minute, time.Hour},
+		classifier.RateLimited:      {RetryDelay, time.Hour, 2 * time.Hour, 4 * time.Hour},
+		classifier.GeoBlocked:       {RetryDelay, 6 * time.Hour},
+		classifier.CopyrightBlocked: {RetryDelay, 6 * time.Hour},
+	},
+}
+
+// Delay returns the delay before the retry-th retry of a url failed with an
+// error of category. It returns false if the url shouldn't be retried.
+func (p BackoffPolicy) Delay(category string, retry int64) (time.Duration, bool) {
+	if retry > p.MaxRetries {
+		return 0, false
+	}
+	delays := p.Delays[category]
+	if len(delays) == 0 {
+		return 0, false
+	}
+	if i := retry - 1; i < int64(len(delays)) {
+		return delays[i], true
+	}
+	return delays[len(delays)-1], true
+}
+
+// ParseBackoffPolicy parses s and returns a new BackoffPolicy with
+// maxRetries. s is a semicolon-separated list of category=delays, with delays
+// being comma-separated durations, e.g. rate_limited=5m,30m,2h;timeout=1m.
+// Categories must be classifier categories, categories missing from s keep
+// the delays of DefaultBackoffPolicy.
+func ParseBackoffPolicy(s string, maxRetries int64) (BackoffPolicy, error) {
+	p := BackoffPolicy{
+		MaxRetries: maxRetries,
+		Delays:     make(map[string][]time.Duration),
+	}
+	for category, delays := range DefaultBackoffPolicy.Delays {
+		p.Delays[category] = delays
+	}
+	if s == "" {
+		return p, nil
+	}
+	for _, kv := range strings.Split(s, ";") {
+		i := strings.Index(kv, "=")
+		if i < 0 {
+			return p, fmt.Errorf("invalid backoff %q", kv)
+		}
+		category := kv[:i]
+		if !classifier.IsCategory(category) {
+			return p, fmt.Errorf("invalid backoff %q: unknown category %q", kv, category)
+		}
+		var delays []time.Duration
+		for _, sd := range strings.Split(kv[i+1:], ",") {
+			d, err := time.ParseDuration(sd)
+			if err != nil {
+				return p, fmt.Errorf("invalid backoff %q: %v", kv, err)
+			}
+			delays = append(delays, d)
+		}
+		p.Delays[category] = delays
+	}
+	return p, nil
+}
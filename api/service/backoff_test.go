@@ -0,0 +1,60 @@
+package service
+
+import (
+	"testing"
+	"time"
+
+	"github.com/yansal/youtube-ar/api/classifier"
+)
+
+func TestBackoffPolicyDelay(t *testing.T) {
+	p := BackoffPolicy{
+		MaxRetries: 3,
+		Delays: map[string][]time.Duration{
+			classifier.RateLimited: {time.Minute, time.Hour},
+		},
+	}
+	for _, tc := range []struct {
+		category string
+		retry    int64
+		delay    time.Duration
+		ok       bool
+	}{
+		{category: classifier.RateLimited, retry: 1, delay: time.Minute, ok: true},
+		{category: classifier.RateLimited, retry: 2, delay: time.Hour, ok: true},
+		{category: classifier.RateLimited, retry: 3, delay: time.Hour, ok: true},
+		{category: classifier.RateLimited, retry: 4},
+		{category: classifier.GeoBlocked, retry: 1},
+		{category: "", retry: 1},
+	} {
+		delay, ok := p.Delay(tc.category, tc.retry)
+		if delay != tc.delay || ok != tc.ok {
+			t.Errorf("expected delay of retry %d of %q to be %v, %v, got %v, %v", tc.retry, tc.category, tc.delay, tc.ok, delay, ok)
+		}
+	}
+}
+
+func TestParseBackoffPolicy(t *testing.T) {
+	p, err := ParseBackoffPolicy("rate_limited=5m,30m;timeout=1m", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.MaxRetries != 2 {
+		t.Errorf("expected max retries to be 2, got %d", p.MaxRetries)
+	}
+	if delays := p.Delays[classifier.RateLimited]; len(delays) != 2 || delays[0] != 5*time.Minute || delays[1] != 30*time.Minute {
+		t.Errorf("unexpected rate_limited delays %v", delays)
+	}
+	if delays := p.Delays[classifier.Timeout]; len(delays) != 1 || delays[0] != time.Minute {
+		t.Errorf("unexpected timeout delays %v", delays)
+	}
+	if delays := p.Delays[classifier.GeoBlocked]; len(delays) != len(DefaultBackoffPolicy.Delays[classifier.GeoBlocked]) {
+		t.Errorf("expected geo_blocked delays to default, got %v", delays)
+	}
+
+	for _, s := range []string{"rate_limited", "rate_limited=5", "rate_limited=5m,", "killed=1m"} {
+		if _, err := ParseBackoffPolicy(s, 2); err == nil {
+			t.Errorf("expected error parsing %q", s)
+		}
+	}
+}
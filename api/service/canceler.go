@@ -0,0 +1,98 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strconv"
+
+	"github.com/yansal/sql/nest"
+	"github.com/yansal/youtube-ar/api/model"
+)
+
+// Canceler is a canceler of downloads.
+type Canceler struct {
+	broker CancelerBroker
+	store  CancelerStore
+}
+
+// CancelerBroker is the broker interface required by Canceler.
+type CancelerBroker interface {
+	Publish(context.Context, string, string) error
+	Subscribe(context.Context, string) (<-chan string, error)
+}
+
+// CancelerStore is the store interface required by Canceler.
+type CancelerStore interface {
+	GetURL(context.Context, nest.Querier, int64) (*model.URL, error)
+	CancelURL(context.Context, nest.Querier, *model.URL) error
+	CancelChildren(context.Context, nest.Querier, int64) ([]model.URL, error)
+	UpdateParentStatus(context.Context, nest.Querier, int64) error
+}
+
+// CancelerWorker is the worker interface required by Canceler.
+type CancelerWorker interface {
+	CancelURL(int64) bool
+}
+
+// NewCanceler returns a new Canceler.
+func NewCanceler(broker CancelerBroker, store CancelerStore) *Canceler {
+	return &Canceler{broker: broker, store: store}
+}
+
+// CancelChannel is the channel of the ids of canceled urls.
+const CancelChannel = "cancel-url"
+
+// ErrNotCancelable is returned when canceling a url that is neither pending
+// nor processing.
+var ErrNotCancelable = errors.New("url is not pending nor processing")
+
+// CancelURL marks the url with id as canceled, and signals the worker
+// downloading it, if any. The children of the url are canceled too, and the
+// status of its parent is updated.
+func (c *Canceler) CancelURL(ctx context.Context, db nest.Querier, id int64) (*model.URL, error) {
+	url, err := c.store.GetURL(ctx, db, id)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.store.CancelURL(ctx, db, url); err == sql.ErrNoRows {
+		return nil, ErrNotCancelable
+	} else if err != nil {
+		return nil, err
+	}
+	children, err := c.store.CancelChildren(ctx, db, id)
+	if err != nil {
+		return nil, err
+	}
+	if url.ParentID.Valid {
+		if err := c.store.UpdateParentStatus(ctx, db, url.ParentID.Int64); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := c.broker.Publish(ctx, CancelChannel, strconv.FormatInt(id, 10)); err != nil {
+		return nil, err
+	}
+	for _, child := range children {
+		if err := c.broker.Publish(ctx, CancelChannel, strconv.FormatInt(child.ID, 10)); err != nil {
+			return nil, err
+		}
+	}
+	return url, nil
+}
+
+// Listen cancels the downloads of w signaled by CancelURL, until ctx is done.
+func (c *Canceler) Listen(ctx context.Context, w CancelerWorker) error {
+	messages, err := c.broker.Subscribe(ctx, CancelChannel)
+	if err != nil {
+		return err
+	}
+	for msg := range messages {
+		id, err := strconv.ParseInt(msg, 10, 64)
+		if err != nil {
+			continue
+		}
+		w.CancelURL(id)
+	}
+	return nil
+}
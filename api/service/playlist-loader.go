@@ -5,6 +5,8 @@ import (
 	"database/sql"
 
 	"github.com/yansal/sql/nest"
+	"github.com/yansal/youtube-ar/api/broker"
+	"github.com/yansal/youtube-ar/api/manager"
 	"github.com/yansal/youtube-ar/api/model"
 	"github.com/yansal/youtube-ar/api/payload"
 	"github.com/yansal/youtube-ar/api/store"
@@ -71,9 +73,16 @@ func (s *PlaylistLoader) getOrCreateYoutubeVideo(ctx context.Context, db nest.Qu
 			return err
 		}
 
-		p := payload.URL{URL: "https://www.youtube.com/watch?v=" + youtubeID}
+		// bulk urls must not delay the urls submitted meanwhile
+		p := payload.URL{
+			URL:      "https://www.youtube.com/watch?v=" + youtubeID,
+			Priority: string(broker.PriorityLow),
+		}
+		// the video may have been submitted on its own before
 		if _, err := s.manager.CreateURL(ctx, tx, p); err != nil {
-			return err
+			if _, ok := err.(*manager.DuplicateError); !ok {
+				return err
+			}
 		}
 		return nil
 	}); err != nil {
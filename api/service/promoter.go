@@ -0,0 +1,44 @@
+package service
+
+import (
+	"context"
+	"time"
+
+	"github.com/yansal/youtube-ar/api/log"
+)
+
+// Promoter is a promoter of scheduled payloads.
+type Promoter struct {
+	broker PromoterBroker
+	log    log.Logger
+}
+
+// PromoterBroker is the broker interface required by Promoter.
+type PromoterBroker interface {
+	Promote(context.Context, string) (int, error)
+}
+
+// NewPromoter returns a new Promoter.
+func NewPromoter(broker PromoterBroker, log log.Logger) *Promoter {
+	return &Promoter{broker: broker, log: log}
+}
+
+// Run sends the scheduled payloads of queues that are due every interval,
+// until ctx is done. Errors are logged, and the payloads are promoted again
+// at the next interval.
+func (p *Promoter) Run(ctx context.Context, queues []string, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			for _, queue := range queues {
+				if _, err := p.broker.Promote(ctx, queue); err != nil && ctx.Err() == nil {
+					p.log.Log(ctx, err.Error(), log.String("queue", queue))
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package service
+
+import (
+	"context"
+	"time"
+
+	"github.com/yansal/youtube-ar/api/log"
+)
+
+// Reaper is a reaper of abandoned in-flight payloads.
+type Reaper struct {
+	broker ReaperBroker
+	log    log.Logger
+}
+
+// ReaperBroker is the broker interface required by Reaper.
+type ReaperBroker interface {
+	Reap(context.Context, string, bool) (int, error)
+}
+
+// NewReaper returns a new Reaper.
+func NewReaper(broker ReaperBroker, log log.Logger) *Reaper {
+	return &Reaper{broker: broker, log: log}
+}
+
+// Reap requeues the in-flight payloads of queues whose lease has expired, or
+// moves them to the failed queues if fail is true.
+func (r *Reaper) Reap(ctx context.Context, queues []string, fail bool) error {
+	for _, queue := range queues {
+		if _, err := r.broker.Reap(ctx, queue, fail); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Run requeues expired in-flight payloads of queues every interval, until ctx
+// is done. Errors are logged, and the payloads are reaped again at the next
+// interval.
+func (r *Reaper) Run(ctx context.Context, queues []string, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			if err := r.Reap(ctx, queues, false); err != nil && ctx.Err() == nil {
+				r.log.Log(ctx, err.Error())
+			}
+		}
+	}
+}
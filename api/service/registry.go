@@ -0,0 +1,98 @@
+package service
+
+import (
+	"context"
+	"time"
+
+	"github.com/yansal/youtube-ar/api/broker"
+	"github.com/yansal/youtube-ar/api/log"
+)
+
+// HeartbeatRetention is the duration after which the heartbeats of stale
+// workers are removed.
+const HeartbeatRetention = time.Hour
+
+// Registry is a registry of the workers, from their heartbeats.
+type Registry struct {
+	broker RegistryBroker
+	log    log.Logger
+}
+
+// RegistryBroker is the broker interface required by Registry.
+type RegistryBroker interface {
+	ListHeartbeats(context.Context) ([]*broker.Heartbeat, error)
+	Beat(context.Context, *broker.Heartbeat) error
+	RemoveHeartbeat(context.Context, string) error
+	Release(context.Context, string, string) error
+}
+
+// NewRegistry returns a new Registry.
+func NewRegistry(broker RegistryBroker, log log.Logger) *Registry {
+	return &Registry{broker: broker, log: log}
+}
+
+// ListWorkers lists the last heartbeat of each worker.
+func (r *Registry) ListWorkers(ctx context.Context) ([]*broker.Heartbeat, error) {
+	return r.broker.ListHeartbeats(ctx)
+}
+
+// RecoverStale releases the in-flight jobs of the stale workers, so that they
+// are received by other workers. The heartbeats of stale workers are kept for
+// HeartbeatRetention. It returns the number of released jobs.
+func (r *Registry) RecoverStale(ctx context.Context) (int, error) {
+	heartbeats, err := r.broker.ListHeartbeats(ctx)
+	if err != nil {
+		return 0, err
+	}
+	now := time.Now()
+	var n int
+	for _, h := range heartbeats {
+		if !h.Stale(now) {
+			continue
+		}
+		if now.Sub(h.SeenAt) > HeartbeatRetention {
+			if err := r.broker.RemoveHeartbeat(ctx, h.ID); err != nil {
+				return n, err
+			}
+			continue
+		}
+		if len(h.Jobs) == 0 {
+			continue
+		}
+		for _, job := range h.Jobs {
+			if job.ID == "" {
+				continue
+			}
+			// the job may have been reaped meanwhile
+			if err := r.broker.Release(ctx, job.Queue, job.ID); err == broker.ErrNoJob {
+				continue
+			} else if err != nil {
+				return n, err
+			}
+			n++
+		}
+		h.Jobs = nil
+		if err := r.broker.Beat(ctx, h); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// Run releases the in-flight jobs of stale workers every interval, until ctx
+// is done. Errors are logged, and the jobs are released again at the next
+// interval.
+func (r *Registry) Run(ctx context.Context, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			if _, err := r.RecoverStale(ctx); err != nil && ctx.Err() == nil {
+				r.log.Log(ctx, err.Error())
+			}
+		}
+	}
+}
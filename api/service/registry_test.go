@@ -0,0 +1,126 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/yansal/youtube-ar/api/broker"
+	"github.com/yansal/youtube-ar/api/log"
+)
+
+func assertf(t *testing.T, ok bool, msg string, args ...interface{}) {
+	t.Helper()
+	if !ok {
+		t.Errorf(msg, args...)
+	}
+}
+
+type logMock struct {
+	logFunc func(ctx context.Context, msg string, fields ...log.Field)
+}
+
+func (l logMock) Log(ctx context.Context, msg string, fields ...log.Field) {
+	if l.logFunc != nil {
+		l.logFunc(ctx, msg, fields...)
+	}
+}
+
+type registryBrokerMock struct {
+	listHeartbeatsFunc  func(context.Context) ([]*broker.Heartbeat, error)
+	beatFunc            func(context.Context, *broker.Heartbeat) error
+	removeHeartbeatFunc func(context.Context, string) error
+	releaseFunc         func(context.Context, string, string) error
+}
+
+func (m registryBrokerMock) ListHeartbeats(ctx context.Context) ([]*broker.Heartbeat, error) {
+	return m.listHeartbeatsFunc(ctx)
+}
+func (m registryBrokerMock) Beat(ctx context.Context, h *broker.Heartbeat) error {
+	return m.beatFunc(ctx, h)
+}
+func (m registryBrokerMock) RemoveHeartbeat(ctx context.Context, id string) error {
+	return m.removeHeartbeatFunc(ctx, id)
+}
+func (m registryBrokerMock) Release(ctx context.Context, queue string, id string) error {
+	return m.releaseFunc(ctx, queue, id)
+}
+
+func TestRegistryRecoverStale(t *testing.T) {
+	now := time.Now()
+	heartbeats := []*broker.Heartbeat{
+		{ID: "alive", SeenAt: now, Jobs: []broker.RunningJob{{ID: "1", Queue: "download-url"}}},
+		{ID: "stale", SeenAt: now.Add(-2 * broker.HeartbeatTimeout), Jobs: []broker.RunningJob{
+			{ID: "2", Queue: "download-url"},
+			{ID: "3", Queue: "get-oembed"},
+		}},
+		{ID: "gone", SeenAt: now.Add(-2 * HeartbeatRetention)},
+	}
+	var (
+		released []string
+		beaten   []*broker.Heartbeat
+		removed  []string
+	)
+	r := NewRegistry(registryBrokerMock{
+		listHeartbeatsFunc: func(context.Context) ([]*broker.Heartbeat, error) {
+			return heartbeats, nil
+		},
+		beatFunc: func(ctx context.Context, h *broker.Heartbeat) error {
+			beaten = append(beaten, h)
+			return nil
+		},
+		removeHeartbeatFunc: func(ctx context.Context, id string) error {
+			removed = append(removed, id)
+			return nil
+		},
+		releaseFunc: func(ctx context.Context, queue string, id string) error {
+			released = append(released, id)
+			if id == "3" {
+				// reaped meanwhile
+				return broker.ErrNoJob
+			}
+			return nil
+		},
+	}, logMock{})
+
+	n, err := r.RecoverStale(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertf(t, n == 1, `expected 1 released job, got %d`, n)
+	assertf(t, len(released) == 2 && released[0] == "2" && released[1] == "3",
+		`expected the jobs of the stale worker to be released, got %v`, released)
+	assertf(t, len(beaten) == 1 && beaten[0].ID == "stale" && beaten[0].Jobs == nil,
+		`expected the stale worker to be recorded without jobs, got %v`, beaten)
+	assertf(t, len(removed) == 1 && removed[0] == "gone",
+		`expected the worker stale for longer than the retention to be removed, got %v`, removed)
+}
+
+func TestRegistryRun(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var (
+		calls  int
+		logged []string
+	)
+	r := NewRegistry(registryBrokerMock{
+		listHeartbeatsFunc: func(context.Context) ([]*broker.Heartbeat, error) {
+			calls++
+			if calls == 1 {
+				return nil, errors.New("redis blip")
+			}
+			cancel()
+			return nil, nil
+		},
+	}, logMock{
+		logFunc: func(ctx context.Context, msg string, fields ...log.Field) {
+			logged = append(logged, msg)
+		},
+	})
+
+	err := r.Run(ctx, time.Millisecond)
+	assertf(t, err == nil, `expected err to be nil, got %+v`, err)
+	assertf(t, calls == 2, `expected 2 calls, got %d`, calls)
+	assertf(t, len(logged) == 1 && logged[0] == "redis blip", `expected the error to be logged, got %+v`, logged)
+}
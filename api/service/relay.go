@@ -0,0 +1,151 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/yansal/sql/nest"
+	"github.com/yansal/youtube-ar/api/broker"
+	"github.com/yansal/youtube-ar/api/log"
+	"github.com/yansal/youtube-ar/api/model"
+	"github.com/yansal/youtube-ar/api/store"
+)
+
+// Relay is a relay publishing outbox entries to the broker.
+type Relay struct {
+	broker RelayBroker
+	store  RelayStore
+	log    log.Logger
+}
+
+// RelayBroker is the broker interface required by Relay.
+type RelayBroker interface {
+	Send(context.Context, string, string, broker.Priority) error
+	SendAt(context.Context, string, string, broker.Priority, time.Time) error
+}
+
+// RelayStore is the store interface required by Relay.
+type RelayStore interface {
+	ClaimOutboxEntries(context.Context, nest.Querier, int64) ([]model.OutboxEntry, error)
+	GetOutboxEntry(context.Context, nest.Querier, int64) (*model.OutboxEntry, error)
+	SetOutboxEntrySent(context.Context, nest.Querier, *model.OutboxEntry) error
+	SetOutboxEntryError(context.Context, nest.Querier, *model.OutboxEntry) error
+}
+
+// NewRelay returns a new Relay.
+func NewRelay(broker RelayBroker, store RelayStore, log log.Logger) *Relay {
+	return &Relay{broker: broker, store: store, log: log}
+}
+
+// RelayBatchSize is the maximum number of outbox entries relayed in a transaction.
+const RelayBatchSize = 100
+
+// Outbox retries. Entries failing to be sent are attempted again after a
+// delay doubling from relayRetryDelay up to maxRelayRetryDelay, until they
+// are dead after MaxRelayAttempts. Dead entries are no longer relayed, but
+// can be replayed.
+const (
+	MaxRelayAttempts   = 15
+	relayRetryDelay    = 5 * time.Second
+	maxRelayRetryDelay = time.Hour
+)
+
+// RelayPending sends the pending outbox entries to the broker. It returns the
+// number of sent entries.
+func (r *Relay) RelayPending(ctx context.Context, db nest.Querier) (int, error) {
+	var n int
+	err := store.Transaction(ctx, db, func(ctx context.Context, tx nest.Querier) error {
+		entries, err := r.store.ClaimOutboxEntries(ctx, tx, RelayBatchSize)
+		if err != nil {
+			return err
+		}
+		for i := range entries {
+			if err := r.send(ctx, tx, &entries[i]); err != nil {
+				return err
+			}
+			if !entries[i].LastError.Valid {
+				n++
+			}
+		}
+		return nil
+	})
+	return n, err
+}
+
+// Run sends the pending outbox entries to the broker every interval, until
+// ctx is done. Errors are logged, and the entries are sent again at the next
+// interval.
+func (r *Relay) Run(ctx context.Context, db nest.Querier, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			if _, err := r.RelayPending(ctx, db); err != nil && ctx.Err() == nil {
+				r.log.Log(ctx, err.Error())
+			}
+		}
+	}
+}
+
+// Replay sends the outbox entry with id to the broker, even if it has already been sent.
+func (r *Relay) Replay(ctx context.Context, db nest.Querier, id int64) error {
+	e, err := r.store.GetOutboxEntry(ctx, db, id)
+	if err != nil {
+		return err
+	}
+	if err := r.send(ctx, db, e); err != nil {
+		return err
+	}
+	if e.LastError.Valid {
+		return fmt.Errorf("couldn't send outbox entry %d: %s", e.ID, e.LastError.String)
+	}
+	return nil
+}
+
+// send sends e to the broker, and records the outcome in db. Errors of the
+// broker are recorded on e instead of being returned, so that the other
+// entries can be sent.
+func (r *Relay) send(ctx context.Context, db nest.Querier, e *model.OutboxEntry) error {
+	// Brokers backed by postgres send the jobs within db, so that entries
+	// are sent exactly once. The send is nested in a savepoint, so that a
+	// failure doesn't abort the transaction of the other entries.
+	err := store.Transaction(ctx, db, func(ctx context.Context, tx nest.Querier) error {
+		bctx := broker.WithTx(ctx, tx)
+		priority, err := broker.ParsePriority(e.Priority)
+		if err != nil {
+			return err
+		}
+		if e.RunAt.After(time.Now()) {
+			return r.broker.SendAt(bctx, e.Queue, e.Payload, priority, e.RunAt)
+		}
+		return r.broker.Send(bctx, e.Queue, e.Payload, priority)
+	})
+	if err != nil {
+		failOutboxEntry(e, err, time.Now())
+		return r.store.SetOutboxEntryError(ctx, db, e)
+	}
+	e.LastError = sql.NullString{}
+	return r.store.SetOutboxEntrySent(ctx, db, e)
+}
+
+// failOutboxEntry records err as the error of the last attempt to send e,
+// and schedules the next attempt, or marks e as dead after MaxRelayAttempts.
+func failOutboxEntry(e *model.OutboxEntry, err error, now time.Time) {
+	e.LastError = sql.NullString{Valid: true, String: err.Error()}
+	attempts := e.Attempts + 1
+	if attempts >= MaxRelayAttempts {
+		e.DeadAt = pq.NullTime{Valid: true, Time: now}
+		return
+	}
+	delay := maxRelayRetryDelay
+	if shift := uint(attempts - 1); shift < 32 && relayRetryDelay<<shift < maxRelayRetryDelay {
+		delay = relayRetryDelay << shift
+	}
+	e.NextAttemptAt = now.Add(delay)
+}
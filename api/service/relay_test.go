@@ -0,0 +1,32 @@
+package service
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/yansal/youtube-ar/api/model"
+)
+
+func TestFailOutboxEntry(t *testing.T) {
+	now := time.Now()
+	for _, tt := range []struct {
+		attempts int64
+		delay    time.Duration
+	}{
+		{attempts: 0, delay: relayRetryDelay},
+		{attempts: 1, delay: 2 * relayRetryDelay},
+		{attempts: 3, delay: 8 * relayRetryDelay},
+		{attempts: MaxRelayAttempts - 2, delay: maxRelayRetryDelay},
+	} {
+		e := &model.OutboxEntry{Attempts: tt.attempts}
+		failOutboxEntry(e, errors.New("broker down"), now)
+		assertf(t, e.LastError.String == "broker down", `expected last error to be "broker down", got %+v`, e.LastError)
+		assertf(t, e.NextAttemptAt.Equal(now.Add(tt.delay)), `expected next attempt of entry with %d attempts after %s, got %s`, tt.attempts, tt.delay, e.NextAttemptAt.Sub(now))
+		assertf(t, !e.DeadAt.Valid, `expected entry with %d attempts not to be dead`, tt.attempts)
+	}
+
+	e := &model.OutboxEntry{Attempts: MaxRelayAttempts - 1}
+	failOutboxEntry(e, errors.New("broker down"), now)
+	assertf(t, e.DeadAt.Valid && e.DeadAt.Time.Equal(now), `expected entry to be dead, got %+v`, e.DeadAt)
+}
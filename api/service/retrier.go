@@ -2,26 +2,38 @@ package service
 
 import (
 	"context"
+	"database/sql"
 	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
 
-	"github.com/go-redis/redis"
 	"github.com/yansal/sql/nest"
+	"github.com/yansal/youtube-ar/api/broker"
 	"github.com/yansal/youtube-ar/api/event"
 	"github.com/yansal/youtube-ar/api/model"
 	"github.com/yansal/youtube-ar/api/payload"
+	"github.com/yansal/youtube-ar/api/query"
+	"github.com/yansal/youtube-ar/api/store"
 )
 
 // Retrier is a retrier.
 type Retrier struct {
-	broker  RetrierBroker
-	manager RetrierManager
-	store   RetrierStore
+	broker     RetrierBroker
+	manager    RetrierManager
+	store      RetrierStore
+	classifier RetrierClassifier
 }
 
 // RetrierBroker is the broker interface required by Retrier.
 type RetrierBroker interface {
-	PopNextFailed(context.Context, string) (string, error)
+	PopNextFailed(context.Context, string) (*broker.Job, error)
 	RemFailed(context.Context, string, string) error
+	ListFailed(context.Context, string, int64, int64) ([]*broker.Job, error)
+	CountFailed(context.Context, string) (int64, error)
+	GetFailed(context.Context, string, string) (*broker.Job, error)
+	RequeueFailed(context.Context, string, string) error
+	PurgeFailed(context.Context, string) (int64, error)
 }
 
 // RetrierManager is the manager interface required by Retrier.
@@ -32,70 +44,242 @@ type RetrierManager interface {
 // RetrierStore is the store interface required by Retrier.
 type RetrierStore interface {
 	GetURL(context.Context, nest.Querier, int64) (*model.URL, error)
+	AppendLog(context.Context, nest.Querier, int64, *model.Log) error
+	UpdateParentStatus(context.Context, nest.Querier, int64) error
+	ResetURL(context.Context, nest.Querier, int64) error
 }
 
+// RetrierClassifier is the classifier interface required by Retrier.
+type RetrierClassifier interface {
+	Classify(err string, logs []string) string
+}
+
+// RetryDelay is the default delay before a failed download-url event is
+// automatically retried.
+const RetryDelay = 30 * time.Minute
+
 // NewRetrier returns a new Retrier.
-func NewRetrier(broker RetrierBroker, manager RetrierManager, store RetrierStore) *Retrier {
-	return &Retrier{broker: broker, manager: manager, store: store}
+func NewRetrier(broker RetrierBroker, manager RetrierManager, store RetrierStore, classifier RetrierClassifier) *Retrier {
+	return &Retrier{broker: broker, manager: manager, store: store, classifier: classifier}
 }
 
-// RetryNextDownloadURL retries the next failed download-url event.
-func (r *Retrier) RetryNextDownloadURL(ctx context.Context, db nest.Querier) error {
-	// TODO: use an atomic rpoplpush to ensure we don't lose any failed event?
-	b, err := r.broker.PopNextFailed(ctx, "download-url")
-	if err == redis.Nil {
+// RetryNextDownloadURL retries the next failed download-url event, according
+// to policy.
+func (r *Retrier) RetryNextDownloadURL(ctx context.Context, db nest.Querier, policy BackoffPolicy) error {
+	err := r.retryNext(ctx, db, policy)
+	if err == broker.ErrNoJob {
 		return nil
-	} else if err != nil {
+	}
+	return err
+}
+
+// Run retries the failed download-url events according to policy, until ctx
+// is done. It waits for interval when there are no failed events left.
+func (r *Retrier) Run(ctx context.Context, db nest.Querier, policy BackoffPolicy, interval time.Duration) error {
+	for {
+		err := r.retryNext(ctx, db, policy)
+		if err == nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			continue
+		} else if err != broker.ErrNoJob {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(interval):
+		}
+	}
+}
+
+// retryNext retries the next failed download-url event according to policy,
+// and records the decision in the logs of the failed url. It returns
+// broker.ErrNoJob if there is no failed event.
+func (r *Retrier) retryNext(ctx context.Context, db nest.Querier, policy BackoffPolicy) error {
+	// TODO: use an atomic rpoplpush to ensure we don't lose any failed event?
+	job, err := r.broker.PopNextFailed(ctx, "download-url")
+	if err != nil {
 		return err
 	}
 
 	var e event.URL
-	if err := json.Unmarshal([]byte(b), &e); err != nil {
+	if err := json.Unmarshal([]byte(job.Payload), &e); err != nil {
 		return err
 	}
 	failed, err := r.store.GetURL(ctx, db, e.ID)
-	if err != nil {
+	if err == sql.ErrNoRows {
+		// the url has been deleted meanwhile
+		return nil
+	} else if err != nil {
 		return err
 	}
 
-	if !failed.ShouldRetry() {
-		return nil
+	category := failed.ErrorCategory.String
+	if !failed.ErrorCategory.Valid {
+		// urls failed before error categories were recorded
+		category = r.classifier.Classify(failed.Error.String, failed.Logs)
 	}
-
-	if failed.Retries.Int64 >= 5 {
-		return nil
+	retry := failed.Retries.Int64 + 1
+	var msg string
+	if _, ok := policy.Delays[category]; !ok {
+		msg = fmt.Sprintf("retrier: skipped, %s error %q is not retryable", category, failed.Error.String)
+	} else if delay, ok := policy.Delay(category, retry); !ok {
+		msg = fmt.Sprintf("retrier: skipped, %s and %d retries reached", category, failed.Retries.Int64)
+	} else {
+		url, err := r.retry(ctx, db, failed, delay)
+		if err != nil {
+			return err
+		}
+		msg = fmt.Sprintf("retrier: %s, retried as url %d after %s (retry %d/%d)", category, url.ID, delay, retry, policy.MaxRetries)
 	}
-
-	_, err = r.retry(ctx, db, failed)
-	return err
+	return r.store.AppendLog(ctx, db, failed.ID, &model.Log{Log: msg})
 }
 
 // RetryDownloadURL retries the download-url event with the given id.
 func (r *Retrier) RetryDownloadURL(ctx context.Context, db nest.Querier, id int64) (*model.URL, error) {
-	e := &event.URL{ID: id}
+	failed, err := r.store.GetURL(ctx, db, id)
+	if err != nil {
+		return nil, err
+	}
+
+	e := &event.URL{ID: failed.ID, URL: failed.URL}
 	b, err := json.Marshal(e)
 	if err != nil {
 		return nil, err
 	}
 
 	// TODO: use an atomic rpoplpush to ensure we don't lose any failed event?
-	if err := r.broker.RemFailed(ctx, "download-url", string(b)); err != nil && err != redis.Nil {
+	if err := r.broker.RemFailed(ctx, "download-url", string(b)); err != nil {
 		return nil, err
 	}
 
-	failed, err := r.store.GetURL(ctx, db, e.ID)
+	return r.retry(ctx, db, failed, 0)
+}
+
+func (r *Retrier) retry(ctx context.Context, db nest.Querier, failed *model.URL, delay time.Duration) (*model.URL, error) {
+	url := payload.URL{
+		URL:       failed.URL,
+		Retries:   failed.Retries.Int64 + 1,
+		Delay:     delay,
+		ParentID:  failed.ParentID.Int64,
+		Extractor: failed.Extractor.String,
+	}
+	if failed.Options != nil {
+		if err := json.Unmarshal(failed.Options, &url.Options); err != nil {
+			return nil, err
+		}
+	}
+	if failed.PostProcess != nil {
+		if err := json.Unmarshal(failed.PostProcess, &url.PostProcess); err != nil {
+			return nil, err
+		}
+	}
+
+	retried, err := r.manager.CreateURL(ctx, db, url)
 	if err != nil {
 		return nil, err
 	}
+	if failed.ParentID.Valid {
+		// the retry supersedes failed in the status of the parent
+		if err := r.store.UpdateParentStatus(ctx, db, failed.ParentID.Int64); err != nil {
+			return nil, err
+		}
+	}
+	return retried, nil
+}
 
-	return r.retry(ctx, db, failed)
+// ListFailed lists the failed jobs of queue, most recent first.
+func (r *Retrier) ListFailed(ctx context.Context, queue string, q *query.Failed) ([]*broker.Job, error) {
+	return r.broker.ListFailed(ctx, queue, q.Offset, q.Limit)
 }
 
-func (r *Retrier) retry(ctx context.Context, db nest.Querier, failed *model.URL) (*model.URL, error) {
-	url := payload.URL{
-		URL:     failed.URL,
-		Retries: failed.Retries.Int64 + 1,
+// CountFailed counts the failed jobs of queue.
+func (r *Retrier) CountFailed(ctx context.Context, queue string) (int64, error) {
+	return r.broker.CountFailed(ctx, queue)
+}
+
+// GetFailed gets the failed job of queue with id.
+func (r *Retrier) GetFailed(ctx context.Context, queue string, id string) (*broker.Job, error) {
+	return r.broker.GetFailed(ctx, queue, id)
+}
+
+// RequeueFailed requeues the failed job of queue with id. The failed url of a
+// download-url job is reset to pending within the same transaction, so that
+// it is downloaded again.
+func (r *Retrier) RequeueFailed(ctx context.Context, db nest.Querier, queue string, id string) error {
+	if queue != "download-url" {
+		return r.broker.RequeueFailed(ctx, queue, id)
+	}
+	job, err := r.broker.GetFailed(ctx, queue, id)
+	if err != nil {
+		return err
 	}
+	var e event.URL
+	if err := json.Unmarshal([]byte(job.Payload), &e); err != nil {
+		return err
+	}
+	return store.Transaction(ctx, db, func(ctx context.Context, tx nest.Querier) error {
+		// The url is reset first, a worker receiving the job before
+		// the commit waits for it to lock the url.
+		if err := r.store.ResetURL(ctx, tx, e.ID); err != nil && err != sql.ErrNoRows {
+			return err
+		}
+		return r.broker.RequeueFailed(ctx, queue, id)
+	})
+}
+
+// FailedFilter is a filter on failed jobs. The zero value matches all jobs.
+type FailedFilter struct {
+	// Error matches the jobs whose last error contains Error.
+	Error string
+}
+
+// Match returns whether job matches f.
+func (f FailedFilter) Match(job *broker.Job) bool {
+	return strings.Contains(job.LastError, f.Error)
+}
+
+// requeueBatchSize is the number of failed jobs listed at once by RequeueFailedWhere.
+const requeueBatchSize = 100
+
+// RequeueFailedWhere requeues the failed jobs of queue matching f. It returns
+// the number of requeued jobs.
+func (r *Retrier) RequeueFailedWhere(ctx context.Context, db nest.Querier, queue string, f FailedFilter) (int, error) {
+	// Collect the ids before requeuing, as requeuing shifts the offsets.
+	var ids []string
+	for offset := int64(0); ; offset += requeueBatchSize {
+		jobs, err := r.broker.ListFailed(ctx, queue, offset, requeueBatchSize)
+		if err != nil {
+			return 0, err
+		}
+		for _, job := range jobs {
+			if f.Match(job) {
+				ids = append(ids, job.ID)
+			}
+		}
+		if len(jobs) < requeueBatchSize {
+			break
+		}
+	}
+
+	var n int
+	for _, id := range ids {
+		if err := r.RequeueFailed(ctx, db, queue, id); err == broker.ErrNoJob {
+			// requeued or popped meanwhile
+			continue
+		} else if err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
 
-	return r.manager.CreateURL(ctx, db, url)
+// PurgeFailed removes all failed jobs of queue. It returns the number of
+// removed jobs.
+func (r *Retrier) PurgeFailed(ctx context.Context, queue string) (int64, error) {
+	return r.broker.PurgeFailed(ctx, queue)
 }
@@ -0,0 +1,138 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// PartSize is the size of the parts of multipart uploads. S3 requires parts
+// of at least 5MiB, except the last one, and at most 10000 parts, so uploads
+// are limited to about 160GiB.
+const PartSize = 16 << 20
+
+// maxParts is the maximum number of parts of a multipart upload.
+var maxParts int64 = 10000
+
+// Part retries.
+const maxPartAttempts = 3
+
+var partRetryDelay = time.Second
+
+// Upload saves the file read from r at path with a multipart upload, holding
+// one part in memory at a time, and returns the sha256 checksum of the file.
+// Parts are sent with their md5 checksum, verified by s3, and retried on
+// failure. Errors of r are returned as is, and abort the upload.
+func (s *Storage) Upload(ctx context.Context, path string, r io.Reader) (string, error) {
+	created, err := s.s3.CreateMultipartUploadWithContext(ctx, &s3.CreateMultipartUploadInput{
+		Bucket:      aws.String(s.bucket),
+		Key:         aws.String(path),
+		ContentType: contentType(path),
+	})
+	if err != nil {
+		return "", err
+	}
+	checksum, err := s.uploadParts(ctx, path, created.UploadId, r)
+	if err != nil {
+		// use a new context, ctx may be canceled
+		abortctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if _, aerr := s.s3.AbortMultipartUploadWithContext(abortctx, &s3.AbortMultipartUploadInput{
+			Bucket:   aws.String(s.bucket),
+			Key:      aws.String(path),
+			UploadId: created.UploadId,
+		}); aerr != nil {
+			return "", fmt.Errorf("%v (and couldn't abort upload: %v)", err, aerr)
+		}
+		return "", err
+	}
+	return checksum, nil
+}
+
+func (s *Storage) uploadParts(ctx context.Context, path string, uploadID *string, r io.Reader) (string, error) {
+	var (
+		sum   = sha256.New()
+		buf   = make([]byte, PartSize)
+		parts []*s3.CompletedPart
+	)
+	for number := int64(1); ; number++ {
+		n, err := io.ReadFull(r, buf)
+		if err == io.EOF && number > 1 {
+			break
+		} else if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return "", err
+		}
+		if number > maxParts {
+			// s3 would only fail the upload on completion
+			return "", fmt.Errorf("storage: file is larger than %d parts of %d bytes", maxParts, len(buf))
+		}
+		sum.Write(buf[:n])
+		part, perr := s.uploadPart(ctx, path, uploadID, number, buf[:n])
+		if perr != nil {
+			return "", perr
+		}
+		parts = append(parts, part)
+		if err != nil {
+			// last part
+			break
+		}
+	}
+
+	_, err := s.s3.CompleteMultipartUploadWithContext(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(s.bucket),
+		Key:             aws.String(path),
+		UploadId:        uploadID,
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: parts},
+	})
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(sum.Sum(nil)), nil
+}
+
+// uploadPart uploads the part b, retrying on failure.
+func (s *Storage) uploadPart(ctx context.Context, path string, uploadID *string, number int64, b []byte) (*s3.CompletedPart, error) {
+	digest := checksum(md5.New(), b)
+	var err error
+	for attempt := 1; attempt <= maxPartAttempts; attempt++ {
+		if attempt > 1 {
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(time.Duration(attempt-1) * partRetryDelay):
+			}
+		}
+		var out *s3.UploadPartOutput
+		out, err = s.s3.UploadPartWithContext(ctx, &s3.UploadPartInput{
+			Body:       bytes.NewReader(b),
+			Bucket:     aws.String(s.bucket),
+			Key:        aws.String(path),
+			UploadId:   uploadID,
+			PartNumber: aws.Int64(number),
+			ContentMD5: aws.String(base64.StdEncoding.EncodeToString(digest)),
+		})
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, err
+			}
+			continue
+		}
+		return &s3.CompletedPart{ETag: out.ETag, PartNumber: aws.Int64(number)}, nil
+	}
+	return nil, fmt.Errorf("storage: couldn't upload part %d after %d attempts: %v", number, maxPartAttempts, err)
+}
+
+func checksum(h hash.Hash, b []byte) []byte {
+	h.Write(b)
+	return h.Sum(nil)
+}
@@ -0,0 +1,142 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+func assertf(t *testing.T, ok bool, msg string, args ...interface{}) {
+	t.Helper()
+	if !ok {
+		t.Errorf(msg, args...)
+	}
+}
+
+type s3Mock struct {
+	s3iface.S3API
+	uploadPartFunc func(*s3.UploadPartInput) (*s3.UploadPartOutput, error)
+
+	parts    map[int64][]byte
+	complete *s3.CompleteMultipartUploadInput
+	aborted  bool
+}
+
+func (m *s3Mock) CreateMultipartUploadWithContext(ctx aws.Context, input *s3.CreateMultipartUploadInput, opts ...request.Option) (*s3.CreateMultipartUploadOutput, error) {
+	m.parts = make(map[int64][]byte)
+	return &s3.CreateMultipartUploadOutput{UploadId: aws.String("upload-id")}, nil
+}
+
+func (m *s3Mock) UploadPartWithContext(ctx aws.Context, input *s3.UploadPartInput, opts ...request.Option) (*s3.UploadPartOutput, error) {
+	if m.uploadPartFunc != nil {
+		return m.uploadPartFunc(input)
+	}
+	b, err := ioutil.ReadAll(input.Body)
+	if err != nil {
+		return nil, err
+	}
+	m.parts[*input.PartNumber] = b
+	sum := md5.Sum(b)
+	return &s3.UploadPartOutput{ETag: aws.String(`"` + hex.EncodeToString(sum[:]) + `"`)}, nil
+}
+
+func (m *s3Mock) CompleteMultipartUploadWithContext(ctx aws.Context, input *s3.CompleteMultipartUploadInput, opts ...request.Option) (*s3.CompleteMultipartUploadOutput, error) {
+	m.complete = input
+	return &s3.CompleteMultipartUploadOutput{}, nil
+}
+
+func (m *s3Mock) AbortMultipartUploadWithContext(ctx aws.Context, input *s3.AbortMultipartUploadInput, opts ...request.Option) (*s3.AbortMultipartUploadOutput, error) {
+	m.aborted = true
+	return &s3.AbortMultipartUploadOutput{}, nil
+}
+
+func init() { partRetryDelay = 0 }
+
+func TestUpload(t *testing.T) {
+	for _, size := range []int{0, 1, PartSize, 2*PartSize + 1} {
+		b := bytes.Repeat([]byte("a"), size)
+		mock := &s3Mock{}
+		s := &Storage{bucket: "bucket", s3: mock}
+		checksum, err := s.Upload(context.Background(), "file.mp4", bytes.NewReader(b))
+		assertf(t, err == nil, "expected nil, got %v", err)
+		sum := sha256.Sum256(b)
+		assertf(t, checksum == hex.EncodeToString(sum[:]), "expected sha256 checksum of %d bytes, got %s", size, checksum)
+		assertf(t, mock.complete != nil, "expected upload of %d bytes to be completed", size)
+
+		var uploaded []byte
+		for i := range mock.complete.MultipartUpload.Parts {
+			uploaded = append(uploaded, mock.parts[int64(i+1)]...)
+		}
+		assertf(t, bytes.Equal(uploaded, b), "expected %d bytes to be uploaded, got %d", size, len(uploaded))
+	}
+}
+
+func TestUploadRetry(t *testing.T) {
+	mock := &s3Mock{}
+	var attempts int
+	mock.uploadPartFunc = func(input *s3.UploadPartInput) (*s3.UploadPartOutput, error) {
+		attempts++
+		if attempts < maxPartAttempts {
+			return nil, errors.New("failed")
+		}
+		mock.uploadPartFunc = nil
+		return mock.UploadPartWithContext(context.Background(), input)
+	}
+	s := &Storage{bucket: "bucket", s3: mock}
+	_, err := s.Upload(context.Background(), "file.mp4", bytes.NewReader([]byte("file")))
+	assertf(t, err == nil, "expected nil, got %v", err)
+	assertf(t, attempts == maxPartAttempts, "expected %d attempts, got %d", maxPartAttempts, attempts)
+
+	mock = &s3Mock{}
+	attempts = 0
+	mock.uploadPartFunc = func(input *s3.UploadPartInput) (*s3.UploadPartOutput, error) {
+		attempts++
+		return nil, errors.New("failed")
+	}
+	s = &Storage{bucket: "bucket", s3: mock}
+	_, err = s.Upload(context.Background(), "file.mp4", bytes.NewReader([]byte("file")))
+	assertf(t, err != nil, "expected an error, got nil")
+	assertf(t, attempts == maxPartAttempts, "expected %d attempts, got %d", maxPartAttempts, attempts)
+	assertf(t, mock.aborted, "expected upload to be aborted")
+	assertf(t, mock.complete == nil, "expected upload not to be completed")
+}
+
+func TestUploadTooManyParts(t *testing.T) {
+	defer func(n int64) { maxParts = n }(maxParts)
+	maxParts = 2
+	mock := &s3Mock{}
+	s := &Storage{bucket: "bucket", s3: mock}
+	_, err := s.Upload(context.Background(), "file.mp4", bytes.NewReader(bytes.Repeat([]byte("a"), 2*PartSize+1)))
+	assertf(t, err != nil, "expected an error, got nil")
+	assertf(t, len(mock.parts) == 2, "expected 2 parts to be uploaded, got %d", len(mock.parts))
+	assertf(t, mock.aborted, "expected upload to be aborted")
+	assertf(t, mock.complete == nil, "expected upload not to be completed")
+
+	mock = &s3Mock{}
+	s = &Storage{bucket: "bucket", s3: mock}
+	_, err = s.Upload(context.Background(), "file.mp4", bytes.NewReader(bytes.Repeat([]byte("a"), 2*PartSize)))
+	assertf(t, err == nil, "expected nil, got %v", err)
+}
+
+func TestUploadReadError(t *testing.T) {
+	mock := &s3Mock{}
+	s := &Storage{bucket: "bucket", s3: mock}
+	rerr := errors.New("youtube-dl failed")
+	_, err := s.Upload(context.Background(), "file.mp4", &errReader{err: rerr})
+	assertf(t, err == rerr, "expected %v, got %v", rerr, err)
+	assertf(t, mock.aborted, "expected upload to be aborted")
+}
+
+type errReader struct{ err error }
+
+func (r *errReader) Read(b []byte) (int, error) { return 0, r.err }
@@ -8,6 +8,7 @@ import (
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
 )
 
 // New returns a new storage.
@@ -26,7 +27,7 @@ func New(bucket string) (*Storage, error) {
 // Storage is a storage.
 type Storage struct {
 	bucket string
-	s3     *s3.S3
+	s3     s3iface.S3API
 }
 
 // Save saves file located at path.
@@ -34,20 +35,26 @@ func (s *Storage) Save(ctx context.Context, path string, reader io.ReadSeeker) e
 	// TODO: add logs
 
 	input := &s3.PutObjectInput{
-		Body:   reader,
-		Bucket: aws.String(s.bucket),
-		Key:    aws.String(path),
+		Body:        reader,
+		Bucket:      aws.String(s.bucket),
+		Key:         aws.String(path),
+		ContentType: contentType(path),
 	}
 
+	_, err := s.s3.PutObjectWithContext(ctx, input)
+	return err
+}
+
+// contentType returns the content type of the file at path, or nil to let s3
+// pick it.
+func contentType(path string) *string {
 	switch {
 	case strings.HasSuffix(path, ".mp3"):
-		input.ContentType = aws.String("audio/mpeg")
+		return aws.String("audio/mpeg")
 	case strings.HasSuffix(path, ".mp4"):
-		input.ContentType = aws.String("video/mp4")
+		return aws.String("video/mp4")
 	case strings.HasSuffix(path, ".webm"):
-		input.ContentType = aws.String("video/webm")
+		return aws.String("video/webm")
 	}
-
-	_, err := s.s3.PutObjectWithContext(ctx, input)
-	return err
+	return nil
 }
@@ -0,0 +1,138 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/yansal/sql/build"
+	"github.com/yansal/sql/nest"
+	"github.com/yansal/sql/scan"
+	"github.com/yansal/youtube-ar/api/model"
+	"github.com/yansal/youtube-ar/api/query"
+)
+
+// CreateOutboxEntry creates e.
+func (*Store) CreateOutboxEntry(ctx context.Context, db nest.Querier, e *model.OutboxEntry) error {
+	runAt := e.RunAt
+	if runAt.IsZero() {
+		runAt = time.Now()
+	}
+	query, args := build.InsertInto("outbox").
+		Values(
+			build.Value("queue", build.Bind(e.Queue)),
+			build.Value("payload", build.Bind(e.Payload)),
+			build.Value("priority", build.Bind(e.Priority)),
+			build.Value("run_at", build.Bind(runAt)),
+		).
+		Returning(build.Columns(e.Columns()...)...).
+		Build()
+
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	return scan.Struct(rows, e)
+}
+
+// ClaimOutboxEntries locks up to limit pending outbox entries whose next
+// attempt is due, skipping the dead entries and the entries already locked by
+// another transaction. db should be a transaction.
+func (*Store) ClaimOutboxEntries(ctx context.Context, db nest.Querier, limit int64) ([]model.OutboxEntry, error) {
+	// build doesn't support locking clauses.
+	query := fmt.Sprintf(`SELECT %s FROM outbox WHERE sent_at IS NULL AND dead_at IS NULL AND next_attempt_at <= now() ORDER BY id LIMIT $1 FOR UPDATE SKIP LOCKED`,
+		strings.Join(model.OutboxEntry{}.Columns(), ", "),
+	)
+	rows, err := db.QueryContext(ctx, query, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []model.OutboxEntry
+	if err := scan.StructSlice(rows, &entries); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// GetOutboxEntry gets the outbox entry with id.
+func (*Store) GetOutboxEntry(ctx context.Context, db nest.Querier, id int64) (*model.OutboxEntry, error) {
+	var e model.OutboxEntry
+	query, args := build.Select(build.Columns(e.Columns()...)...).
+		From(build.Ident("outbox")).
+		Where(build.Ident("id").Equal(build.Bind(id))).
+		Build()
+
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	if err := scan.Struct(rows, &e); err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+// ListPendingOutboxEntries lists the outbox entries that haven't been sent,
+// including the dead ones.
+func (*Store) ListPendingOutboxEntries(ctx context.Context, db nest.Querier, q *query.Outbox) ([]model.OutboxEntry, error) {
+	var e model.OutboxEntry
+	expr := build.Ident("sent_at").IsNull()
+	if q.Cursor != 0 {
+		expr = expr.And(build.Ident("id")).GreaterThan(build.Bind(q.Cursor))
+	}
+	query, args := build.Select(build.Columns(e.Columns()...)...).
+		From(build.Ident("outbox")).
+		Where(expr).
+		OrderBy(build.OrderExpr(build.Ident("id"), build.Asc)).
+		Limit(build.Bind(q.Limit)).
+		Build()
+
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []model.OutboxEntry
+	if err := scan.StructSlice(rows, &entries); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// SetOutboxEntrySent marks e as sent.
+func (*Store) SetOutboxEntrySent(ctx context.Context, db nest.Querier, e *model.OutboxEntry) error {
+	query, args := build.Update("outbox").
+		Set(
+			build.Value("sent_at", build.Bind(time.Now())),
+			build.Value("attempts", build.Ident("attempts").Op("+", build.Int(1))),
+			build.Value("dead_at", build.Bind(pq.NullTime{})),
+		).
+		Where(build.Ident("id").Equal(build.Bind(e.ID))).
+		Build()
+	_, err := db.ExecContext(ctx, query, args...)
+	return err
+}
+
+// SetOutboxEntryError records the error of the last attempt to send e, and
+// when e is attempted again or if it is dead.
+func (*Store) SetOutboxEntryError(ctx context.Context, db nest.Querier, e *model.OutboxEntry) error {
+	query, args := build.Update("outbox").
+		Set(
+			build.Value("last_error", build.Bind(e.LastError)),
+			build.Value("attempts", build.Ident("attempts").Op("+", build.Int(1))),
+			build.Value("next_attempt_at", build.Bind(e.NextAttemptAt)),
+			build.Value("dead_at", build.Bind(e.DeadAt)),
+		).
+		Where(build.Ident("id").Equal(build.Bind(e.ID))).
+		Build()
+	_, err := db.ExecContext(ctx, query, args...)
+	return err
+}
@@ -2,8 +2,12 @@ package store
 
 import (
 	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
 	"time"
 
+	"github.com/lib/pq"
 	"github.com/yansal/sql/build"
 	"github.com/yansal/sql/nest"
 	"github.com/yansal/sql/scan"
@@ -19,33 +23,224 @@ func New() *Store {
 // Store is a store.
 type Store struct{}
 
-// CreateURL creates url.
+// ErrIdempotencyKeyExists is returned by CreateURL when an url with the
+// idempotency key of url has been created concurrently.
+var ErrIdempotencyKeyExists = errors.New("store: idempotency key already exists")
+
+// CreateURL creates url. It returns ErrIdempotencyKeyExists if the
+// idempotency key of url is already used.
 func (*Store) CreateURL(ctx context.Context, db nest.Querier, url *model.URL) error {
 	query, args := build.InsertInto("urls").
 		Values(
 			build.Value("url", build.Bind(url.URL)),
 			build.Value("retries", build.Bind(url.Retries)),
+			build.Value("options", build.Bind(jsonb(url.Options))),
+			build.Value("postprocess", build.Bind(jsonb(url.PostProcess))),
+			build.Value("canonical_key", build.Bind(url.CanonicalKey)),
+			build.Value("idempotency_key", build.Bind(url.IdempotencyKey)),
+			build.Value("parent_id", build.Bind(url.ParentID)),
+			build.Value("extractor", build.Bind(url.Extractor)),
 		).
 		Returning(build.Columns(url.Columns()...)...).
 		Build()
 
 	rows, err := db.QueryContext(ctx, query, args...)
 	if err != nil {
-		return err
+		return idempotencyKeyErr(err)
 	}
 	defer rows.Close()
-	return scan.Struct(rows, url)
+	return idempotencyKeyErr(scan.Struct(rows, url))
+}
+
+// idempotencyKeyErr returns ErrIdempotencyKeyExists if err is a violation of
+// the unique index of idempotency keys, and err otherwise.
+func idempotencyKeyErr(err error) error {
+	if perr, ok := err.(*pq.Error); ok && perr.Code == "23505" && perr.Constraint == "urls_idempotency_key_key" {
+		return ErrIdempotencyKeyExists
+	}
+	return err
 }
 
-// LockURL locks url.
+// GetURLByIdempotencyKey gets the url created with the idempotency key.
+func (*Store) GetURLByIdempotencyKey(ctx context.Context, db nest.Querier, key string) (*model.URL, error) {
+	var url model.URL
+	query, args := build.Select(build.Columns(url.Columns()...)...).
+		From(build.Ident("urls")).
+		Where(build.Ident("idempotency_key").Equal(build.Bind(key))).
+		Build()
+
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	if err := scan.Struct(rows, &url); err != nil {
+		return nil, err
+	}
+	return &url, nil
+}
+
+// LockCanonicalKey takes a transaction-level advisory lock on key, so that
+// concurrent transactions creating urls with key are serialized. db should be
+// a transaction.
+func (*Store) LockCanonicalKey(ctx context.Context, db nest.Querier, key string) error {
+	_, err := db.ExecContext(ctx, `SELECT pg_advisory_xact_lock(hashtext($1))`, key)
+	return err
+}
+
+// FindURLByCanonicalKey finds the last url with the canonical key that is
+// pending, processing or downloaded. It returns sql.ErrNoRows if there is
+// none, e.g. if all the urls with the key failed or were canceled.
+func (*Store) FindURLByCanonicalKey(ctx context.Context, db nest.Querier, key string) (*model.URL, error) {
+	var url model.URL
+	query, args := build.Select(build.Columns(url.Columns()...)...).
+		From(build.Ident("urls")).
+		Where(build.Ident("canonical_key").Equal(build.Bind(key)).
+			And(build.Ident("status")).In(build.Bind([]string{"pending", "processing", "success"})).
+			And(build.Ident("deleted_at")).IsNull()).
+		OrderBy(build.OrderExpr(build.Ident("id"), build.Desc)).
+		Limit(build.Bind(1)).
+		Build()
+
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	if err := scan.Struct(rows, &url); err != nil {
+		return nil, err
+	}
+	return &url, nil
+}
+
+// ErrNotLocked is returned by LockURL when the url isn't pending, e.g. when it
+// is canceled, or already downloaded or failed by another job.
+var ErrNotLocked = errors.New("store: url not locked")
+
+// LockURL locks url if it is pending, and sets its options, post-processing
+// steps, parent and extractor. It returns ErrNotLocked otherwise.
 func (*Store) LockURL(ctx context.Context, db nest.Querier, url *model.URL) error {
 	query, args := build.Update("urls").
 		Set(build.Value("status", build.Bind(url.Status))).
 		Where(build.Ident("id").Equal(build.Bind(url.ID)).
 			And(build.Ident("status").Equal(build.String("pending")))).
+		Returning(build.Columns("options", "postprocess", "parent_id", "extractor")...).
 		Build()
-	_, err := db.ExecContext(ctx, query, args...)
-	return err
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	if err := scan.Struct(rows, url); err == sql.ErrNoRows {
+		return ErrNotLocked
+	} else if err != nil {
+		return err
+	}
+	return nil
+}
+
+// ResetURL resets the url with id to pending, if it failed, so that it can be
+// locked again. It returns sql.ErrNoRows otherwise.
+func (*Store) ResetURL(ctx context.Context, db nest.Querier, id int64) error {
+	query, args := build.Update("urls").
+		Set(
+			build.Value("status", build.String("pending")),
+			build.Value("error", build.Bind(sql.NullString{})),
+			build.Value("error_category", build.Bind(sql.NullString{})),
+		).
+		Where(build.Ident("id").Equal(build.Bind(id)).
+			And(build.Ident("status").Equal(build.String("failure"))),
+		).
+		Build()
+	res, err := db.ExecContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// CancelURL cancels url, if it is pending or processing. It returns
+// sql.ErrNoRows otherwise.
+func (*Store) CancelURL(ctx context.Context, db nest.Querier, url *model.URL) error {
+	query, args := build.Update("urls").
+		Set(build.Value("status", build.String("canceled"))).
+		Where(build.Ident("id").Equal(build.Bind(url.ID)).
+			And(build.Ident("status")).In(build.Bind([]string{"pending", "processing"})).
+			And(build.Ident("deleted_at")).IsNull()).
+		Returning(build.Columns(url.Columns()...)...).
+		Build()
+
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	return scan.Struct(rows, url)
+}
+
+// CancelChildren cancels the children of the url with id that are pending or
+// processing, and returns them.
+func (*Store) CancelChildren(ctx context.Context, db nest.Querier, id int64) ([]model.URL, error) {
+	var url model.URL
+	query, args := build.Update("urls").
+		Set(build.Value("status", build.String("canceled"))).
+		Where(build.Ident("parent_id").Equal(build.Bind(id)).
+			And(build.Ident("status")).In(build.Bind([]string{"pending", "processing"})).
+			And(build.Ident("deleted_at")).IsNull()).
+		Returning(build.Columns(url.Columns()...)...).
+		Build()
+
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var urls []model.URL
+	if err := scan.StructSlice(rows, &urls); err != nil {
+		return nil, err
+	}
+	return urls, nil
+}
+
+// UpdateParentStatus updates the status of the url with id from the statuses
+// of its children: processing while a child is pending or processing, then
+// success if all children succeeded, canceled if all were canceled, and
+// failure otherwise. Children superseded by a retry, i.e. a later child with
+// the same canonical key, are left out. Canceled parents are left as is.
+func (*Store) UpdateParentStatus(ctx context.Context, db nest.Querier, id int64) error {
+	return Transaction(ctx, db, func(ctx context.Context, tx nest.Querier) error {
+		// lock the parent first, so that the update sees the statuses of
+		// children finishing concurrently
+		if _, err := tx.ExecContext(ctx, `SELECT 1 FROM urls WHERE id = $1 FOR UPDATE`, id); err != nil {
+			return err
+		}
+		_, err := tx.ExecContext(ctx, `UPDATE urls SET status = children.status
+FROM (
+	SELECT CASE
+		WHEN bool_or(status IN ('pending', 'processing')) THEN 'processing'
+		WHEN bool_and(status = 'success') THEN 'success'
+		WHEN bool_and(status = 'canceled') THEN 'canceled'
+		ELSE 'failure'
+	END AS status
+	FROM (
+		SELECT DISTINCT ON (coalesce(canonical_key, id::text)) status
+		FROM urls
+		WHERE parent_id = $1 AND deleted_at IS NULL
+		ORDER BY coalesce(canonical_key, id::text), id DESC
+	) latest
+	HAVING count(*) > 0
+) children
+WHERE urls.id = $1 AND urls.status <> 'canceled'`, id)
+		return err
+	})
 }
 
 // UnlockURL unlocks url.
@@ -55,6 +250,7 @@ func (*Store) UnlockURL(ctx context.Context, db nest.Querier, url *model.URL) er
 			build.Value("status", build.Bind(url.Status)),
 			build.Value("file", build.Bind(url.File)),
 			build.Value("error", build.Bind(url.Error)),
+			build.Value("error_category", build.Bind(url.ErrorCategory)),
 		).
 		Where(build.Ident("id").Equal(build.Bind(url.ID)).
 			And(build.Ident("status").Equal(build.String("processing"))),
@@ -67,7 +263,37 @@ func (*Store) UnlockURL(ctx context.Context, db nest.Querier, url *model.URL) er
 // SetOEmbed sets oembed.
 func (*Store) SetOEmbed(ctx context.Context, db nest.Querier, url *model.URL) error {
 	query, args := build.Update("urls").
-		Set(build.Value("oembed", build.Bind(url.OEmbed))).
+		Set(build.Value("oembed", build.Bind(jsonb(url.OEmbed)))).
+		Where(build.Ident("id").Equal(build.Bind(url.ID))).
+		Build()
+	_, err := db.ExecContext(ctx, query, args...)
+	return err
+}
+
+// SetMetadata sets metadata.
+func (*Store) SetMetadata(ctx context.Context, db nest.Querier, url *model.URL) error {
+	query, args := build.Update("urls").
+		Set(build.Value("metadata", build.Bind(jsonb(url.Metadata)))).
+		Where(build.Ident("id").Equal(build.Bind(url.ID))).
+		Build()
+	_, err := db.ExecContext(ctx, query, args...)
+	return err
+}
+
+// SetExtractor sets extractor.
+func (*Store) SetExtractor(ctx context.Context, db nest.Querier, url *model.URL) error {
+	query, args := build.Update("urls").
+		Set(build.Value("extractor", build.Bind(url.Extractor))).
+		Where(build.Ident("id").Equal(build.Bind(url.ID))).
+		Build()
+	_, err := db.ExecContext(ctx, query, args...)
+	return err
+}
+
+// SetProgress sets progress.
+func (*Store) SetProgress(ctx context.Context, db nest.Querier, url *model.URL) error {
+	query, args := build.Update("urls").
+		Set(build.Value("progress", build.Bind(jsonb(url.Progress)))).
 		Where(build.Ident("id").Equal(build.Bind(url.ID))).
 		Build()
 	_, err := db.ExecContext(ctx, query, args...)
@@ -151,6 +377,12 @@ func buildListURLs(q *query.URLs) (string, []interface{}) {
 	if q.Status != nil {
 		expr = expr.And(build.Ident("status")).In(build.Bind(q.Status))
 	}
+	if q.ErrorCategory != nil {
+		expr = expr.And(build.Ident("error_category")).In(build.Bind(q.ErrorCategory))
+	}
+	if q.ParentID != 0 {
+		expr = expr.And(build.Ident("parent_id")).Equal(build.Bind(q.ParentID))
+	}
 	if q.Cursor != 0 {
 		expr = expr.And(build.Ident("id")).LessThan(build.Bind(q.Cursor))
 	}
@@ -197,6 +429,50 @@ func (s *Store) ListLogs(ctx context.Context, db nest.Querier, urlID int64, q *q
 	return logs, nil
 }
 
+// CreateArtifact creates artifact.
+func (*Store) CreateArtifact(ctx context.Context, db nest.Querier, artifact *model.Artifact) error {
+	query, args := build.InsertInto("artifacts").
+		Values(
+			build.Value("url_id", build.Bind(artifact.URLID)),
+			build.Value("kind", build.Bind(artifact.Kind)),
+			build.Value("language", build.Bind(artifact.Language)),
+			build.Value("file", build.Bind(artifact.File)),
+			build.Value("mime_type", build.Bind(artifact.MimeType)),
+			build.Value("size", build.Bind(artifact.Size)),
+		).
+		Returning(build.Columns(artifact.Columns()...)...).
+		Build()
+
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	return scan.Struct(rows, artifact)
+}
+
+// ListArtifacts lists the artifacts of the urls with ids.
+func (*Store) ListArtifacts(ctx context.Context, db nest.Querier, urlIDs []int64) ([]model.Artifact, error) {
+	var artifact model.Artifact
+	query, args := build.Select(build.Columns(artifact.Columns()...)...).
+		From(build.Ident("artifacts")).
+		Where(build.Ident("url_id").Equal(build.CallExpr("any", build.Bind(pq.Array(urlIDs))))).
+		OrderBy(build.OrderExpr(build.Ident("id"), build.Asc)).
+		Build()
+
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var artifacts []model.Artifact
+	if err := scan.StructSlice(rows, &artifacts); err != nil {
+		return nil, err
+	}
+	return artifacts, nil
+}
+
 // CreateYoutubeVideo creates v.
 func (*Store) CreateYoutubeVideo(ctx context.Context, db nest.Querier, v *model.YoutubeVideo) error {
 	query, args := build.InsertInto("youtube_videos").
@@ -235,3 +511,15 @@ func (*Store) GetYoutubeVideoByYoutubeID(ctx context.Context, db nest.Querier, y
 	}
 	return &v, nil
 }
+
+// jsonb binds json-encoded values to jsonb columns: the sql builder can't
+// bind []byte values, and pq would send them as bytea.
+type jsonb []byte
+
+// Value implements driver.Valuer.
+func (j jsonb) Value() (driver.Value, error) {
+	if j == nil {
+		return nil, nil
+	}
+	return string(j), nil
+}
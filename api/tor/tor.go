@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"os"
 	"os/exec"
 	"strings"
@@ -32,7 +33,11 @@ func (*Tor) Start(ctx context.Context) <-chan Event {
 		}
 		defer os.RemoveAll(dir)
 
-		port := getRandomPort()
+		port, err := getRandomPort()
+		if err != nil {
+			stream <- Event{Type: Failure, Err: err}
+			return
+		}
 		cmd := exec.CommandContext(ctx, "tor", "-f", "-")
 		cmd.Stdin = strings.NewReader(fmt.Sprintf(torrcformat, dir, port))
 
@@ -76,9 +81,16 @@ func (*Tor) Start(ctx context.Context) <-chan Event {
 	return stream
 }
 
-func getRandomPort() string {
-	// TODO: get a random port from the OS, just like net.Listen does
-	return "9051"
+// getRandomPort returns a port chosen by the OS, so that concurrent tor
+// processes don't listen on the same port.
+func getRandomPort() (string, error) {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		return "", err
+	}
+	defer l.Close()
+	_, port, err := net.SplitHostPort(l.Addr().String())
+	return port, err
 }
 
 const torrcformat = `DataDirectory %s
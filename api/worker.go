@@ -2,47 +2,103 @@ package main
 
 import (
 	"context"
+	"flag"
 	"net/http"
 	"os"
+	"time"
 
+	"github.com/yansal/sql/nest"
 	"github.com/yansal/youtube-ar/api/broker"
 	"github.com/yansal/youtube-ar/api/downloader"
 	"github.com/yansal/youtube-ar/api/log"
 	loghttp "github.com/yansal/youtube-ar/api/log/http"
 	"github.com/yansal/youtube-ar/api/manager"
 	"github.com/yansal/youtube-ar/api/oembed"
+	"github.com/yansal/youtube-ar/api/postprocess"
+	"github.com/yansal/youtube-ar/api/service"
 	"github.com/yansal/youtube-ar/api/storage"
 	"github.com/yansal/youtube-ar/api/store"
 	"github.com/yansal/youtube-ar/api/tor"
 	"github.com/yansal/youtube-ar/api/worker"
 	"github.com/yansal/youtube-ar/api/worker/handler"
-	"github.com/yansal/youtube-ar/api/youtubedl"
+	"golang.org/x/sync/errgroup"
 )
 
 func runWorker(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("worker", flag.ExitOnError)
+	var (
+		concurrency, timeouts string
+		grace                 time.Duration
+	)
+	fs.StringVar(&concurrency, "concurrency", os.Getenv("WORKER_CONCURRENCY"), "comma-separated queue=n goroutines, e.g. download-url=4,get-oembed=8")
+	fs.StringVar(&timeouts, "timeout", defaultTimeouts(), "comma-separated queue=duration job deadlines, e.g. download-url=2h,get-oembed=1m")
+	fs.DurationVar(&grace, "grace-period", defaultGracePeriod(), "grace period of running jobs on shutdown, before they are requeued")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	c, err := worker.ParseConcurrency(concurrency)
+	if err != nil {
+		return err
+	}
+	t, err := worker.ParseTimeouts(timeouts)
+	if err != nil {
+		return err
+	}
+
 	log := log.New()
-	redis, err := newRedis(log)
+	db, err := newDB(log)
+	if err != nil {
+		return err
+	}
+	b, err := newBroker(log, db)
 	if err != nil {
 		return err
 	}
-	b := broker.New(redis, log)
+	return work(ctx, log, db, b, c, t, grace)
+}
 
+// work runs the worker, receiving jobs from b.
+func work(ctx context.Context, log log.Logger, db nest.Querier, b broker.Broker, concurrency map[string]int, timeouts map[string]time.Duration, grace time.Duration) error {
 	storage, err := storage.New(os.Getenv("S3_BUCKET"))
 	if err != nil {
 		return err
 	}
-	db, err := newDB(log)
+	classifier, err := newClassifier()
+	if err != nil {
+		return err
+	}
+	extractors, err := newExtractors()
+	if err != nil {
+		return err
+	}
+	limiter, err := newLimiter(log, b)
 	if err != nil {
 		return err
 	}
 	store := store.New()
-	downloader := downloader.New(tor.New(), youtubedl.New(), storage, store, log)
+	downloader := downloader.New(tor.New(), extractors, postprocess.New(), storage, store, log)
 	httpclient := loghttp.Wrap(new(http.Client), log)
-	m := manager.NewWorker(downloader, oembed.NewClient(httpclient), store)
+	m := manager.NewWorker(downloader, oembed.NewClient(httpclient), store, classifier, limiter, manager.NewServer(store, manager.DuplicateReturn, txBroker(b)), log)
 
-	w := worker.New(b, map[string]broker.Handler{
+	handlers := map[string]broker.Handler{
 		"download-url": handler.DownloadURL(m, db),
 		"get-oembed":   handler.GetOEmbed(m, db),
-	})
-	return w.Listen(ctx)
+	}
+	var queues []string
+	for queue := range handlers {
+		queues = append(queues, queue)
+	}
+	w := worker.New(b, handlers, concurrency, timeouts, grace, log)
+	reaper := service.NewReaper(b, log)
+	promoter := service.NewPromoter(b, log)
+	canceler := service.NewCanceler(b, store)
+	registry := service.NewRegistry(b, log)
+
+	g, ctx := errgroup.WithContext(ctx)
+	g.Go(func() error { return w.Listen(ctx) })
+	g.Go(func() error { return reaper.Run(ctx, queues, broker.LeaseTimeout) })
+	g.Go(func() error { return promoter.Run(ctx, queues, 10*time.Second) })
+	g.Go(func() error { return canceler.Listen(ctx, m) })
+	g.Go(func() error { return registry.Run(ctx, broker.HeartbeatTimeout) })
+	return g.Wait()
 }
@@ -2,40 +2,271 @@ package worker
 
 import (
 	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/yansal/youtube-ar/api/broker"
+	"github.com/yansal/youtube-ar/api/log"
 	"golang.org/x/sync/errgroup"
 )
 
 // Worker is a worker implementation.
 type Worker struct {
-	broker   Broker
-	handlers map[string]broker.Handler
+	broker      Broker
+	handlers    map[string]broker.Handler
+	concurrency map[string]int
+	timeouts    map[string]time.Duration
+	grace       time.Duration
+	log         log.Logger
+
+	mu   sync.Mutex
+	jobs map[string]broker.RunningJob
+	seq  uint64
 }
 
 // Broker is the broker interface required by Worker.
 type Broker interface {
 	Receive(ctx context.Context, queue string, handler broker.Handler) error
+	Beat(ctx context.Context, h *broker.Heartbeat) error
+	RemoveHeartbeat(ctx context.Context, id string) error
 }
 
-// New returns a new Worker.
-func New(b Broker, h map[string]broker.Handler) *Worker {
-	return &Worker{broker: b, handlers: h}
+// New returns a new Worker. concurrency maps queues to their number of
+// goroutines, queues missing from concurrency get one goroutine. timeouts maps
+// queues to the deadline of their jobs, jobs of queues missing from timeouts
+// have no deadline. When stopping, running jobs are given grace to complete
+// before being requeued.
+func New(b Broker, h map[string]broker.Handler, concurrency map[string]int, timeouts map[string]time.Duration, grace time.Duration, log log.Logger) *Worker {
+	return &Worker{broker: b, handlers: h, concurrency: concurrency, timeouts: timeouts, grace: grace, log: log, jobs: make(map[string]broker.RunningJob)}
 }
 
-// Listen starts a goroutine for each handler.
+// Listen starts concurrency goroutines for each handler. When ctx is done,
+// Listen stops receiving jobs, and waits for the running jobs to complete.
+// The jobs still running after the grace period are canceled and requeued.
+// Listen sends heartbeats until it returns.
 func (w *Worker) Listen(ctx context.Context) error {
+	jobctx, canceljobs := context.WithCancel(context.Background())
+	defer canceljobs()
+
+	stopbeat := w.heartbeat(w.newHeartbeat())
+	defer stopbeat()
+
 	g, ctx := errgroup.WithContext(ctx)
 	for queue, handler := range w.handlers {
 		queue := queue
 		handler := handler
-		g.Go(func() error {
-			for {
-				if err := w.broker.Receive(ctx, queue, handler); err != nil {
-					return err
+		if d := w.timeouts[queue]; d > 0 {
+			handler = withTimeout(handler, d)
+		}
+		handler = w.tracked(queue, drainable(handler, jobctx))
+		n := w.concurrency[queue]
+		if n < 1 {
+			n = 1
+		}
+		for i := 0; i < n; i++ {
+			g.Go(func() error {
+				for ctx.Err() == nil {
+					if err := w.broker.Receive(ctx, queue, handler); err != nil && ctx.Err() == nil {
+						return err
+					}
 				}
+				return nil
+			})
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-done:
+			return
+		case <-ctx.Done():
+		}
+		select {
+		case <-done:
+		case <-time.After(w.grace):
+			canceljobs()
+		}
+	}()
+	err := g.Wait()
+	close(done)
+	return err
+}
+
+// newHeartbeat returns the heartbeat of w.
+func (w *Worker) newHeartbeat() *broker.Heartbeat {
+	host, _ := os.Hostname()
+	pid := os.Getpid()
+	var queues []string
+	for queue := range w.handlers {
+		queues = append(queues, queue)
+	}
+	sort.Strings(queues)
+	return &broker.Heartbeat{
+		ID:        fmt.Sprintf("%s.%d", host, pid),
+		Host:      host,
+		PID:       pid,
+		Queues:    queues,
+		StartedAt: time.Now(),
+	}
+}
+
+// heartbeat sends h with the running jobs of w every
+// broker.HeartbeatInterval, until the returned func is called. The heartbeat
+// is then removed.
+func (w *Worker) heartbeat(h *broker.Heartbeat) func() {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	beat := func() {
+		h.Jobs = w.runningJobs()
+		h.SeenAt = time.Now()
+		ctx := context.Background()
+		if err := w.broker.Beat(ctx, h); err != nil {
+			w.log.Log(ctx, err.Error(), log.String("heartbeat", h.ID))
+		}
+	}
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(broker.HeartbeatInterval)
+		defer ticker.Stop()
+		beat()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				beat()
 			}
-		})
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+		ctx := context.Background()
+		if err := w.broker.RemoveHeartbeat(ctx, h.ID); err != nil {
+			w.log.Log(ctx, err.Error(), log.String("heartbeat", h.ID))
+		}
+	}
+}
+
+// tracked returns a handler calling h, and recording the job as running on w
+// meanwhile.
+func (w *Worker) tracked(queue string, h broker.Handler) broker.Handler {
+	return func(ctx context.Context, payload string) error {
+		id := broker.JobID(ctx)
+		w.mu.Lock()
+		key := id
+		if key == "" {
+			// legacy payloads have no id, key them per receive
+			// so that concurrent ones don't overwrite each other
+			w.seq++
+			key = "legacy-" + strconv.FormatUint(w.seq, 10)
+		}
+		w.jobs[key] = broker.RunningJob{ID: id, Queue: queue, StartedAt: time.Now()}
+		w.mu.Unlock()
+		defer func() {
+			w.mu.Lock()
+			delete(w.jobs, key)
+			w.mu.Unlock()
+		}()
+		return h(ctx, payload)
+	}
+}
+
+// runningJobs returns the running jobs of w, oldest first.
+func (w *Worker) runningJobs() []broker.RunningJob {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	jobs := make([]broker.RunningJob, 0, len(w.jobs))
+	for _, job := range w.jobs {
+		jobs = append(jobs, job)
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].StartedAt.Before(jobs[j].StartedAt) })
+	return jobs
+}
+
+// drainable returns a handler calling h with a context that isn't canceled
+// with the context of the worker, but with jobctx. The jobs interrupted by
+// jobctx are requeued.
+func drainable(h broker.Handler, jobctx context.Context) broker.Handler {
+	return func(ctx context.Context, payload string) error {
+		err := h(jobContext{Context: jobctx, values: ctx}, payload)
+		if err != nil && jobctx.Err() != nil {
+			return broker.ErrRequeue
+		}
+		return err
+	}
+}
+
+// jobContext is a context canceled with its embedded Context, and carrying
+// the values of values.
+type jobContext struct {
+	context.Context
+	values context.Context
+}
+
+func (c jobContext) Value(key interface{}) interface{} {
+	return c.values.Value(key)
+}
+
+// withTimeout returns a handler calling h with a context canceled after d.
+func withTimeout(h broker.Handler, d time.Duration) broker.Handler {
+	return func(ctx context.Context, payload string) error {
+		ctx, cancel := context.WithTimeout(ctx, d)
+		defer cancel()
+		return h(ctx, payload)
+	}
+}
+
+// ParseConcurrency parses a comma-separated list of queue=n pairs, e.g.
+// "download-url=4,get-oembed=8".
+func ParseConcurrency(s string) (map[string]int, error) {
+	concurrency := make(map[string]int)
+	if s == "" {
+		return concurrency, nil
+	}
+	for _, pair := range strings.Split(s, ",") {
+		i := strings.Index(pair, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("invalid concurrency %q, expected queue=n", pair)
+		}
+		n, err := strconv.Atoi(pair[i+1:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid concurrency %q: %v", pair, err)
+		}
+		if n < 1 {
+			return nil, fmt.Errorf("invalid concurrency %q, expected n to be positive", pair)
+		}
+		concurrency[pair[:i]] = n
+	}
+	return concurrency, nil
+}
+
+// ParseTimeouts parses a comma-separated list of queue=duration pairs, e.g.
+// "download-url=2h,get-oembed=1m".
+func ParseTimeouts(s string) (map[string]time.Duration, error) {
+	timeouts := make(map[string]time.Duration)
+	if s == "" {
+		return timeouts, nil
+	}
+	for _, pair := range strings.Split(s, ",") {
+		i := strings.Index(pair, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("invalid timeout %q, expected queue=duration", pair)
+		}
+		d, err := time.ParseDuration(pair[i+1:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid timeout %q: %v", pair, err)
+		}
+		if d <= 0 {
+			return nil, fmt.Errorf("invalid timeout %q, expected duration to be positive", pair)
+		}
+		timeouts[pair[:i]] = d
 	}
-	return g.Wait()
+	return timeouts, nil
 }
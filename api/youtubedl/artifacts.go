@@ -0,0 +1,81 @@
+package youtubedl
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Artifact is a file downloaded alongside the media, e.g. a thumbnail.
+type Artifact struct {
+	Kind     ArtifactKind
+	Path     string
+	Language string // of subtitles
+}
+
+// ArtifactKind is a kind of artifact.
+type ArtifactKind string
+
+// ArtifactKind values.
+const (
+	KindThumbnail ArtifactKind = "thumbnail"
+	KindSubtitles ArtifactKind = "subtitles"
+	KindInfo      ArtifactKind = "info"
+	KindChapters  ArtifactKind = "chapters"
+)
+
+var (
+	thumbnailExts = map[string]bool{".jpg": true, ".jpeg": true, ".png": true, ".webp": true}
+	subtitlesExts = map[string]bool{".vtt": true, ".srt": true, ".ass": true, ".ttml": true, ".srv3": true}
+)
+
+// classify returns the artifact of the file at path, or false if the file is
+// the media.
+func classify(path string) (Artifact, bool) {
+	name := filepath.Base(path)
+	if strings.HasSuffix(name, infoJSONSuffix) {
+		return Artifact{Kind: KindInfo, Path: path}, true
+	}
+	ext := strings.ToLower(filepath.Ext(name))
+	if thumbnailExts[ext] {
+		return Artifact{Kind: KindThumbnail, Path: path}, true
+	}
+	if subtitlesExts[ext] {
+		// subtitles are named like the media, with the language before
+		// the extension, e.g. video.en.vtt
+		lang := strings.TrimPrefix(filepath.Ext(strings.TrimSuffix(name, filepath.Ext(name))), ".")
+		return Artifact{Kind: KindSubtitles, Path: path, Language: lang}, true
+	}
+	return Artifact{}, false
+}
+
+// Chapter is a chapter of a video.
+type Chapter struct {
+	StartTime float64 `json:"start_time"` // seconds
+	EndTime   float64 `json:"end_time"`   // seconds
+	Title     string  `json:"title"`
+}
+
+// writeChapters writes chapters to a WebVTT chapters file at path.
+func writeChapters(path string, chapters []Chapter) error {
+	var b strings.Builder
+	b.WriteString("WEBVTT\n")
+	for i, c := range chapters {
+		fmt.Fprintf(&b, "\n%d\n%s --> %s\n%s\n", i+1, vttTimestamp(c.StartTime), vttTimestamp(c.EndTime), c.Title)
+	}
+	return ioutil.WriteFile(path, []byte(b.String()), 0600)
+}
+
+// vttTimestamp formats seconds as a WebVTT timestamp, e.g. 01:02:03.500.
+func vttTimestamp(seconds float64) string {
+	d := time.Duration(seconds * float64(time.Second)).Round(time.Millisecond)
+	h := d / time.Hour
+	d -= h * time.Hour
+	m := d / time.Minute
+	d -= m * time.Minute
+	s := d / time.Second
+	d -= s * time.Second
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", h, m, s, d/time.Millisecond)
+}
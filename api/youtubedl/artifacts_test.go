@@ -0,0 +1,57 @@
+package youtubedl
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestClassify(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		artifact Artifact
+		ok       bool
+	}{
+		{name: "video-id.mp4"},
+		{name: "video-id.mp3"},
+		{name: "video-id.info.json", artifact: Artifact{Kind: KindInfo}, ok: true},
+		{name: "video-id.jpg", artifact: Artifact{Kind: KindThumbnail}, ok: true},
+		{name: "video-id.webp", artifact: Artifact{Kind: KindThumbnail}, ok: true},
+		{name: "video-id.en.vtt", artifact: Artifact{Kind: KindSubtitles, Language: "en"}, ok: true},
+		{name: "video.v2-id.pt-BR.srt", artifact: Artifact{Kind: KindSubtitles, Language: "pt-BR"}, ok: true},
+	} {
+		path := filepath.Join("dir", tc.name)
+		if tc.ok {
+			tc.artifact.Path = path
+		}
+		artifact, ok := classify(path)
+		if ok != tc.ok || artifact != tc.artifact {
+			t.Errorf("expected %q to be classified as %+v (%v), got %+v (%v)", tc.name, tc.artifact, tc.ok, artifact, ok)
+		}
+	}
+}
+
+func TestWriteChapters(t *testing.T) {
+	dir, err := ioutil.TempDir("", "youtube-ar-youtubedl-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "video.chapters.vtt")
+	if err := writeChapters(path, []Chapter{
+		{StartTime: 0, EndTime: 61.5, Title: "Intro"},
+		{StartTime: 61.5, EndTime: 3723, Title: "Outro"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "WEBVTT\n\n1\n00:00:00.000 --> 00:01:01.500\nIntro\n\n2\n00:01:01.500 --> 01:02:03.000\nOutro\n"
+	if string(b) != expected {
+		t.Errorf("expected chapters to be %q, got %q", expected, b)
+	}
+}
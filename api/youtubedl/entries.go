@@ -0,0 +1,130 @@
+package youtubedl
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os/exec"
+	"strings"
+)
+
+// Entry is an entry of a playlist, or of an url with multiple videos.
+type Entry struct {
+	URL   string
+	Title string
+}
+
+// info is the flat info json of an url.
+type info struct {
+	Type    string      `json:"_type"`
+	Entries []infoEntry `json:"entries"`
+}
+
+type infoEntry struct {
+	ID         string `json:"id"`
+	URL        string `json:"url"`
+	WebpageURL string `json:"webpage_url"`
+	IEKey      string `json:"ie_key"`
+	Title      string `json:"title"`
+}
+
+// ErrPlaylist is returned by Download when youtube-dl starts downloading a
+// playlist, whose entries must be listed with Entries instead.
+var ErrPlaylist = errors.New("youtube-dl: url is a playlist")
+
+// playlistLog prefixes the log of youtube-dl starting to download a playlist,
+// or an url with multiple videos.
+const playlistLog = "[download] Downloading playlist: "
+
+// playlistPaths are path segments of playlist urls, e.g. youtube channels or
+// soundcloud sets.
+var playlistPaths = []string{"playlist", "channel", "c", "user", "sets", "album", "albums", "showcase"}
+
+// IsPlaylist returns whether rawurl is shaped like a playlist, so that its
+// entries are worth listing before downloading it. Other playlists are
+// detected by Download.
+func IsPlaylist(rawurl string) bool {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return false
+	}
+	q := u.Query()
+	// youtube-dl downloads the video of urls with both, e.g. watch?v=&list=
+	if q.Get("list") != "" && q.Get("v") == "" {
+		return true
+	}
+	for _, segment := range strings.Split(u.Path, "/") {
+		if strings.HasPrefix(segment, "@") {
+			return true
+		}
+		for _, p := range playlistPaths {
+			if strings.EqualFold(segment, p) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Entries returns the entries of rawurl if it is a playlist, or an url with
+// multiple videos, without downloading them. It returns nil if rawurl is a
+// single video.
+func (p *YoutubeDL) Entries(ctx context.Context, rawurl string, proxyaddr string) ([]Entry, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, p.binary, "--proxy", proxyaddr, "--no-playlist", "--flat-playlist", "--dump-single-json", "--", rawurl)
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, ErrDeadlineExceeded
+		}
+		return nil, fmt.Errorf("%s: %v: %s", p.name(), err, strings.TrimSpace(stderr.String()))
+	}
+	entries, err := parseEntries(stdout.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", p.name(), err)
+	}
+	return entries, nil
+}
+
+// parseEntries parses the entries of the flat info json b.
+func parseEntries(b []byte) ([]Entry, error) {
+	var i info
+	if err := json.Unmarshal(b, &i); err != nil {
+		return nil, err
+	}
+	if i.Type != "playlist" && i.Type != "multi_video" {
+		return nil, nil
+	}
+	entries := make([]Entry, 0, len(i.Entries))
+	for _, e := range i.Entries {
+		u := entryURL(e)
+		if u == "" {
+			return nil, fmt.Errorf("no url for entry %q", e.ID)
+		}
+		entries = append(entries, Entry{URL: u, Title: e.Title})
+	}
+	return entries, nil
+}
+
+// entryURL returns the url of e. Flat youtube entries only have an id.
+func entryURL(e infoEntry) string {
+	if e.WebpageURL != "" {
+		return e.WebpageURL
+	}
+	if u, err := url.Parse(e.URL); err == nil && u.Scheme != "" && u.Host != "" {
+		return e.URL
+	}
+	if e.IEKey == "Youtube" {
+		id := e.ID
+		if id == "" {
+			id = e.URL
+		}
+		if id != "" {
+			return "https://www.youtube.com/watch?v=" + id
+		}
+	}
+	return ""
+}
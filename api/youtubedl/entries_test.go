@@ -0,0 +1,109 @@
+package youtubedl
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseEntries(t *testing.T) {
+	entries, err := parseEntries([]byte(`{"_type": "video", "id": "dQw4w9WgXcQ"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entries != nil {
+		t.Errorf("expected no entries for a video, got %+v", entries)
+	}
+
+	entries, err = parseEntries([]byte(`{
+		"_type": "playlist",
+		"entries": [
+			{"_type": "url", "ie_key": "Youtube", "id": "dQw4w9WgXcQ", "url": "dQw4w9WgXcQ", "title": "a"},
+			{"_type": "url", "url": "https://vimeo.com/123", "title": "b"},
+			{"webpage_url": "https://example.com/post/1#2", "url": "https://cdn.example.com/2.mp4"}
+		]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Entry{
+		{URL: "https://www.youtube.com/watch?v=dQw4w9WgXcQ", Title: "a"},
+		{URL: "https://vimeo.com/123", Title: "b"},
+		{URL: "https://example.com/post/1#2"},
+	}
+	if !reflect.DeepEqual(entries, expected) {
+		t.Errorf("expected entries to be %+v, got %+v", expected, entries)
+	}
+
+	entries, err = parseEntries([]byte(`{"_type": "playlist", "entries": []}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entries == nil || len(entries) != 0 {
+		t.Errorf("expected empty entries for an empty playlist, got %#v", entries)
+	}
+
+	if _, err := parseEntries([]byte(`{"_type": "playlist", "entries": [{"id": "x", "url": "x"}]}`)); err == nil {
+		t.Errorf("expected an error for an entry without url")
+	}
+}
+
+func TestIsPlaylist(t *testing.T) {
+	for _, tc := range []struct {
+		url      string
+		playlist bool
+	}{
+		{url: "https://www.youtube.com/watch?v=dQw4w9WgXcQ"},
+		{url: "https://www.youtube.com/watch?v=dQw4w9WgXcQ&list=PL123"},
+		{url: "https://youtu.be/dQw4w9WgXcQ"},
+		{url: "https://vimeo.com/123"},
+		{url: "https://www.youtube.com/playlist?list=PL123", playlist: true},
+		{url: "https://www.youtube.com/channel/UC123", playlist: true},
+		{url: "https://www.youtube.com/@handle/videos", playlist: true},
+		{url: "https://soundcloud.com/artist/sets/album", playlist: true},
+	} {
+		if playlist := IsPlaylist(tc.url); playlist != tc.playlist {
+			t.Errorf("expected %s to be a playlist: %v, got %v", tc.url, tc.playlist, playlist)
+		}
+	}
+}
+
+func TestDownloadPlaylist(t *testing.T) {
+	dir, err := ioutil.TempDir("", "youtube-ar-youtubedl-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// fake yt-dlp, starting to download a playlist
+	binary := filepath.Join(dir, "yt-dlp")
+	script := `#!/bin/sh
+case "$*" in
+*--dump-single-json*)
+	echo 'ERROR: unsupported url' >&2
+	exit 1;;
+esac
+echo '[download] Downloading playlist: mix'
+exec sleep 10
+`
+	if err := ioutil.WriteFile(binary, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	var derr error
+	for event := range New(binary, 0, 0).Download(context.Background(), "https://example.com", "", Options{}) {
+		if event.Type == Failure {
+			derr = event.Err
+		}
+	}
+	if derr != ErrPlaylist {
+		t.Errorf("expected %v, got %v", ErrPlaylist, derr)
+	}
+
+	if _, err := New(binary, 0, 0).Entries(context.Background(), "https://example.com", ""); err == nil || !strings.HasPrefix(err.Error(), "yt-dlp: ") {
+		t.Errorf("expected an error of yt-dlp, got %v", err)
+	}
+}
@@ -0,0 +1,55 @@
+package youtubedl
+
+import (
+	"encoding/json"
+	"io/ioutil"
+)
+
+// infoJSONSuffix is the suffix of the info json files written by youtube-dl.
+const infoJSONSuffix = ".info.json"
+
+// Metadata is the metadata of a download, read from the info json written by
+// youtube-dl.
+type Metadata struct {
+	ID          string    `json:"id,omitempty"`
+	Title       string    `json:"title,omitempty"`
+	Description string    `json:"description,omitempty"`
+	Uploader    string    `json:"uploader,omitempty"`
+	UploaderID  string    `json:"uploader_id,omitempty"`
+	Channel     string    `json:"channel,omitempty"`
+	UploadDate  string    `json:"upload_date,omitempty"` // YYYYMMDD
+	Duration    float64   `json:"duration,omitempty"`    // seconds
+	ViewCount   int64     `json:"view_count,omitempty"`
+	LikeCount   int64     `json:"like_count,omitempty"`
+	Tags        []string  `json:"tags,omitempty"`
+	Categories  []string  `json:"categories,omitempty"`
+	WebpageURL  string    `json:"webpage_url,omitempty"`
+	Extractor   string    `json:"extractor,omitempty"`
+	Thumbnail   string    `json:"thumbnail,omitempty"`
+	Chapters    []Chapter `json:"chapters,omitempty"`
+
+	// Format of the downloaded file.
+	FormatID string  `json:"format_id,omitempty"`
+	Format   string  `json:"format,omitempty"`
+	Ext      string  `json:"ext,omitempty"`
+	Width    int     `json:"width,omitempty"`
+	Height   int     `json:"height,omitempty"`
+	FPS      float64 `json:"fps,omitempty"`
+	VCodec   string  `json:"vcodec,omitempty"`
+	ACodec   string  `json:"acodec,omitempty"`
+	Filesize int64   `json:"filesize,omitempty"`
+}
+
+// readMetadata reads the metadata of the info json at path. Fields other than
+// the ones of Metadata, e.g. the list of available formats, are ignored.
+func readMetadata(path string) (*Metadata, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var m Metadata
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
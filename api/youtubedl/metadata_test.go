@@ -0,0 +1,56 @@
+package youtubedl
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestReadMetadata(t *testing.T) {
+	dir, err := ioutil.TempDir("", "youtube-ar-youtubedl-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "video"+infoJSONSuffix)
+	info := `{
+		"id": "dQw4w9WgXcQ",
+		"title": "Never Gonna Give You Up",
+		"uploader": "Rick Astley",
+		"upload_date": "20091025",
+		"duration": 212,
+		"view_count": 1000000000,
+		"like_count": null,
+		"tags": ["rick", "astley"],
+		"formats": [{"format_id": "18"}, {"format_id": "22"}],
+		"format_id": "22",
+		"ext": "mp4",
+		"height": 720
+	}`
+	if err := ioutil.WriteFile(path, []byte(info), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := readMetadata(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := &Metadata{
+		ID:         "dQw4w9WgXcQ",
+		Title:      "Never Gonna Give You Up",
+		Uploader:   "Rick Astley",
+		UploadDate: "20091025",
+		Duration:   212,
+		ViewCount:  1000000000,
+		Tags:       []string{"rick", "astley"},
+		FormatID:   "22",
+		Ext:        "mp4",
+		Height:     720,
+	}
+	if !reflect.DeepEqual(m, expected) {
+		t.Errorf("expected metadata to be %+v, got %+v", expected, m)
+	}
+}
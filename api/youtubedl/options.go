@@ -0,0 +1,189 @@
+package youtubedl
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Options are the format options of a download. The zero value lets
+// youtube-dl pick the format.
+type Options struct {
+	// AudioOnly extracts the audio of the video.
+	AudioOnly bool `json:"audio_only,omitempty"`
+	// MaxHeight is the maximum height of the video, in pixels.
+	MaxHeight int `json:"max_height,omitempty"`
+	// Container is the preferred container, e.g. mp4 or mp3.
+	Container string `json:"container,omitempty"`
+	// Format is a raw youtube-dl format expression, e.g. bestvideo+bestaudio.
+	Format string `json:"format,omitempty"`
+
+	// Thumbnail downloads the thumbnail of the video.
+	Thumbnail bool `json:"thumbnail,omitempty"`
+	// Subtitles are the languages of the subtitles to download, e.g. en.
+	Subtitles []string `json:"subtitles,omitempty"`
+
+	// Stream uploads the file while it is downloaded, without writing it to
+	// disk. Streamed formats are single files, e.g. best instead of
+	// bestvideo+bestaudio.
+	Stream bool `json:"stream,omitempty"`
+}
+
+// IsZero returns true if o is the zero value.
+func (o Options) IsZero() bool {
+	return !o.AudioOnly && o.MaxHeight == 0 && o.Container == "" && o.Format == "" &&
+		!o.Thumbnail && len(o.Subtitles) == 0 && !o.Stream
+}
+
+// Containers of videos and audios.
+var (
+	VideoContainers = []string{"mp4", "webm", "mkv"}
+	AudioContainers = []string{"mp3", "m4a", "opus", "flac", "wav"}
+)
+
+// MaxHeight is the maximum of Options.MaxHeight.
+const MaxHeight = 4320
+
+// MaxSubtitles is the maximum number of languages of Options.Subtitles.
+const MaxSubtitles = 10
+
+// language matches subtitle languages, e.g. en or pt-BR.
+var language = regexp.MustCompile(`^[A-Za-z]{2,3}(-[A-Za-z0-9]{1,8})*$`)
+
+// format matches the characters allowed in youtube-dl format expressions.
+var format = regexp.MustCompile(`^[A-Za-z0-9_+/,.:<>=!*?\[\]()-]{1,200}$`)
+
+func contains(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate returns an error if o is invalid.
+func (o Options) Validate() error {
+	if o.MaxHeight < 0 || o.MaxHeight > MaxHeight {
+		return fmt.Errorf("invalid max height %d, expected a height between 1 and %d", o.MaxHeight, MaxHeight)
+	}
+	if o.AudioOnly && o.MaxHeight != 0 {
+		return errors.New("max height can't be used with audio only")
+	}
+	if o.Container != "" {
+		if o.AudioOnly && !contains(AudioContainers, o.Container) {
+			return fmt.Errorf("invalid audio container %q, expected one of %v", o.Container, AudioContainers)
+		}
+		if !o.AudioOnly && !contains(VideoContainers, o.Container) {
+			return fmt.Errorf("invalid video container %q, expected one of %v, or audio only", o.Container, VideoContainers)
+		}
+	}
+	if o.Format != "" {
+		if !format.MatchString(o.Format) {
+			return fmt.Errorf("invalid format %q", o.Format)
+		}
+		if o.MaxHeight != 0 {
+			return errors.New("max height can't be used with a format")
+		}
+	}
+	if o.Stream {
+		if o.AudioOnly {
+			return errors.New("audio only can't be streamed")
+		}
+		if strings.Contains(o.Format, "+") {
+			return fmt.Errorf("format %q merges formats and can't be streamed", o.Format)
+		}
+	}
+	if len(o.Subtitles) > MaxSubtitles {
+		return fmt.Errorf("too many subtitles, expected at most %d languages", MaxSubtitles)
+	}
+	for _, lang := range o.Subtitles {
+		if !language.MatchString(lang) {
+			return fmt.Errorf("invalid subtitles language %q", lang)
+		}
+	}
+	return nil
+}
+
+// Args returns the youtube-dl arguments of o.
+func (o Options) Args() []string {
+	args := o.formatArgs()
+	if o.Thumbnail {
+		args = append(args, "--write-thumbnail")
+	}
+	if len(o.Subtitles) > 0 {
+		args = append(args, "--write-sub", "--write-auto-sub", "--sub-format", "vtt/srt/best", "--sub-lang", strings.Join(o.Subtitles, ","))
+	}
+	return args
+}
+
+func (o Options) formatArgs() []string {
+	var args []string
+	if o.AudioOnly {
+		f := o.Format
+		if f == "" {
+			f = "bestaudio/best"
+			if o.Container == "m4a" {
+				f = "bestaudio[ext=m4a]/" + f
+			}
+		}
+		args = append(args, "--format", f, "--extract-audio")
+		if o.Container != "" {
+			args = append(args, "--audio-format", o.Container)
+		}
+		return args
+	}
+
+	if o.Stream {
+		return o.streamFormatArgs()
+	}
+
+	f := o.Format
+	if f == "" && (o.MaxHeight != 0 || o.Container != "") {
+		video, audio, best := "bestvideo", "bestaudio", "best"
+		if o.MaxHeight != 0 {
+			height := "[height<=" + strconv.Itoa(o.MaxHeight) + "]"
+			video += height
+			best += height
+		}
+		switch o.Container {
+		case "mp4":
+			video += "[ext=mp4]"
+			audio += "[ext=m4a]"
+		case "webm":
+			video += "[ext=webm]"
+			audio += "[ext=webm]"
+		}
+		f = video + "+" + audio
+		if audio != "bestaudio" {
+			// fall back to any audio container
+			f += "/" + video + "+bestaudio"
+		}
+		f += "/" + best
+	}
+	if f != "" {
+		args = append(args, "--format", f)
+	}
+	if o.Container != "" {
+		args = append(args, "--merge-output-format", o.Container)
+	}
+	return args
+}
+
+// streamFormatArgs returns the youtube-dl arguments of the format of o when
+// streamed: the merging of formats requires files.
+func (o Options) streamFormatArgs() []string {
+	f := o.Format
+	if f == "" {
+		f = "best"
+		if o.MaxHeight != 0 {
+			f += "[height<=" + strconv.Itoa(o.MaxHeight) + "]"
+		}
+		if o.Container != "" {
+			f = f + "[ext=" + o.Container + "]/" + f
+		}
+	}
+	return []string{"--format", f}
+}
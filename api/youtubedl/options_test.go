@@ -0,0 +1,80 @@
+package youtubedl
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestOptionsValidate(t *testing.T) {
+	for _, opts := range []Options{
+		{},
+		{AudioOnly: true, Container: "mp3"},
+		{MaxHeight: 720, Container: "mp4"},
+		{Format: "bestvideo[height<=480]+bestaudio/best"},
+		{Thumbnail: true, Subtitles: []string{"en", "pt-BR"}},
+		{Stream: true, MaxHeight: 720, Container: "mp4"},
+	} {
+		if err := opts.Validate(); err != nil {
+			t.Errorf("unexpected error for %+v: %v", opts, err)
+		}
+	}
+
+	for _, opts := range []Options{
+		{MaxHeight: -1},
+		{MaxHeight: 100000},
+		{AudioOnly: true, MaxHeight: 720},
+		{AudioOnly: true, Container: "mp4"},
+		{Container: "mp3"},
+		{Format: "best; rm -rf /"},
+		{Format: "best", MaxHeight: 720},
+		{Subtitles: []string{"english"}},
+		{Subtitles: []string{"en,fr"}},
+		{Stream: true, AudioOnly: true},
+		{Stream: true, Format: "bestvideo+bestaudio"},
+	} {
+		if err := opts.Validate(); err == nil {
+			t.Errorf("expected an error for %+v", opts)
+		}
+	}
+}
+
+func TestOptionsArgs(t *testing.T) {
+	for _, tc := range []struct {
+		opts Options
+		args []string
+	}{
+		{opts: Options{}, args: nil},
+		{
+			opts: Options{AudioOnly: true, Container: "mp3"},
+			args: []string{"--format", "bestaudio/best", "--extract-audio", "--audio-format", "mp3"},
+		},
+		{
+			opts: Options{MaxHeight: 720},
+			args: []string{"--format", "bestvideo[height<=720]+bestaudio/best[height<=720]"},
+		},
+		{
+			opts: Options{MaxHeight: 1080, Container: "mp4"},
+			args: []string{"--format", "bestvideo[height<=1080][ext=mp4]+bestaudio[ext=m4a]/bestvideo[height<=1080][ext=mp4]+bestaudio/best[height<=1080]", "--merge-output-format", "mp4"},
+		},
+		{
+			opts: Options{Format: "worst"},
+			args: []string{"--format", "worst"},
+		},
+		{
+			opts: Options{Thumbnail: true, Subtitles: []string{"en", "fr"}},
+			args: []string{"--write-thumbnail", "--write-sub", "--write-auto-sub", "--sub-format", "vtt/srt/best", "--sub-lang", "en,fr"},
+		},
+		{
+			opts: Options{Stream: true},
+			args: []string{"--format", "best"},
+		},
+		{
+			opts: Options{Stream: true, MaxHeight: 720, Container: "mp4"},
+			args: []string{"--format", "best[height<=720][ext=mp4]/best[height<=720]"},
+		},
+	} {
+		if args := tc.opts.Args(); !reflect.DeepEqual(args, tc.args) {
+			t.Errorf("expected args of %+v to be %q, got %q", tc.opts, tc.args, args)
+		}
+	}
+}
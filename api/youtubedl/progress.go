@@ -0,0 +1,125 @@
+package youtubedl
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Progress is the progress of a download, parsed from youtube-dl output.
+type Progress struct {
+	Phase           Phase   `json:"phase"`
+	Percent         float64 `json:"percent"`
+	DownloadedBytes int64   `json:"downloaded_bytes,omitempty"`
+	TotalBytes      int64   `json:"total_bytes,omitempty"`
+	Speed           int64   `json:"speed,omitempty"` // bytes per second
+	ETA             int64   `json:"eta,omitempty"`   // seconds
+}
+
+// Phase is a phase of a download.
+type Phase string
+
+// Phase values.
+const (
+	Downloading Phase = "downloading"
+	Downloaded  Phase = "downloaded"
+	Merging     Phase = "merging"
+	Converting  Phase = "converting"
+)
+
+// progressLine matches youtube-dl download progress lines, e.g.
+// "[download]  42.3% of 10.00MiB at  1.00MiB/s ETA 00:05" or
+// "[download] 100% of 10.00MiB in 00:05".
+var progressLine = regexp.MustCompile(`^\[download\]\s+([\d.]+)%\s+of\s+~?\s*([\d.]+[KMGTPEZY]?i?B)` +
+	`(?:\s+at\s+(?:([\d.]+[KMGTPEZY]?i?B)/s|Unknown speed))?` +
+	`(?:\s+ETA\s+(?:([\d:]+)|Unknown ETA))?` +
+	`(?:\s+in\s+[\d:]+)?`)
+
+// ParseProgress parses the progress of a download from a youtube-dl output
+// line. It returns false if line isn't a progress line.
+func ParseProgress(line string) (Progress, bool) {
+	switch {
+	case strings.HasPrefix(line, "[ffmpeg] Merging formats"):
+		return Progress{Phase: Merging, Percent: 100}, true
+	case strings.HasPrefix(line, "[ffmpeg] Destination:"),
+		strings.HasPrefix(line, "[ExtractAudio] Destination:"),
+		strings.HasPrefix(line, "[ffmpeg] Converting"):
+		return Progress{Phase: Converting, Percent: 100}, true
+	}
+
+	m := progressLine.FindStringSubmatch(line)
+	if m == nil {
+		return Progress{}, false
+	}
+	percent, err := strconv.ParseFloat(m[1], 64)
+	if err != nil {
+		return Progress{}, false
+	}
+	total, ok := parseBytes(m[2])
+	if !ok {
+		return Progress{}, false
+	}
+	p := Progress{
+		Phase:           Downloading,
+		Percent:         percent,
+		DownloadedBytes: int64(float64(total) * percent / 100),
+		TotalBytes:      total,
+	}
+	if percent >= 100 {
+		p.Phase = Downloaded
+	}
+	if m[3] != "" {
+		p.Speed, _ = parseBytes(m[3])
+	}
+	if m[4] != "" {
+		if eta, ok := parseETA(m[4]); ok {
+			p.ETA = int64(eta / time.Second)
+		}
+	}
+	return p, true
+}
+
+var byteUnits = map[string]float64{
+	"B":   1,
+	"KiB": 1 << 10,
+	"MiB": 1 << 20,
+	"GiB": 1 << 30,
+	"TiB": 1 << 40,
+	"PiB": 1 << 50,
+	"KB":  1e3,
+	"MB":  1e6,
+	"GB":  1e9,
+	"TB":  1e12,
+	"PB":  1e15,
+}
+
+// parseBytes parses a youtube-dl size, e.g. 10.00MiB.
+func parseBytes(s string) (int64, bool) {
+	i := strings.IndexFunc(s, func(r rune) bool { return (r < '0' || r > '9') && r != '.' })
+	if i <= 0 {
+		return 0, false
+	}
+	unit, ok := byteUnits[s[i:]]
+	if !ok {
+		return 0, false
+	}
+	f, err := strconv.ParseFloat(s[:i], 64)
+	if err != nil {
+		return 0, false
+	}
+	return int64(f * unit), true
+}
+
+// parseETA parses a youtube-dl duration, e.g. 01:02:03 or 00:05.
+func parseETA(s string) (time.Duration, bool) {
+	var d time.Duration
+	for _, part := range strings.Split(s, ":") {
+		n, err := strconv.Atoi(part)
+		if err != nil {
+			return 0, false
+		}
+		d = d*60 + time.Duration(n)
+	}
+	return d * time.Second, true
+}
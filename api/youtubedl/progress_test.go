@@ -0,0 +1,54 @@
+package youtubedl
+
+import "testing"
+
+func TestParseProgress(t *testing.T) {
+	for _, tc := range []struct {
+		line     string
+		progress Progress
+	}{
+		{
+			line:     "[download]  42.0% of 10.00MiB at  1.00MiB/s ETA 00:05",
+			progress: Progress{Phase: Downloading, Percent: 42, DownloadedBytes: 4404019, TotalBytes: 10485760, Speed: 1048576, ETA: 5},
+		},
+		{
+			line:     "[download]   1.0% of ~2.00GiB at Unknown speed ETA Unknown ETA (frag 1/100)",
+			progress: Progress{Phase: Downloading, Percent: 1, DownloadedBytes: 21474836, TotalBytes: 2147483648},
+		},
+		{
+			line:     "[download]  50.0% of 1.00KiB at 512.00B/s ETA 01:02:03",
+			progress: Progress{Phase: Downloading, Percent: 50, DownloadedBytes: 512, TotalBytes: 1024, Speed: 512, ETA: 3723},
+		},
+		{
+			line:     "[download] 100% of 10.00MiB in 00:05",
+			progress: Progress{Phase: Downloaded, Percent: 100, DownloadedBytes: 10485760, TotalBytes: 10485760},
+		},
+		{
+			line:     `[ffmpeg] Merging formats into "video.mp4"`,
+			progress: Progress{Phase: Merging, Percent: 100},
+		},
+		{
+			line:     "[ffmpeg] Destination: audio.mp3",
+			progress: Progress{Phase: Converting, Percent: 100},
+		},
+	} {
+		progress, ok := ParseProgress(tc.line)
+		if !ok {
+			t.Errorf("expected %q to be parsed", tc.line)
+			continue
+		}
+		if progress != tc.progress {
+			t.Errorf("expected progress of %q to be %+v, got %+v", tc.line, tc.progress, progress)
+		}
+	}
+
+	for _, line := range []string{
+		"[youtube] dQw4w9WgXcQ: Downloading webpage",
+		"[download] Destination: video.mp4",
+		"[download] video.mp4 has already been downloaded",
+	} {
+		if _, ok := ParseProgress(line); ok {
+			t.Errorf("expected %q not to be parsed", line)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package youtubedl
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"unicode"
+)
+
+// streamOutput is the output template of streamed downloads, and the name
+// prefix of the artifacts of streamed downloads.
+const streamOutput = "-"
+
+// streamWriter writes the media file written by youtube-dl to stdout to w. It
+// sends a Streaming event with the path of the file before the first write.
+type streamWriter struct {
+	w        io.Writer
+	dir      string
+	stream   chan<- Event
+	watchdog *watchdog
+
+	path    string // set on the first write
+	written int64
+}
+
+func (s *streamWriter) Write(b []byte) (int, error) {
+	if s.path == "" {
+		// youtube-dl writes the info json before the media file
+		s.path = filepath.Join(s.dir, streamName(s.dir))
+		s.stream <- Event{Type: Streaming, Path: s.path}
+	}
+	s.watchdog.output()
+	n, err := s.w.Write(b)
+	atomic.AddInt64(&s.written, int64(n))
+	return n, err
+}
+
+func (s *streamWriter) size() int64 {
+	return atomic.LoadInt64(&s.written)
+}
+
+// streamName returns the name of the media file streamed to dir, like the
+// default youtube-dl output template, from the info json in dir. It falls
+// back to the name of dir.
+func streamName(dir string) string {
+	m, err := readMetadata(filepath.Join(dir, streamOutput+infoJSONSuffix))
+	if err != nil || m.ID == "" {
+		return filepath.Base(dir)
+	}
+	name := m.ID
+	if m.Title != "" {
+		name = sanitize(m.Title) + "-" + m.ID
+	}
+	if m.Ext != "" {
+		name += "." + m.Ext
+	}
+	return name
+}
+
+// sanitize replaces the characters of s not allowed in file names.
+func sanitize(s string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || strings.ContainsRune(`/\:*?"<>|`, r) {
+			return '_'
+		}
+		return r
+	}, s)
+}
+
+// renameArtifacts renames the artifacts of the media file streamed to path,
+// named after the output template, after path. Artifacts that can't be
+// renamed are dropped, after calling log.
+func renameArtifacts(path string, artifacts []Artifact, log func(error)) []Artifact {
+	base := strings.TrimSuffix(path, filepath.Ext(path))
+	renamed := artifacts[:0]
+	for _, artifact := range artifacts {
+		name := filepath.Base(artifact.Path)
+		if strings.HasPrefix(name, streamOutput+".") {
+			newpath := base + strings.TrimPrefix(name, streamOutput)
+			if err := os.Rename(artifact.Path, newpath); err != nil {
+				log(err)
+				continue
+			}
+			artifact.Path = newpath
+		}
+		renamed = append(renamed, artifact)
+	}
+	return renamed
+}
@@ -0,0 +1,79 @@
+package youtubedl
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStream(t *testing.T) {
+	dir, err := ioutil.TempDir("", "youtube-ar-youtubedl-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// fake youtube-dl, writing the info json and a thumbnail before
+	// streaming the media file
+	binary := filepath.Join(dir, "youtube-dl")
+	script := `#!/bin/sh
+echo '{"id": "abc", "title": "a/b: c", "ext": "mp4"}' > -.info.json
+echo thumbnail > -.jpg
+echo '[download]  50.0% of 10.00MiB at  1.00MiB/s ETA 00:05' >&2
+printf media
+`
+	if err := ioutil.WriteFile(binary, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		buf       bytes.Buffer
+		streaming string
+		success   Event
+		progress  bool
+	)
+	for event := range New(binary, 0, 0).Stream(context.Background(), "https://example.com", "", Options{Stream: true}, &buf) {
+		switch event.Type {
+		case Failure:
+			t.Fatal(event.Err)
+		case Streaming:
+			streaming = event.Path
+		case ProgressUpdate:
+			progress = true
+		case Success:
+			success = event
+		}
+	}
+	defer os.RemoveAll(filepath.Dir(success.Path))
+
+	if buf.String() != "media" {
+		t.Errorf("expected media, got %q", buf.String())
+	}
+	if !progress {
+		t.Errorf("expected progress events")
+	}
+	if filepath.Base(streaming) != "a_b_ c-abc.mp4" {
+		t.Errorf("expected a_b_ c-abc.mp4, got %s", streaming)
+	}
+	if success.Path != streaming {
+		t.Errorf("expected %s, got %s", streaming, success.Path)
+	}
+	if success.Metadata == nil || success.Metadata.ID != "abc" {
+		t.Errorf("expected metadata, got %+v", success.Metadata)
+	}
+	if len(success.Artifacts) != 2 {
+		t.Errorf("expected 2 artifacts, got %+v", success.Artifacts)
+	}
+	for _, artifact := range success.Artifacts {
+		name := filepath.Base(artifact.Path)
+		if name != "a_b_ c-abc.info.json" && name != "a_b_ c-abc.jpg" {
+			t.Errorf("unexpected artifact %s", name)
+		}
+		if _, err := os.Stat(artifact.Path); err != nil {
+			t.Errorf("expected nil, got %v", err)
+		}
+	}
+}
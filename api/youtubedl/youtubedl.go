@@ -3,24 +3,64 @@ package youtubedl
 import (
 	"bufio"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"os"
 	"os/exec"
 	"path/filepath"
+	"strings"
 	"sync"
+	"time"
 )
 
-// New returns a new YoutubeDL.
-func New() *YoutubeDL {
-	return &YoutubeDL{}
+// New returns a new YoutubeDL running binary, e.g. youtube-dl or its yt-dlp
+// fork. Downloads writing more than maxFileSize bytes, or not logging anything
+// for idleTimeout, are aborted. Zero values disable the limits.
+func New(binary string, maxFileSize int64, idleTimeout time.Duration) *YoutubeDL {
+	return &YoutubeDL{binary: binary, maxFileSize: maxFileSize, idleTimeout: idleTimeout}
 }
 
 // YoutubeDL is a downloader.
-type YoutubeDL struct{}
+type YoutubeDL struct {
+	binary      string
+	maxFileSize int64
+	idleTimeout time.Duration
+}
+
+// name returns the name of the binary of p, e.g. youtube-dl, to prefix its
+// errors and logs.
+func (p *YoutubeDL) name() string {
+	return filepath.Base(p.binary)
+}
 
-// Download downloads url and returns a stream of Event.
-func (p *YoutubeDL) Download(ctx context.Context, url string, proxyaddr string) <-chan Event {
+// Errors of aborted downloads.
+var (
+	ErrDeadlineExceeded = errors.New("youtube-dl: job deadline exceeded")
+	ErrIdle             = errors.New("youtube-dl: no output for too long")
+	ErrFileTooLarge     = errors.New("youtube-dl: max file size exceeded")
+)
+
+// watchdogInterval is the interval at which the limits of a download are checked.
+const watchdogInterval = time.Second
+
+// Download downloads url with opts and returns a stream of Event.
+func (p *YoutubeDL) Download(ctx context.Context, url string, proxyaddr string, opts Options) <-chan Event {
+	return p.download(ctx, url, proxyaddr, opts, nil)
+}
+
+// Stream downloads url with opts like Download, but writes the media file to
+// w instead of disk. A Streaming event with the path of the file is sent
+// before the first write, and w must be written concurrently with the
+// events. The path is in the dir of the artifacts, but isn't written.
+func (p *YoutubeDL) Stream(ctx context.Context, url string, proxyaddr string, opts Options, w io.Writer) <-chan Event {
+	return p.download(ctx, url, proxyaddr, opts, w)
+}
+
+// download downloads url with opts to the dir of the returned path, or
+// streams it to w if w isn't nil.
+func (p *YoutubeDL) download(ctx context.Context, url string, proxyaddr string, opts Options, w io.Writer) <-chan Event {
 	stream := make(chan Event)
 	go func() {
 		defer close(stream)
@@ -30,40 +70,89 @@ func (p *YoutubeDL) Download(ctx context.Context, url string, proxyaddr string)
 			stream <- Event{Type: Failure, Err: err}
 			return
 		}
+		var success bool
+		defer func() {
+			// on success, the caller removes dir after using the file
+			if !success {
+				os.RemoveAll(dir)
+			}
+		}()
 
-		cmd := exec.CommandContext(ctx, "youtube-dl", "--newline", "--proxy", proxyaddr, "--verbose", url)
+		cmdctx, kill := context.WithCancel(ctx)
+		defer kill()
+		args := append([]string{"--newline", "--proxy", proxyaddr, "--verbose", "--no-playlist", "--write-info-json"}, opts.Args()...)
+		if w != nil {
+			// youtube-dl logs to stderr when writing to stdout
+			args = append(args, "--output", streamOutput)
+		}
+		cmd := exec.CommandContext(cmdctx, p.binary, append(args, "--", url)...)
 		cmd.Dir = dir
 
-		// stream stderr and stdout
+		// stream stderr, and stdout unless it's the media file
+		wd := &watchdog{lastOutput: time.Now()}
+		size := func() int64 { return dirSize(dir) }
+		var sw *streamWriter
+		if w != nil {
+			sw = &streamWriter{w: w, dir: dir, stream: stream, watchdog: wd}
+			cmd.Stdout = sw
+			size = sw.size
+		}
 		stderr, err := cmd.StderrPipe()
 		if err != nil {
 			stream <- Event{Type: Failure, Err: err}
 			return
 		}
-		stdout, err := cmd.StdoutPipe()
-		if err != nil {
-			stream <- Event{Type: Failure, Err: err}
-			return
+		var stdout io.Reader
+		if sw == nil {
+			if stdout, err = cmd.StdoutPipe(); err != nil {
+				stream <- Event{Type: Failure, Err: err}
+				return
+			}
 		}
 		var wg sync.WaitGroup
-		wg.Add(2)
 		slurp := func(r io.Reader) {
 			defer wg.Done()
 			s := bufio.NewScanner(r)
 			for s.Scan() {
-				stream <- Event{Type: Log, Log: s.Text()}
+				wd.output()
+				line := s.Text()
+				stream <- Event{Type: Log, Log: line}
+				if strings.HasPrefix(line, playlistLog) {
+					wd.abortWith(ErrPlaylist)
+					kill()
+					continue
+				}
+				if progress, ok := ParseProgress(line); ok {
+					stream <- Event{Type: ProgressUpdate, Progress: progress}
+				}
 			}
 		}
+		wg.Add(1)
 		go slurp(stderr)
-		go slurp(stdout)
+		if stdout != nil {
+			wg.Add(1)
+			go slurp(stdout)
+		}
 
 		if err := cmd.Start(); err != nil {
 			stream <- Event{Type: Failure, Err: err}
 			return
 		}
+		stopwatchdog := p.watch(cmdctx, wd, size, kill)
 
 		wg.Wait()
-		if err := cmd.Wait(); err != nil {
+		err = cmd.Wait()
+		stopwatchdog()
+		if wd.err() == ErrPlaylist {
+			// youtube-dl may be done before it is killed
+			err = ErrPlaylist
+		}
+		if err != nil {
+			if werr := wd.err(); werr != nil {
+				err = werr
+			} else if ctx.Err() == context.DeadlineExceeded {
+				err = ErrDeadlineExceeded
+			}
 			stream <- Event{Type: Failure, Err: err}
 			return
 		}
@@ -73,22 +162,154 @@ func (p *YoutubeDL) Download(ctx context.Context, url string, proxyaddr string)
 			stream <- Event{Type: Failure, Err: err}
 			return
 		}
-		if len(fis) != 1 {
-			err := fmt.Errorf("expected 1 file in %s, got %d", dir, len(fis))
-			stream <- Event{Type: Failure, Err: err}
-			return
+		var (
+			files     []string
+			artifacts []Artifact
+			metadata  *Metadata
+		)
+		for _, fi := range fis {
+			path := filepath.Join(dir, fi.Name())
+			artifact, ok := classify(path)
+			if !ok {
+				files = append(files, path)
+				continue
+			}
+			artifacts = append(artifacts, artifact)
+			if artifact.Kind != KindInfo {
+				continue
+			}
+			// the metadata are optional, don't fail the download
+			if metadata, err = readMetadata(path); err != nil {
+				stream <- Event{Type: Log, Log: fmt.Sprintf("%s: couldn't read %s: %v", p.name(), fi.Name(), err)}
+			}
+		}
+		var path string
+		if sw != nil {
+			if len(files) != 0 || sw.path == "" {
+				err := fmt.Errorf("expected 1 streamed media file and no file in %s, got %d", dir, len(files))
+				stream <- Event{Type: Failure, Err: err}
+				return
+			}
+			path = sw.path
+			artifacts = renameArtifacts(path, artifacts, func(err error) {
+				stream <- Event{Type: Log, Log: fmt.Sprintf("%s: couldn't rename artifact: %v", p.name(), err)}
+			})
+		} else {
+			if len(files) != 1 {
+				err := fmt.Errorf("expected 1 media file in %s, got %d", dir, len(files))
+				stream <- Event{Type: Failure, Err: err}
+				return
+			}
+			path = files[0]
 		}
-		stream <- Event{Type: Success, Path: filepath.Join(dir, fis[0].Name())}
+		if metadata != nil && len(metadata.Chapters) > 0 {
+			path := strings.TrimSuffix(path, filepath.Ext(path)) + ".chapters.vtt"
+			if err := writeChapters(path, metadata.Chapters); err != nil {
+				stream <- Event{Type: Log, Log: fmt.Sprintf("%s: couldn't write chapters: %v", p.name(), err)}
+			} else {
+				artifacts = append(artifacts, Artifact{Kind: KindChapters, Path: path})
+			}
+		}
+		success = true
+		stream <- Event{Type: Success, Path: path, Artifacts: artifacts, Metadata: metadata}
 	}()
 	return stream
 }
 
+// watchdog records the output of a download, and why it was aborted.
+type watchdog struct {
+	mu         sync.Mutex
+	lastOutput time.Time
+	abort      error
+}
+
+func (w *watchdog) output() {
+	w.mu.Lock()
+	w.lastOutput = time.Now()
+	w.mu.Unlock()
+}
+
+// abortWith records that the download is aborted because of err, unless it
+// already is.
+func (w *watchdog) abortWith(err error) {
+	w.mu.Lock()
+	if w.abort == nil {
+		w.abort = err
+	}
+	w.mu.Unlock()
+}
+
+func (w *watchdog) err() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.abort
+}
+
+// watch periodically checks the limits of the download of the given size, and
+// calls kill when one is exceeded, until the returned func is called.
+func (p *YoutubeDL) watch(ctx context.Context, w *watchdog, size func() int64, kill func()) func() {
+	if p.idleTimeout <= 0 && p.maxFileSize <= 0 {
+		return func() {}
+	}
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(watchdogInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			var abort error
+			w.mu.Lock()
+			idle := time.Since(w.lastOutput)
+			w.mu.Unlock()
+			if p.idleTimeout > 0 && idle > p.idleTimeout {
+				abort = ErrIdle
+			} else if p.maxFileSize > 0 && size() > p.maxFileSize {
+				abort = ErrFileTooLarge
+			}
+			if abort != nil {
+				w.abortWith(abort)
+				kill()
+				return
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+// dirSize returns the total size of the files in dir.
+func dirSize(dir string) int64 {
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return 0
+	}
+	var size int64
+	for _, fi := range fis {
+		size += fi.Size()
+	}
+	return size
+}
+
 // Event is a downloader event.
 type Event struct {
-	Type EventType
-	Log  string
-	Err  error
-	Path string
+	Type      EventType
+	Log       string
+	Err       error
+	Path      string // on streaming and success
+	Progress  Progress
+	Artifacts []Artifact // on success
+	Metadata  *Metadata  // on success, nil if youtube-dl didn't write any
 }
 
 // EventType is an event type.
@@ -99,4 +320,6 @@ const (
 	Log EventType = iota
 	Failure
 	Success
+	ProgressUpdate
+	Streaming
 )
@@ -29,6 +29,19 @@ class Video extends React.Component {
     this.props.onRetry(this.props.video.id)
   }
 
+  handleCancel = event => {
+    fetch(`${API_URL}/urls/${this.props.video.id}/cancel`, {
+      method: 'POST'
+    }).then(response => {
+      if (!response.ok) {
+        return
+      }
+      response.json().then(video => {
+        this.setState({ video })
+      })
+    })
+  }
+
   refresh = () => {
     const { video } = this.state
 
@@ -76,6 +89,9 @@ class Video extends React.Component {
           <div>{this.getStatus()}</div>
 
           <button onClick={this.handleDelete}>Delete</button>
+          {(video.status === 'pending' || video.status === 'processing') && (
+            <button onClick={this.handleCancel}>Cancel</button>
+          )}
           {video.status !== 'success' && <button onClick={this.handleRetry}>Retry</button>}
           {video.file && (
             <div>
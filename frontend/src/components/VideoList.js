@@ -132,6 +132,7 @@ class VideoList extends React.Component {
           <option value="failure">Failure</option>
           <option value="processing">Processing</option>
           <option value="pending">Pending</option>
+          <option value="canceled">Canceled</option>
         </select>
         <input type="text" onChange={this.handleSearchChange} placeholder="Search" />
         {list ? <ul className="yar-video-list">{listNodes}</ul> : <div>Nothing to show!</div>}